@@ -2,8 +2,6 @@
 Example on how to retrieve a jwt from machine to machine point of view.
 Your application should be registered on the oauthsrv server in order to work.
 In the registration process you should receive a `client_id` and a `client_secret`.
-
-NOTE: this feature is not implemented in `oauthsrv`
 '''
 import requests
 
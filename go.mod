@@ -6,6 +6,7 @@ require (
 	github.com/google/uuid v1.3.0
 	github.com/kylelemons/godebug v1.1.0
 	go.mongodb.org/mongo-driver v1.5.4
+	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
 	gotest.tools v2.2.0+incompatible
 )
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"github.com/ale-cci/oauthsrv/pkg/server"
 )
 
 func main() {
@@ -15,9 +16,6 @@ func main() {
 		log.Panicf("Unable to initialize server: %v", err)
 	}
 
-	router := http.NewServeMux()
-	handlers.AddRoutes(cnf, router)
-
 	log.Printf("Server started on %s", addr)
-	http.ListenAndServe(addr, router)
+	log.Fatal(http.ListenAndServe(addr, server.New(cnf)))
 }
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/**
+ * Client application registered on the server, stored in the
+ * `apps` collection.
+ */
+type App struct {
+	Id     string `bson:"_id"`
+	Name   string `bson:"name"`
+	Type   string `bson:"type"`
+	Secret string `bson:"client_secret"`
+
+	// exact uris where the user could be redirected after the authorization
+	RedirectURIs []string `bson:"redirect_uris"`
+
+	// scopes the application is allowed to request, if empty any scope
+	// could be requested
+	Scopes []string `bson:"scopes"`
+}
+
+// Public apps can't keep a secret, they're required to use pkce
+func (app *App) isPublic() bool {
+	return app.Type == "public"
+}
+
+func GetApp(ctx context.Context, cnf *Config, clientId string) (*App, error) {
+	var app App
+
+	err := cnf.Database.Collection("apps").FindOne(
+		ctx,
+		bson.D{{Key: "_id", Value: clientId}},
+	).Decode(&app)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch app: %v", err)
+	}
+	return &app, nil
+}
+
+// Returns the redirect uri to use for the authorization request, empty
+// string if the requested uri is not registered
+func (app *App) redirectURI(requested string) string {
+	if requested == "" {
+		if len(app.RedirectURIs) == 1 {
+			return app.RedirectURIs[0]
+		}
+		return ""
+	}
+
+	for _, uri := range app.RedirectURIs {
+		if uri == requested {
+			return uri
+		}
+	}
+	return ""
+}
+
+// Checks that each of the space separated scopes can be requested by the app
+func (app *App) allowsScope(scope string) bool {
+	if len(app.Scopes) == 0 {
+		return true
+	}
+
+	for _, requested := range splitScope(scope) {
+		// openid only asks for an id token, does not grant any access
+		if requested == "openid" {
+			continue
+		}
+
+		found := false
+		for _, allowed := range app.Scopes {
+			if allowed == requested {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -5,11 +5,19 @@ package handlers
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ale-cci/oauthsrv/pkg/jwt"
 	"github.com/ale-cci/oauthsrv/pkg/keystore"
+	"github.com/ale-cci/oauthsrv/pkg/mux"
+	"github.com/ale-cci/oauthsrv/pkg/passwords"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -23,6 +31,22 @@ type Config struct {
 
 	// application keystore, used to sign jwts
 	Keystore keystore.Keystore
+
+	// algorithm of the tokens signed by the server. When empty, the
+	// first algorithm supported by the keystore
+	SigningAlgorithm string
+
+	// public url of the server, identifies the issuer of the tokens.
+	// When empty it's derived from each request
+	Issuer string
+
+	// rules checked when a password is set
+	PasswordPolicy *passwords.Policy
+
+	// builds the urls of the named routes, set by `AddRoutes`
+	urls interface {
+		URL(name string, pairs ...string) (string, error)
+	}
 }
 
 /**
@@ -39,14 +63,228 @@ func EnvConfig() (*Config, error) {
 		return nil, fmt.Errorf("Unable establish connection: %v", err)
 	}
 
-	ks, _ := keystore.NewTempKeystore()
+	db := client.Database(os.Getenv("DB_NAME"))
+
+	if err := createIdentityIndexes(context.Background(), db); err != nil {
+		return nil, fmt.Errorf("Unable to create indexes: %v", err)
+	}
+
+	ks, err := envKeystore(db)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load keystore: %v", err)
+	}
+
+	alg := os.Getenv("SIGNING_ALGORITHM")
+	if alg != "" && !contains(ks.SigningAlgorithms(), alg) {
+		return nil, fmt.Errorf("Invalid SIGNING_ALGORITHM: keystore could not sign with %q", alg)
+	}
+
+	peppers, err := envPeppers()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load password peppers: %v", err)
+	}
+	passwords.SetPeppers(peppers)
+
+	policy, err := envPasswordPolicy()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load password policy: %v", err)
+	}
 
 	return &Config{
-		Database: client.Database(os.Getenv("DB_NAME")),
-		Keystore: ks,
+		Database:         db,
+		Keystore:         ks,
+		SigningAlgorithm: alg,
+		Issuer:           strings.TrimSuffix(os.Getenv("ISSUER"), "/"),
+		PasswordPolicy:   policy,
 	}, nil
 }
 
+/**
+ * Peppers mixed into password and client secret hashes, from
+ * `PASSWORD_PEPPERS` or the file at `PASSWORD_PEPPERS_FILE`.
+ * Returns nil when neither is set.
+ */
+func envPeppers() (*passwords.Peppers, error) {
+	if text := os.Getenv("PASSWORD_PEPPERS"); text != "" {
+		return passwords.ParsePeppers(text)
+	}
+
+	if path := os.Getenv("PASSWORD_PEPPERS_FILE"); path != "" {
+		return passwords.LoadPeppers(path)
+	}
+	return nil, nil
+}
+
+// Minimum password length, when `PASSWORD_MIN_LENGTH` is not set
+const defaultPasswordMinLength = 8
+
+/**
+ * Password policy from `PASSWORD_MIN_LENGTH`, `PASSWORD_MIN_CLASSES` and
+ * `PASSWORD_BLOCKLIST`, the path of a breached passwords SHA-1 list.
+ */
+func envPasswordPolicy() (*passwords.Policy, error) {
+	policy := &passwords.Policy{
+		Algorithm: passwords.Default,
+		MinLength: defaultPasswordMinLength,
+	}
+
+	if minLength := os.Getenv("PASSWORD_MIN_LENGTH"); minLength != "" {
+		value, err := strconv.Atoi(minLength)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PASSWORD_MIN_LENGTH: %v", err)
+		}
+		policy.MinLength = value
+	}
+
+	if minClasses := os.Getenv("PASSWORD_MIN_CLASSES"); minClasses != "" {
+		value, err := strconv.Atoi(minClasses)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PASSWORD_MIN_CLASSES: %v", err)
+		}
+		policy.MinClasses = value
+	}
+
+	if path := os.Getenv("PASSWORD_BLOCKLIST"); path != "" {
+		blocklist, err := passwords.OpenBlocklist(path)
+		if err != nil {
+			return nil, err
+		}
+		policy.Blocklist = blocklist
+	}
+	return policy, nil
+}
+
+// Directory with the PEM private keys, when `KEYSTORE_DIR` is not set
+const defaultKeystoreDir = "/etc/oauthsrv"
+
+// Interval between checks for new keys in the keystore directory
+const keystoreWatchInterval = 30 * time.Second
+
+/**
+ * When `KEYSTORE_KEK` is set, keys are stored on the database and shared among
+ * all the instances, encrypted with the base64 encoded key-encryption key.
+ * Otherwise keys are loaded from the PEM files in `KEYSTORE_DIR`, and reloaded
+ * when the directory changes. If the directory has no keys, a temporary
+ * keystore is used instead, and tokens are invalidated at each restart.
+ *
+ * Generated keys are rotated when `KEY_ROTATION_INTERVAL` is set.
+ */
+func envKeystore(db *mongo.Database) (keystore.Keystore, error) {
+	ks, err := baseKeystore(db)
+	if err != nil {
+		return nil, err
+	}
+
+	rotation := os.Getenv("KEY_ROTATION_INTERVAL")
+	if rotation == "" {
+		return ks, nil
+	}
+
+	interval, err := time.ParseDuration(rotation)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid KEY_ROTATION_INTERVAL: %v", err)
+	}
+
+	managed, ok := ks.(keystore.ManagedKeystore)
+	if !ok {
+		return nil, fmt.Errorf("Keys loaded from files could not be rotated")
+	}
+
+	rotating, err := keystore.NewRotatingKeystore(managed, rotationPolicy(interval))
+	if err != nil {
+		return nil, err
+	}
+
+	go rotating.Run(context.Background(), rotating.Policy.PublishDelay/2)
+	return rotating, nil
+}
+
+/**
+ * New keys are published a quarter of the interval before being used, at
+ * most one hour. Retired keys are kept until the tokens they signed expire.
+ */
+func rotationPolicy(interval time.Duration) keystore.RotationPolicy {
+	publishDelay := interval / 4
+	if publishDelay > time.Hour {
+		publishDelay = time.Hour
+	}
+
+	return keystore.RotationPolicy{
+		Interval:     interval,
+		PublishDelay: publishDelay,
+		Retention:    time.Duration(jwt.TokenLifetime) * time.Second,
+	}
+}
+
+func baseKeystore(db *mongo.Database) (keystore.Keystore, error) {
+	if encodedKEK := os.Getenv("KEYSTORE_KEK"); encodedKEK != "" {
+		kek, err := base64.StdEncoding.DecodeString(encodedKEK)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid KEYSTORE_KEK: %v", err)
+		}
+		return keystore.NewMongoKeystore(db, kek)
+	}
+
+	dir := os.Getenv("KEYSTORE_DIR")
+	if dir == "" {
+		dir = defaultKeystoreDir
+	}
+
+	ks, err := keystore.NewFileKeystore(dir)
+	if err != nil {
+		log.Printf("Using temporary keystore: %v", err)
+		return keystore.NewTempKeystore()
+	}
+
+	// removed keys verify the tokens they signed until they expire
+	ks.Retention = time.Duration(jwt.TokenLifetime) * time.Second
+	go ks.Watch(context.Background(), keystoreWatchInterval)
+	return ks, nil
+}
+
+/**
+ * Returns the issuer url, if not configured it's built from the
+ * host of the request.
+ */
+func (cnf *Config) issuer(r *http.Request) string {
+	if cnf.Issuer != "" {
+		return cnf.Issuer
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+/**
+ * Algorithm of the signed tokens. Keys loaded from files could change
+ * while the server is running, so the default is resolved on each call.
+ */
+func (cnf *Config) signingAlgorithm() string {
+	if cnf.SigningAlgorithm != "" {
+		return cnf.SigningAlgorithm
+	}
+	return jwt.SigningAlgorithm(cnf.Keystore)
+}
+
+// Signs a token with the configured algorithm
+func (cnf *Config) signJWT(claims jwt.JWTBody) (string, error) {
+	return jwt.NewJWTWithAlgorithm(cnf.Keystore, cnf.signingAlgorithm(), claims)
+}
+
+/**
+ * Returns the path of the named route, e.g.
+ * `cnf.url("user-groups", "user_id", id)`
+ */
+func (cnf *Config) url(name string, pairs ...string) (string, error) {
+	if cnf.urls == nil {
+		return "", fmt.Errorf("Routes not registered")
+	}
+	return cnf.urls.URL(name, pairs...)
+}
+
 /**
  * Inject the configuration to a custom handler function,
  * returning a standard `http.HandlerFunc`
@@ -56,3 +294,15 @@ func (cnf *Config) apply(handler func(*Config, http.ResponseWriter, *http.Reques
 		handler(cnf, w, r)
 	}
 }
+
+/**
+ * Converts a middleware with access to the configuration to a
+ * router middleware
+ */
+func (cnf *Config) middleware(middleware CnfMiddleware) mux.Middleware {
+	return func(next http.Handler) http.Handler {
+		return cnf.apply(middleware(func(_ *Config, w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
@@ -11,22 +11,20 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-func handleGroups(cnf *Config, w http.ResponseWriter, r *http.Request) {
-	handler := CheckJWT(handleGroupsGET, func(_ jwt.JWTBody) error { return nil })
-	handler(cnf, w, r)
+type JSONApi struct {
+	Data    interface{}   `json:"data,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Errors  interface{}   `json:"errors,omitempty"`
+	Links   *JSONApiLinks `json:"links,omitempty"`
 }
 
-type JSONApi struct {
-	Data    interface{} `json:"data,omitempty"`
-	Message string      `json:"message,omitempty"`
+// Links of paginated responses
+type JSONApiLinks struct {
+	Next string `json:"next,omitempty"`
 }
 
 func getJWTBody(r *http.Request) (jwt.JWTBody, error) {
-	authHeader := r.Header.Get("authorization")
-	var encodedJWT string
-	fmt.Sscanf(authHeader, "Bearer %s", &encodedJWT)
-
-	decodedJWT, err := jwt.Decode(encodedJWT)
+	decodedJWT, err := jwt.Decode(bearerToken(r))
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get body from jwt: %v", err)
 	}
@@ -53,7 +51,7 @@ func canReadGroups(groups []string) []regexp.Regexp {
 
 			if len(matches) > 0 {
 				groupName := matches[1]
-				reg := fmt.Sprintf("%s:.*", groupName)
+				reg := fmt.Sprintf("^%s:.*$", regexp.QuoteMeta(groupName))
 				regs = append(regs, *regexp.MustCompile(reg))
 			}
 		}
@@ -61,8 +59,7 @@ func canReadGroups(groups []string) []regexp.Regexp {
 	return regs
 }
 
-func handleGroupsGET(cnf *Config, w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("content-type", "application/json")
+func handleGroups(cnf *Config, w http.ResponseWriter, r *http.Request) {
 	encoder := json.NewEncoder(w)
 
 	jwtBody, _ := getJWTBody(r)
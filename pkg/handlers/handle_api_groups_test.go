@@ -11,17 +11,15 @@ import (
 
 	"github.com/ale-cci/oauthsrv/pkg/handlers"
 	"github.com/ale-cci/oauthsrv/pkg/jwt"
-	"github.com/ale-cci/oauthsrv/pkg/mux"
+	"github.com/ale-cci/oauthsrv/pkg/server"
 	"go.mongodb.org/mongo-driver/bson"
 	"gotest.tools/assert"
 )
 
 func TestHandleGroupsApi(t *testing.T) {
-	router := mux.NewServeMux()
 	cnf, err := handlers.EnvConfig()
 	assert.NilError(t, err)
-	handlers.AddRoutes(cnf, router)
-	srv := httptest.NewServer(router)
+	srv := httptest.NewServer(server.New(cnf))
 	defer srv.Close()
 
 	cnf.Database.Collection("identities").Drop(context.Background())
@@ -53,6 +51,14 @@ func TestHandleGroupsApi(t *testing.T) {
 				{Key: "_id", Value: "the-app2-manager"},
 				{Key: "groups", Value: []string{"app-2:manager"}},
 			},
+			bson.D{
+				{Key: "_id", Value: "the-similar-projects-user"},
+				{Key: "groups", Value: []string{"xapp1:read", "app1x:read", "app1:read", "a.b:read", "axb:read"}},
+			},
+			bson.D{
+				{Key: "_id", Value: "the-dotted-admin"},
+				{Key: "groups", Value: []string{"a.b:admin"}},
+			},
 		},
 	)
 
@@ -65,7 +71,7 @@ func TestHandleGroupsApi(t *testing.T) {
 		assert.Check(t, auth != "")
 	})
 
-	token1, err := jwt.NewJWT(cnf.Keystore, jwt.JWTBody{"sub": "the-first-user"})
+	token1, err := handlers.NewAccessToken(cnf, jwt.JWTBody{"sub": "the-first-user"})
 	assert.NilError(t, err)
 
 	t.Run("owner should be able to check it's groups", func(t *testing.T) {
@@ -98,7 +104,7 @@ func TestHandleGroupsApi(t *testing.T) {
 	t.Run("should return 403 if sub is not provided", func(t *testing.T) {
 		req, err := http.NewRequest("GET", srv.URL+"/api/users/the-first-user/groups", nil)
 		assert.NilError(t, err)
-		token, err := jwt.NewJWT(cnf.Keystore, jwt.JWTBody{})
+		token, err := handlers.NewAccessToken(cnf, jwt.JWTBody{})
 		assert.NilError(t, err)
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
@@ -110,7 +116,7 @@ func TestHandleGroupsApi(t *testing.T) {
 	t.Run("users without any permissions should not be able to retrieve user groups", func(t *testing.T) {
 		req, err := http.NewRequest("GET", srv.URL+"/api/users/the-second-user/groups", nil)
 		assert.NilError(t, err)
-		token2, err := jwt.NewJWT(cnf.Keystore, jwt.JWTBody{"sub": "the-first-user"})
+		token2, err := handlers.NewAccessToken(cnf, jwt.JWTBody{"sub": "the-first-user"})
 		assert.NilError(t, err)
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token2))
 
@@ -173,6 +179,18 @@ func TestHandleGroupsApi(t *testing.T) {
 				GetGroupsOf: "the-second-user",
 				ViewsGroups: []string{"app-2:read"},
 			},
+			{
+				TcName:      "app admins should not view groups of projects with similar names",
+				Sub:         "the-app1-admin",
+				GetGroupsOf: "the-similar-projects-user",
+				ViewsGroups: []string{"app1:read"},
+			},
+			{
+				TcName:      "project names should not be matched as patterns",
+				Sub:         "the-dotted-admin",
+				GetGroupsOf: "the-similar-projects-user",
+				ViewsGroups: []string{"a.b:read"},
+			},
 			{
 				TcName:      "user without permissions should not see other's groups",
 				Sub:         "the-second-user",
@@ -186,7 +204,7 @@ func TestHandleGroupsApi(t *testing.T) {
 				req, err := http.NewRequest("GET", srv.URL+"/api/users/"+tc.GetGroupsOf+"/groups", nil)
 				assert.NilError(t, err)
 
-				token, err := jwt.NewJWT(cnf.Keystore, jwt.JWTBody{
+				token, err := handlers.NewAccessToken(cnf, jwt.JWTBody{
 					"sub": tc.Sub,
 				})
 				assert.NilError(t, err)
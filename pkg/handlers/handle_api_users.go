@@ -0,0 +1,627 @@
+// Users management api
+// Creates, lists, updates and disables the identities. Users in the `admin`
+// or `manager` groups manage every user, `<project-id>:admin` and
+// `<project-id>:manager` only the users in the groups of the project.
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+
+	"github.com/ale-cci/oauthsrv/pkg/mux"
+	"github.com/ale-cci/oauthsrv/pkg/passwords"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Users returned in a page of the list, when `limit` is not provided
+const (
+	defaultUsersPageSize = 20
+	maxUsersPageSize     = 100
+)
+
+/**
+ * Identity as returned by the api, the password is never exposed
+ */
+type userResource struct {
+	Id            string   `json:"id"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name,omitempty"`
+	Surname       string   `json:"surname,omitempty"`
+	Address       string   `json:"address,omitempty"`
+	Groups        []string `json:"groups"`
+	Disabled      bool     `json:"disabled"`
+}
+
+/**
+ * Body of the create and update requests, fields not provided are
+ * left unchanged.
+ */
+type userRequest struct {
+	Email         *string `json:"email"`
+	EmailVerified *bool   `json:"email_verified"`
+	Password      *string `json:"password"`
+	Name          *string `json:"name"`
+	Surname       *string `json:"surname"`
+	Address       *string `json:"address"`
+
+	// only on creation, groups have their own endpoints
+	Groups []string `json:"groups"`
+
+	// only on update
+	Disabled *bool `json:"disabled"`
+	// required when users change their own password
+	CurrentPassword *string `json:"current_password"`
+}
+
+/**
+ * Permissions of the authenticated user on the other identities
+ */
+type userPermissions struct {
+	sub    string
+	global bool
+
+	// groups the user could manage
+	manages []regexp.Regexp
+}
+
+func loadPermissions(r *http.Request, cnf *Config) (*userPermissions, error) {
+	jwtBody, err := getJWTBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, _ := jwtBody["sub"].(string)
+	perms := &userPermissions{sub: sub}
+
+	identity, err := FindIdentity(r.Context(), cnf, sub)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// e.g. tokens issued to clients
+		return perms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !identity.Disabled {
+		perms.global = contains(identity.Groups, "admin") || contains(identity.Groups, "manager")
+		perms.manages = canReadGroups(identity.Groups)
+	}
+	return perms, nil
+}
+
+func (perms *userPermissions) canManageGroup(group string) bool {
+	for _, reg := range perms.manages {
+		if reg.MatchString(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Groups giving permissions on other users, global or of a project
+var privilegedGroup = regexp.MustCompile("^(admin|manager|.*:admin|.*:manager)$")
+
+/**
+ * Users are managed by global managers, or by the managers of one of
+ * their groups. Project managers could not manage users with privileges
+ * outside their projects, nor global managers.
+ */
+func (perms *userPermissions) canManage(identity *Identity) bool {
+	if perms.global {
+		return true
+	}
+
+	managed := false
+	for _, group := range identity.Groups {
+		inScope := perms.canManageGroup(group)
+		if privilegedGroup.MatchString(group) && !inScope {
+			return false
+		}
+		managed = managed || inScope
+	}
+	return managed
+}
+
+// Groups of the identity shown to the authenticated user
+func (perms *userPermissions) visibleGroups(identity *Identity) []string {
+	groups := []string{}
+	for _, group := range identity.Groups {
+		if perms.sub == identity.Uid || perms.canManageGroup(group) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func (perms *userPermissions) resource(identity *Identity) userResource {
+	return userResource{
+		Id:            identity.Uid,
+		Email:         identity.Email,
+		EmailVerified: identity.EmailVerified,
+		Name:          identity.Name,
+		Surname:       identity.Surname,
+		Address:       identity.Address,
+		Groups:        perms.visibleGroups(identity),
+		Disabled:      identity.Disabled,
+	}
+}
+
+// Content type is set by the `jsonResponse` middleware of the api routes
+func writeJSON(w http.ResponseWriter, status int, body JSONApi) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func decodeUserRequest(r *http.Request) (*userRequest, error) {
+	var body userRequest
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		return nil, fmt.Errorf("Invalid request body: %v", err)
+	}
+
+	if body.Email != nil {
+		address, err := mail.ParseAddress(*body.Email)
+		if err != nil || address.Address != *body.Email {
+			return nil, fmt.Errorf("Invalid email %q", *body.Email)
+		}
+	}
+	return &body, nil
+}
+
+/**
+ * Hashes the new password of the user, after checking the password policy.
+ * Writes the response on failure.
+ */
+func hashNewPassword(cnf *Config, w http.ResponseWriter, password, email string) (string, bool) {
+	if cnf.PasswordPolicy != nil {
+		err := cnf.PasswordPolicy.Check(password, email)
+
+		var policyErr *passwords.PolicyError
+		if errors.As(err, &policyErr) {
+			writeJSON(w, http.StatusUnprocessableEntity, JSONApi{
+				Message: "Password does not satisfy the password policy",
+				Errors:  policyErr.Violations,
+			})
+			return "", false
+		}
+		if err != nil {
+			log.Printf("Unable to check password policy: %v", err)
+			writeJSON(w, http.StatusInternalServerError, JSONApi{Message: "Unable to check password"})
+			return "", false
+		}
+	}
+
+	hashed, err := passwords.New(rand.Reader, password)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, JSONApi{Message: err.Error()})
+		return "", false
+	}
+	return hashed, true
+}
+
+/**
+ * Disabled users could not refresh the tokens already issued
+ */
+func revokeUserTokens(ctx context.Context, cnf *Config, uid string) error {
+	_, err := cnf.Database.Collection("refresh_tokens").UpdateMany(
+		ctx,
+		bson.D{{Key: "sub", Value: uid}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "revoked", Value: true}}}},
+	)
+	return err
+}
+
+func handleUsersCreate(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	perms, err := loadPermissions(r, cnf)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, JSONApi{Message: err.Error()})
+		return
+	}
+
+	if !perms.global && len(perms.manages) == 0 {
+		writeJSON(w, http.StatusForbidden, JSONApi{Message: "Token lacks the permission to create users"})
+		return
+	}
+
+	body, err := decodeUserRequest(r)
+	if err == nil && body.Email == nil {
+		err = fmt.Errorf("Missing email")
+	}
+	if err == nil && body.Disabled != nil {
+		err = fmt.Errorf("Users could not be created disabled")
+	}
+	if err == nil && body.CurrentPassword != nil {
+		err = fmt.Errorf("Current password is only accepted on update")
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, JSONApi{Message: err.Error()})
+		return
+	}
+
+	// project managers would not be able to manage users outside their groups
+	if !perms.global && len(body.Groups) == 0 {
+		writeJSON(w, http.StatusForbidden, JSONApi{Message: "Users should be created in a group of the project"})
+		return
+	}
+
+	groups := []string{}
+	for _, group := range body.Groups {
+		if !perms.canManageGroup(group) {
+			writeJSON(w, http.StatusForbidden, JSONApi{Message: fmt.Sprintf("Token lacks the permission to assign group %q", group)})
+			return
+		}
+		if !contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+
+	identity := Identity{
+		Uid:    uuid.New().String(),
+		Email:  *body.Email,
+		Groups: groups,
+	}
+	if body.EmailVerified != nil {
+		identity.EmailVerified = *body.EmailVerified
+	}
+	if body.Name != nil {
+		identity.Name = *body.Name
+	}
+	if body.Surname != nil {
+		identity.Surname = *body.Surname
+	}
+	if body.Address != nil {
+		identity.Address = *body.Address
+	}
+
+	document := bson.D{
+		{Key: "_id", Value: identity.Uid},
+		{Key: "email", Value: identity.Email},
+		{Key: "email_verified", Value: identity.EmailVerified},
+		{Key: "name", Value: identity.Name},
+		{Key: "surname", Value: identity.Surname},
+		{Key: "address", Value: identity.Address},
+		{Key: "groups", Value: identity.Groups},
+		{Key: "disabled", Value: false},
+	}
+
+	if body.Password != nil {
+		hashed, ok := hashNewPassword(cnf, w, *body.Password, identity.Email)
+		if !ok {
+			return
+		}
+		document = append(document, bson.E{Key: "password", Value: hashed})
+	}
+
+	_, err = cnf.Database.Collection("identities").InsertOne(r.Context(), document)
+	if mongo.IsDuplicateKeyError(err) {
+		writeJSON(w, http.StatusConflict, JSONApi{Message: "Email already in use"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, JSONApi{Message: "Unable to create user"})
+		return
+	}
+
+	if location, err := cnf.url("user", "user_id", identity.Uid); err == nil {
+		w.Header().Set("location", location)
+	}
+	writeJSON(w, http.StatusCreated, JSONApi{Data: perms.resource(&identity)})
+}
+
+/**
+ * Lists the users managed by the authenticated user, ordered by id.
+ * Filtered by `email` or `group`, pages are requested with `limit` and
+ * `after`, the id of the last user of the previous page.
+ */
+func handleUsersList(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	perms, err := loadPermissions(r, cnf)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, JSONApi{Message: err.Error()})
+		return
+	}
+
+	if !perms.global && len(perms.manages) == 0 {
+		writeJSON(w, http.StatusForbidden, JSONApi{Message: "Token lacks the permission to list users"})
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultUsersPageSize
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxUsersPageSize {
+			writeJSON(w, http.StatusBadRequest, JSONApi{
+				Message: fmt.Sprintf("Limit should be between 1 and %d", maxUsersPageSize),
+			})
+			return
+		}
+	}
+
+	filters := bson.A{}
+	if email := query.Get("email"); email != "" {
+		filters = append(filters, bson.D{{Key: "email", Value: email}})
+	}
+	if group := query.Get("group"); group != "" {
+		filters = append(filters, bson.D{{Key: "groups", Value: group}})
+	}
+	if after := query.Get("after"); after != "" {
+		filters = append(filters, bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: after}}}})
+	}
+
+	if !perms.global {
+		managed := bson.A{}
+		for _, reg := range perms.manages {
+			managed = append(managed, primitive.Regex{Pattern: reg.String()})
+		}
+		// same rules of `canManage`: users with privileged groups outside
+		// the managed projects are excluded
+		filters = append(filters,
+			bson.D{{Key: "groups", Value: bson.D{{Key: "$in", Value: managed}}}},
+			bson.D{{Key: "$nor", Value: bson.A{
+				bson.D{{Key: "groups", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+					{Key: "$regex", Value: primitive.Regex{Pattern: privilegedGroup.String()}},
+					{Key: "$nin", Value: managed},
+				}}}}},
+			}}},
+		)
+	}
+
+	filter := bson.D{}
+	if len(filters) > 0 {
+		filter = bson.D{{Key: "$and", Value: filters}}
+	}
+
+	// one more user tells if there's a next page
+	cursor, err := cnf.Database.Collection("identities").Find(
+		r.Context(),
+		filter,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit+1)),
+	)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, JSONApi{Message: "Unable to list users"})
+		return
+	}
+
+	var identities []Identity
+	if err := cursor.All(r.Context(), &identities); err != nil {
+		writeJSON(w, http.StatusInternalServerError, JSONApi{Message: "Unable to list users"})
+		return
+	}
+
+	var links *JSONApiLinks
+	if len(identities) > limit {
+		identities = identities[:limit]
+
+		next, err := cnf.url("users")
+		if err == nil {
+			query.Set("after", identities[limit-1].Uid)
+			links = &JSONApiLinks{Next: next + "?" + query.Encode()}
+		}
+	}
+
+	users := []userResource{}
+	for i := range identities {
+		users = append(users, perms.resource(&identities[i]))
+	}
+	writeJSON(w, http.StatusOK, JSONApi{Data: users, Links: links})
+}
+
+/**
+ * Returns the requested identity, if the authenticated user could access it.
+ * Writes the response on failure.
+ */
+func requestedUser(cnf *Config, w http.ResponseWriter, r *http.Request) (*userPermissions, *Identity, bool) {
+	perms, err := loadPermissions(r, cnf)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, JSONApi{Message: err.Error()})
+		return nil, nil, false
+	}
+
+	uid := mux.Vars(r)["user_id"]
+
+	if uid != perms.sub && !perms.global && len(perms.manages) == 0 {
+		writeJSON(w, http.StatusForbidden, JSONApi{Message: "Token lacks the permission to read users"})
+		return nil, nil, false
+	}
+
+	identity, err := FindIdentity(r.Context(), cnf, uid)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeJSON(w, http.StatusNotFound, JSONApi{Message: "User not found"})
+		return nil, nil, false
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, JSONApi{Message: "Unable to fetch user"})
+		return nil, nil, false
+	}
+
+	if uid != perms.sub && !perms.canManage(identity) {
+		writeJSON(w, http.StatusForbidden, JSONApi{Message: "Token lacks the permission to read the user"})
+		return nil, nil, false
+	}
+	return perms, identity, true
+}
+
+func handleUserGet(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	perms, identity, ok := requestedUser(cnf, w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, JSONApi{Data: perms.resource(identity)})
+}
+
+/**
+ * Updates the fields provided. Users could change their own profile and
+ * password, providing the current one. Email, status and the passwords of
+ * other users are changed only by their managers.
+ */
+func handleUserUpdate(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	perms, identity, ok := requestedUser(cnf, w, r)
+	if !ok {
+		return
+	}
+
+	body, err := decodeUserRequest(r)
+	if err == nil && body.Groups != nil {
+		err = fmt.Errorf("Groups could not be updated")
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, JSONApi{Message: err.Error()})
+		return
+	}
+
+	self := identity.Uid == perms.sub
+	managed := body.Email != nil || body.EmailVerified != nil || body.Disabled != nil ||
+		(body.Password != nil && !self)
+	if managed && !perms.canManage(identity) {
+		writeJSON(w, http.StatusForbidden, JSONApi{Message: "Token lacks the permission to update the user"})
+		return
+	}
+
+	// a stolen token should not be enough to take over the account
+	if body.Password != nil && self {
+		if body.CurrentPassword == nil || identity.Password == "" {
+			writeJSON(w, http.StatusForbidden, JSONApi{Message: "Current password required to change the password"})
+			return
+		}
+
+		err := passwords.Validate(identity.Password, *body.CurrentPassword)
+		if isStoredHashError(err) {
+			log.Printf("Unable to verify password of %q: %v", identity.Uid, err)
+			writeJSON(w, http.StatusInternalServerError, JSONApi{Message: "Unable to verify password"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusForbidden, JSONApi{Message: "Current password is not valid"})
+			return
+		}
+	}
+
+	update := bson.D{}
+	set := func(key string, value interface{}) {
+		update = append(update, bson.E{Key: key, Value: value})
+	}
+
+	if body.Email != nil && *body.Email != identity.Email {
+		identity.Email = *body.Email
+		identity.EmailVerified = false
+		set("email", identity.Email)
+		set("email_verified", false)
+	}
+	if body.EmailVerified != nil {
+		identity.EmailVerified = *body.EmailVerified
+		set("email_verified", identity.EmailVerified)
+	}
+	if body.Name != nil {
+		identity.Name = *body.Name
+		set("name", identity.Name)
+	}
+	if body.Surname != nil {
+		identity.Surname = *body.Surname
+		set("surname", identity.Surname)
+	}
+	if body.Address != nil {
+		identity.Address = *body.Address
+		set("address", identity.Address)
+	}
+	if body.Disabled != nil {
+		identity.Disabled = *body.Disabled
+		set("disabled", identity.Disabled)
+	}
+
+	if body.Password != nil {
+		hashed, ok := hashNewPassword(cnf, w, *body.Password, identity.Email)
+		if !ok {
+			return
+		}
+		set("password", hashed)
+	}
+
+	if len(update) > 0 {
+		_, err = cnf.Database.Collection("identities").UpdateOne(
+			r.Context(),
+			bson.D{{Key: "_id", Value: identity.Uid}},
+			bson.D{{Key: "$set", Value: update}},
+		)
+		if mongo.IsDuplicateKeyError(err) {
+			writeJSON(w, http.StatusConflict, JSONApi{Message: "Email already in use"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, JSONApi{Message: "Unable to update user"})
+			return
+		}
+	}
+
+	// the update is idempotent, so the request could be retried
+	if identity.Disabled {
+		if err := revokeUserTokens(r.Context(), cnf, identity.Uid); err != nil {
+			log.Printf("Unable to revoke tokens of %q: %v", identity.Uid, err)
+			writeJSON(w, http.StatusInternalServerError, JSONApi{Message: "Unable to revoke the tokens of the user"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, JSONApi{Data: perms.resource(identity)})
+}
+
+/**
+ * Disables the user, identities are never deleted. Disabled users could
+ * not login, and their refresh tokens are revoked.
+ */
+func handleUserDisable(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	perms, identity, ok := requestedUser(cnf, w, r)
+	if !ok {
+		return
+	}
+
+	if !perms.canManage(identity) {
+		writeJSON(w, http.StatusForbidden, JSONApi{Message: "Token lacks the permission to disable the user"})
+		return
+	}
+
+	_, err := cnf.Database.Collection("identities").UpdateOne(
+		r.Context(),
+		bson.D{{Key: "_id", Value: identity.Uid}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "disabled", Value: true}}}},
+	)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, JSONApi{Message: "Unable to disable user"})
+		return
+	}
+
+	// disabling is idempotent, so the request could be retried
+	if err := revokeUserTokens(r.Context(), cnf, identity.Uid); err != nil {
+		log.Printf("Unable to revoke tokens of %q: %v", identity.Uid, err)
+		writeJSON(w, http.StatusInternalServerError, JSONApi{Message: "Unable to revoke the tokens of the user"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * Creates the indexes of the identities, emails should be unique.
+ * Identities without email are allowed.
+ */
+func createIdentityIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("identities").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{{Key: "email", Value: bson.D{{Key: "$type", Value: "string"}}}}),
+	})
+	return err
+}
@@ -0,0 +1,360 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"github.com/ale-cci/oauthsrv/pkg/jwt"
+	"github.com/ale-cci/oauthsrv/pkg/passwords"
+	"github.com/ale-cci/oauthsrv/pkg/server"
+	"go.mongodb.org/mongo-driver/bson"
+	"gotest.tools/assert"
+)
+
+type testUser struct {
+	Id            string   `json:"id"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	Groups        []string `json:"groups"`
+	Disabled      bool     `json:"disabled"`
+}
+
+type testUsersResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Rule string `json:"rule"`
+	} `json:"errors"`
+	Links struct {
+		Next string `json:"next"`
+	} `json:"links"`
+}
+
+func TestHandleUsersApi(t *testing.T) {
+	cnf, err := handlers.EnvConfig()
+	assert.NilError(t, err)
+	srv := httptest.NewServer(server.New(cnf))
+	defer srv.Close()
+
+	// deleted rather than dropped, to keep the email index
+	cnf.Database.Collection("identities").DeleteMany(
+		context.Background(),
+		bson.D{{Key: "email", Value: bson.D{{Key: "$regex", Value: `@users-api\.com$`}}}},
+	)
+
+	_, err = cnf.Database.Collection("identities").InsertMany(
+		context.Background(),
+		[]interface{}{
+			bson.D{
+				{Key: "_id", Value: "users-admin"},
+				{Key: "email", Value: "admin@users-api.com"},
+				{Key: "groups", Value: []string{"admin"}},
+			},
+			bson.D{
+				{Key: "_id", Value: "users-app1-admin"},
+				{Key: "email", Value: "app1-admin@users-api.com"},
+				{Key: "groups", Value: []string{"app1:admin"}},
+			},
+			bson.D{
+				{Key: "_id", Value: "users-member"},
+				{Key: "email", Value: "member@users-api.com"},
+				{Key: "groups", Value: []string{"app1:read", "app2:read"}},
+			},
+			bson.D{
+				{Key: "_id", Value: "users-other"},
+				{Key: "email", Value: "other@users-api.com"},
+				{Key: "groups", Value: []string{"app2:read"}},
+			},
+			bson.D{
+				{Key: "_id", Value: "users-app2-admin"},
+				{Key: "email", Value: "app2-admin@users-api.com"},
+				{Key: "groups", Value: []string{"app1:read", "app2:admin"}},
+			},
+			bson.D{
+				{Key: "_id", Value: "users-manager"},
+				{Key: "email", Value: "manager@users-api.com"},
+				{Key: "groups", Value: []string{"manager", "app1:read"}},
+			},
+		},
+	)
+	assert.NilError(t, err)
+
+	do := func(t *testing.T, sub, method, path string, body interface{}) (*http.Response, testUsersResponse) {
+		var reqBody bytes.Buffer
+		if body != nil {
+			assert.NilError(t, json.NewEncoder(&reqBody).Encode(body))
+		}
+
+		req, err := http.NewRequest(method, srv.URL+path, &reqBody)
+		assert.NilError(t, err)
+
+		token, err := handlers.NewAccessToken(cnf, jwt.JWTBody{"sub": sub})
+		assert.NilError(t, err)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		resp, err := srv.Client().Do(req)
+		assert.NilError(t, err)
+		defer resp.Body.Close()
+
+		var response testUsersResponse
+		if resp.StatusCode != http.StatusNoContent {
+			assert.NilError(t, json.NewDecoder(resp.Body).Decode(&response))
+		}
+		return resp, response
+	}
+
+	decodeUser := func(t *testing.T, response testUsersResponse) testUser {
+		var user testUser
+		assert.NilError(t, json.Unmarshal(response.Data, &user))
+		return user
+	}
+
+	var created testUser
+
+	t.Run("admins should create users", func(t *testing.T) {
+		resp, response := do(t, "users-admin", "POST", "/api/v1/users", map[string]interface{}{
+			"email":          "created@users-api.com",
+			"email_verified": true,
+			"password":       "a-long-enough-password",
+			"groups":         []string{"app1:read"},
+		})
+		assert.Equal(t, resp.StatusCode, http.StatusCreated)
+
+		created = decodeUser(t, response)
+		assert.Check(t, created.Id != "")
+		assert.Equal(t, created.Email, "created@users-api.com")
+		assert.Equal(t, created.EmailVerified, true)
+		assert.Equal(t, resp.Header.Get("location"), "/api/v1/users/"+created.Id)
+
+		t.Run("password should be hashed", func(t *testing.T) {
+			identity, err := handlers.GetIdentity(context.Background(), cnf, "created@users-api.com", "a-long-enough-password")
+			assert.NilError(t, err)
+			assert.Check(t, identity.Password != "a-long-enough-password")
+			assert.NilError(t, passwords.Validate(identity.Password, "a-long-enough-password"))
+		})
+	})
+
+	t.Run("emails should be unique", func(t *testing.T) {
+		resp, _ := do(t, "users-admin", "POST", "/api/v1/users", map[string]interface{}{
+			"email": "created@users-api.com",
+		})
+		assert.Equal(t, resp.StatusCode, http.StatusConflict)
+	})
+
+	t.Run("passwords should satisfy the policy", func(t *testing.T) {
+		resp, response := do(t, "users-admin", "POST", "/api/v1/users", map[string]interface{}{
+			"email":    "weak@users-api.com",
+			"password": "short",
+		})
+		assert.Equal(t, resp.StatusCode, http.StatusUnprocessableEntity)
+		assert.Assert(t, len(response.Errors) > 0)
+		assert.Equal(t, response.Errors[0].Rule, passwords.RuleMinLength)
+	})
+
+	t.Run("invalid emails should be rejected", func(t *testing.T) {
+		resp, _ := do(t, "users-admin", "POST", "/api/v1/users", map[string]interface{}{
+			"email": "Someone <someone@users-api.com>",
+		})
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	})
+
+	t.Run("project admins should create users only in their groups", func(t *testing.T) {
+		tt := []struct {
+			TcName string
+			Groups []string
+			Status int
+		}{
+			{TcName: "without groups", Groups: nil, Status: http.StatusForbidden},
+			{TcName: "in other projects", Groups: []string{"app2:read"}, Status: http.StatusForbidden},
+			{TcName: "in their project", Groups: []string{"app1:write"}, Status: http.StatusCreated},
+		}
+
+		for id, tc := range tt {
+			t.Run(fmt.Sprintf("[%d] %s", id, tc.TcName), func(t *testing.T) {
+				resp, _ := do(t, "users-app1-admin", "POST", "/api/v1/users", map[string]interface{}{
+					"email":  fmt.Sprintf("project-%d@users-api.com", id),
+					"groups": tc.Groups,
+				})
+				assert.Equal(t, resp.StatusCode, tc.Status)
+			})
+		}
+	})
+
+	t.Run("users without permissions should not create users", func(t *testing.T) {
+		resp, _ := do(t, "users-member", "POST", "/api/v1/users", map[string]interface{}{
+			"email": "forbidden@users-api.com",
+		})
+		assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+	})
+
+	t.Run("users should read themselves", func(t *testing.T) {
+		resp, response := do(t, "users-member", "GET", "/api/v1/users/users-member", nil)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.DeepEqual(t, decodeUser(t, response).Groups, []string{"app1:read", "app2:read"})
+
+		resp, _ = do(t, "users-member", "GET", "/api/v1/users/users-other", nil)
+		assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+	})
+
+	t.Run("project admins should only see the groups of their project", func(t *testing.T) {
+		resp, response := do(t, "users-app1-admin", "GET", "/api/v1/users/users-member", nil)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.DeepEqual(t, decodeUser(t, response).Groups, []string{"app1:read"})
+
+		resp, _ = do(t, "users-app1-admin", "GET", "/api/v1/users/users-other", nil)
+		assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+	})
+
+	t.Run("missing users should return 404", func(t *testing.T) {
+		resp, _ := do(t, "users-admin", "GET", "/api/v1/users/missing-user", nil)
+		assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+	})
+
+	t.Run("users should be listed in pages", func(t *testing.T) {
+		path := "/api/v1/users?limit=1&group=app1:read"
+		emails := []string{}
+
+		for path != "" {
+			resp, response := do(t, "users-admin", "GET", path, nil)
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+			var users []testUser
+			assert.NilError(t, json.Unmarshal(response.Data, &users))
+			assert.Assert(t, len(users) <= 1)
+			for _, user := range users {
+				emails = append(emails, user.Email)
+			}
+			path = response.Links.Next
+		}
+		sort.Strings(emails)
+		assert.DeepEqual(t, emails, []string{
+			"app2-admin@users-api.com", created.Email, "manager@users-api.com", "member@users-api.com",
+		})
+	})
+
+	t.Run("project admins should list only the users of their project", func(t *testing.T) {
+		resp, response := do(t, "users-app1-admin", "GET", "/api/v1/users?email=other@users-api.com", nil)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		var users []testUser
+		assert.NilError(t, json.Unmarshal(response.Data, &users))
+		assert.Equal(t, len(users), 0)
+
+		resp, response = do(t, "users-app1-admin", "GET", "/api/v1/users?email=member@users-api.com", nil)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.NilError(t, json.Unmarshal(response.Data, &users))
+		assert.Equal(t, len(users), 1)
+	})
+
+	t.Run("project admins should not manage users privileged outside their project", func(t *testing.T) {
+		for _, uid := range []string{"users-app2-admin", "users-manager"} {
+			resp, _ := do(t, "users-app1-admin", "GET", "/api/v1/users/"+uid, nil)
+			assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+			resp, _ = do(t, "users-app1-admin", "PATCH", "/api/v1/users/"+uid, map[string]interface{}{
+				"password": "a-long-enough-password",
+			})
+			assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+			resp, _ = do(t, "users-app1-admin", "DELETE", "/api/v1/users/"+uid, nil)
+			assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+		}
+
+		resp, response := do(t, "users-app1-admin", "GET", "/api/v1/users?group=app1:read", nil)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		var users []testUser
+		assert.NilError(t, json.Unmarshal(response.Data, &users))
+		for _, user := range users {
+			assert.Check(t, user.Id != "users-app2-admin" && user.Id != "users-manager", user.Id)
+		}
+	})
+
+	t.Run("passwords of other users should be changed only by their managers", func(t *testing.T) {
+		resp, _ := do(t, "users-other", "PATCH", "/api/v1/users/users-member", map[string]interface{}{
+			"password": "a-long-enough-password",
+		})
+		assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+		resp, _ = do(t, "users-app1-admin", "PATCH", "/api/v1/users/users-member", map[string]interface{}{
+			"password": "a-long-enough-password",
+		})
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+	})
+
+	t.Run("users should provide the current password to change it", func(t *testing.T) {
+		tt := []struct {
+			TcName string
+			Body   map[string]interface{}
+			Status int
+		}{
+			{"missing current password", map[string]interface{}{
+				"password": "another-long-password",
+			}, http.StatusForbidden},
+			{"wrong current password", map[string]interface{}{
+				"password":         "another-long-password",
+				"current_password": "wrong-password",
+			}, http.StatusForbidden},
+			{"valid current password", map[string]interface{}{
+				"password":         "another-long-password",
+				"current_password": "a-long-enough-password",
+			}, http.StatusOK},
+		}
+
+		for id, tc := range tt {
+			t.Run(fmt.Sprintf("[%d] %s", id, tc.TcName), func(t *testing.T) {
+				resp, _ := do(t, "users-member", "PATCH", "/api/v1/users/users-member", tc.Body)
+				assert.Equal(t, resp.StatusCode, tc.Status)
+			})
+		}
+
+		_, err := handlers.GetIdentity(context.Background(), cnf, "member@users-api.com", "another-long-password")
+		assert.NilError(t, err)
+	})
+
+	t.Run("users should update their profile", func(t *testing.T) {
+		resp, response := do(t, "users-member", "PATCH", "/api/v1/users/users-member", map[string]interface{}{
+			"name": "Member",
+		})
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, decodeUser(t, response).Name, "Member")
+
+		resp, _ = do(t, "users-member", "PATCH", "/api/v1/users/users-member", map[string]interface{}{
+			"email_verified": true,
+		})
+		assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+	})
+
+	t.Run("changing email should reset its verification", func(t *testing.T) {
+		resp, response := do(t, "users-admin", "PATCH", "/api/v1/users/"+created.Id, map[string]interface{}{
+			"email": "changed@users-api.com",
+		})
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		user := decodeUser(t, response)
+		assert.Equal(t, user.Email, "changed@users-api.com")
+		assert.Equal(t, user.EmailVerified, false)
+	})
+
+	t.Run("disabled users should not authenticate", func(t *testing.T) {
+		resp, _ := do(t, "users-member", "DELETE", "/api/v1/users/"+created.Id, nil)
+		assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+
+		resp, _ = do(t, "users-admin", "DELETE", "/api/v1/users/"+created.Id, nil)
+		assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+
+		_, err := handlers.GetIdentity(context.Background(), cnf, "changed@users-api.com", "a-long-enough-password")
+		assert.ErrorContains(t, err, "disabled")
+
+		resp, response := do(t, "users-admin", "GET", "/api/v1/users/"+created.Id, nil)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, decodeUser(t, response).Disabled, true)
+	})
+}
@@ -1,18 +1,47 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"html/template"
 	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
 )
 
+// Authorization codes should be exchanged right after being issued
+const authorizationCodeLifetime = time.Minute
+
+// Grant type of the request to the authorization endpoint
+func authGrantType(r *http.Request) string {
+	grantType := r.URL.Query().Get("grant_type")
+	if grantType == "" && r.URL.Query().Get("response_type") == "code" {
+		// standard authorization requests, as sent by oidc clients
+		grantType = "code"
+	}
+	return grantType
+}
+
+/**
+ * Authorization requests sent by the user agent. Only the code grant is
+ * started with GET requests, the other grants require POST so that
+ * credentials are never sent in the url.
+ */
+func handleAuthorize(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	if authGrantType(r) != "code" {
+		http.Error(w, "Grant type not found", http.StatusBadRequest)
+		return
+	}
+	Authorize(handleGrantCode)(cnf, w, r)
+}
+
 /**
  * Middleware for multiple grant types
  */
 func handleAuth(cnf *Config, w http.ResponseWriter, r *http.Request) {
-	// Detect grant type
-	grant_type := r.URL.Query().Get("grant_type")
 	// Switch based on grant type
-	switch grant_type {
+	switch authGrantType(r) {
 	case "code":
 		Authorize(handleGrantCode)(cnf, w, r)
 		break
@@ -25,32 +54,283 @@ func handleAuth(cnf *Config, w http.ResponseWriter, r *http.Request) {
 		handleGrantPassword(cnf, w, r)
 		break
 
+	case "refresh_token":
+		handleGrantRefreshToken(cnf, w, r)
+		break
+
 	default:
 		http.Error(w, "Grant type not found", http.StatusBadRequest)
 	}
 }
 
-func handleGrantCode(cnf *Config, w http.ResponseWriter, r *http.Request) {
-	type Error struct {
-		Message string
-	}
+/**
+ * Authorization code stored until it's exchanged on the token endpoint.
+ * Only the hash of the code is saved.
+ */
+type authorizationCode struct {
+	Hash     string `bson:"_id"`
+	ClientId string `bson:"client_id"`
+	// redirect_uri provided on the authorization request, the token
+	// request must provide the same value
+	RedirectURI string    `bson:"redirect_uri"`
+	Scope       string    `bson:"scope"`
+	Sub         string    `bson:"sub"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+
+	CodeChallenge       string `bson:"code_challenge,omitempty"`
+	CodeChallengeMethod string `bson:"code_challenge_method,omitempty"`
+
+	// openid connect parameters, added to the id token
+	Nonce    string    `bson:"nonce,omitempty"`
+	AuthTime time.Time `bson:"auth_time"`
+}
+
+type authorizationRequest struct {
+	App         *App
+	RedirectURI string
+	State       string
+	Scope       string
+
+	CodeChallenge       string
+	CodeChallengeMethod string
+
+	Nonce string
+}
 
+type authorizationError struct {
+	Code        string
+	Description string
+}
+
+/**
+ * Validates the query of an authorization request against the registered app.
+ * According to https://datatracker.ietf.org/doc/html/rfc6749#section-4.1.2.1
+ * when the client or the redirect uri are not valid, the returned request is nil
+ * and the error should be shown to the user instead of redirecting.
+ */
+func parseAuthorizationRequest(r *http.Request, cnf *Config) (*authorizationRequest, *authorizationError) {
 	q := r.URL.Query()
-	errors := []Error{}
 
-	if q.Get("client_id") == "" {
-		errors = append(errors, Error{Message: "Missing client id"})
+	clientId := q.Get("client_id")
+	if clientId == "" {
+		return nil, &authorizationError{"invalid_request", "Missing client id"}
+	}
+
+	app, err := GetApp(r.Context(), cnf, clientId)
+	if err != nil {
+		return nil, &authorizationError{"unauthorized_client", "Unknown client id"}
+	}
+
+	redirectURI := app.redirectURI(q.Get("redirect_uri"))
+	if redirectURI == "" {
+		return nil, &authorizationError{"invalid_request", "Redirect uri not registered for the client"}
+	}
+
+	authReq := &authorizationRequest{
+		App:         app,
+		RedirectURI: redirectURI,
+		State:       q.Get("state"),
+		Scope:       q.Get("scope"),
+		Nonce:       q.Get("nonce"),
+	}
+
+	if authReq.State == "" {
+		return authReq, &authorizationError{"invalid_request", "Missing state"}
 	}
 
-	t, _ := template.ParseFiles("templates/authorize.tmpl")
+	if !app.allowsScope(authReq.Scope) {
+		return authReq, &authorizationError{"invalid_scope", "Requested scope is not allowed for the client"}
+	}
+
+	if challenge := q.Get("code_challenge"); challenge != "" {
+		method, ok := parseCodeChallenge(challenge, q.Get("code_challenge_method"))
+		if !ok {
+			return authReq, &authorizationError{"invalid_request", "Invalid code challenge"}
+		}
+		authReq.CodeChallenge = challenge
+		authReq.CodeChallengeMethod = method
+	} else if app.isPublic() {
+		return authReq, &authorizationError{"invalid_request", "Code challenge required for public clients"}
+	}
+
+	return authReq, nil
+}
+
+// Redirects the user-agent to the client, adding the provided parameters
+// to the redirect uri query
+func redirectToClient(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	location, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect uri", http.StatusInternalServerError)
+		return
+	}
+
+	q := location.Query()
+	for key, values := range params {
+		q[key] = values
+	}
+	location.RawQuery = q.Encode()
+
+	http.Redirect(w, r, location.String(), http.StatusFound)
+}
+
+func handleGrantCode(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	authReq, authErr := parseAuthorizationRequest(r, cnf)
 
-	if len(errors) != 0 {
+	if authErr != nil && authReq == nil {
 		w.WriteHeader(http.StatusBadRequest)
+		renderAuthorize(w, authorizePage{
+			Errors: []pageError{{Message: authErr.Description}},
+		})
+		return
+	}
+
+	if authErr != nil {
+		redirectToClient(w, r, authReq.RedirectURI, url.Values{
+			"error":             {authErr.Code},
+			"error_description": {authErr.Description},
+			"state":             {authReq.State},
+		})
+		return
+	}
+
+	if r.Method == "POST" {
+		handleConsent(cnf, w, r, authReq)
+		return
+	}
+
+	csrfToken, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "csrf",
+		Value:    csrfToken,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	appName := authReq.App.Name
+	if appName == "" {
+		appName = authReq.App.Id
 	}
 
-	t.Execute(w, struct {
-		Errors []Error
-	}{
-		Errors: errors,
+	// the consent is submitted with the parameters of the request
+	action, err := cnf.url("authorization_endpoint")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderAuthorize(w, authorizePage{
+		Action:    action + "?" + r.URL.RawQuery,
+		AppName:   appName,
+		Scopes:    splitScope(authReq.Scope),
+		CSRFToken: csrfToken,
 	})
 }
+
+/**
+ * Processes the consent form submitted by the user. If the user
+ * grants the access, an authorization code is issued to the client.
+ */
+func handleConsent(cnf *Config, w http.ResponseWriter, r *http.Request, authReq *authorizationRequest) {
+	csrfCookie, err := r.Cookie("csrf")
+	csrfToken := r.PostFormValue("csrf_token")
+
+	if err != nil || csrfToken == "" || subtle.ConstantTimeCompare([]byte(csrfCookie.Value), []byte(csrfToken)) != 1 {
+		http.Error(w, "Invalid csrf token", http.StatusForbidden)
+		return
+	}
+
+	if r.PostFormValue("consent") != "allow" {
+		redirectToClient(w, r, authReq.RedirectURI, url.Values{
+			"error":             {"access_denied"},
+			"error_description": {"The user denied the authorization request"},
+			"state":             {authReq.State},
+		})
+		return
+	}
+
+	session, _ := getSession(r)
+	sub, _ := session["sub"].(string)
+
+	code, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = cnf.Database.Collection("authorization_codes").InsertOne(r.Context(), authorizationCode{
+		Hash:        hashToken(code),
+		ClientId:    authReq.App.Id,
+		RedirectURI: r.URL.Query().Get("redirect_uri"),
+		Scope:       authReq.Scope,
+		Sub:         sub,
+		ExpiresAt:   time.Now().Add(authorizationCodeLifetime),
+
+		CodeChallenge:       authReq.CodeChallenge,
+		CodeChallengeMethod: authReq.CodeChallengeMethod,
+
+		Nonce:    authReq.Nonce,
+		AuthTime: sessionAuthTime(session),
+	})
+	if err != nil {
+		redirectToClient(w, r, authReq.RedirectURI, url.Values{
+			"error":             {"server_error"},
+			"error_description": {"Unable to issue authorization code"},
+			"state":             {authReq.State},
+		})
+		return
+	}
+
+	redirectToClient(w, r, authReq.RedirectURI, url.Values{
+		"code":  {code},
+		"state": {authReq.State},
+	})
+}
+
+/**
+ * Retrieves the authorization code, removing it from the database so that
+ * it could not be used twice.
+ */
+func consumeAuthorizationCode(r *http.Request, cnf *Config, code string) (*authorizationCode, error) {
+	var authCode authorizationCode
+
+	err := cnf.Database.Collection("authorization_codes").FindOneAndDelete(
+		r.Context(),
+		bson.D{
+			{Key: "_id", Value: hashToken(code)},
+			{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+		},
+	).Decode(&authCode)
+
+	if err != nil {
+		return nil, err
+	}
+	return &authCode, nil
+}
+
+type pageError struct {
+	Message string
+}
+
+type authorizePage struct {
+	Errors    []pageError
+	Action    string
+	AppName   string
+	Scopes    []string
+	CSRFToken string
+}
+
+func renderAuthorize(w http.ResponseWriter, data authorizePage) {
+	t, err := template.ParseFiles("templates/authorize.tmpl")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	t.Execute(w, data)
+}
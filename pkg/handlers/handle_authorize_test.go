@@ -1,17 +1,17 @@
 package handlers_test
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"fmt"
 	"github.com/ale-cci/oauthsrv/pkg/handlers"
-	"github.com/ale-cci/oauthsrv/pkg/jwt"
-	"github.com/kylelemons/godebug/diff"
+	"go.mongodb.org/mongo-driver/bson"
 	"gotest.tools/assert"
-	"html/template"
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -68,6 +68,23 @@ func TestAuthorizeFromGuest(t *testing.T) {
 			t.Fatalf("want: %q, got: %q", want, got)
 		}
 	})
+
+	t.Run("should redirect to login if sid is an access token", func(t *testing.T) {
+		accessToken, err := handlers.NewAccessToken(cnf, map[string]interface{}{"sub": "some-user"})
+		assert.NilError(t, err)
+
+		location, _ := url.Parse(srv.URL)
+		client.Jar, _ = cookiejar.New(nil)
+		client.Jar.SetCookies(location, []*http.Cookie{{Name: "sid", Value: accessToken}})
+
+		resp, err := client.Get(srv.URL + requestPath)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusFound)
+
+		redirectURL, err := resp.Location()
+		assert.NilError(t, err)
+		assert.Equal(t, redirectURL.Path, "/login")
+	})
 }
 
 func TestAuthorizeEndpoint(t *testing.T) {
@@ -77,15 +94,16 @@ func TestAuthorizeEndpoint(t *testing.T) {
 
 	client := NoFollowRedirectClient(srv)
 
-	authToken, err := jwt.JWT{
-		Head: &jwt.JWTHead{
-			Alg: "none",
-		},
-		Body: jwt.JWTBody{
-			"sid":   1,
-			"email": "test@email.com",
-		},
-	}.Encode(nil)
+	_, err := cnf.Database.Collection("apps").InsertOne(context.Background(), bson.D{
+		{Key: "_id", Value: "authorize-test-app"},
+		{Key: "name", Value: "Authorize Test App"},
+		{Key: "redirect_uris", Value: []string{"http://client.example/callback"}},
+		{Key: "scopes", Value: []string{"profile", "email"}},
+	})
+	assert.NilError(t, err)
+	t.Cleanup(deinitApps(cnf))
+
+	authToken, err := handlers.NewSession(cnf, "authorize-test-user")
 	assert.NilError(t, err)
 
 	authCookie := &http.Cookie{Name: "sid", Value: authToken}
@@ -93,15 +111,16 @@ func TestAuthorizeEndpoint(t *testing.T) {
 	client.Jar, _ = cookiejar.New(nil)
 	client.Jar.SetCookies(location, []*http.Cookie{authCookie})
 
-	t.Run("should return 200 if user is authenticated", func(t *testing.T) {
-		requestPath := "/oauth/v2/auth?" + url.Values{
-			"client_id":    {"something"},
-			"redirect_uri": {""},
-			"grant_type":   {"code"},
-			"scope":        {""},
-		}.Encode()
+	validRequest := url.Values{
+		"client_id":    {"authorize-test-app"},
+		"redirect_uri": {"http://client.example/callback"},
+		"grant_type":   {"code"},
+		"scope":        {"profile"},
+		"state":        {"random-state"},
+	}
 
-		resp, err := client.Get(srv.URL + requestPath)
+	t.Run("should return 200 if user is authenticated", func(t *testing.T) {
+		resp, err := client.Get(srv.URL + "/oauth/v2/auth?" + validRequest.Encode())
 		if err != nil {
 			t.Errorf("Unexpected error: %v", err)
 		}
@@ -113,6 +132,18 @@ func TestAuthorizeEndpoint(t *testing.T) {
 		}
 	})
 
+	t.Run("response_type=code should be accepted in place of grant_type", func(t *testing.T) {
+		resp, err := client.Get(srv.URL + "/oauth/v2/auth?" + url.Values{
+			"client_id":     {"authorize-test-app"},
+			"redirect_uri":  {"http://client.example/callback"},
+			"response_type": {"code"},
+			"scope":         {"profile"},
+			"state":         {"random-state"},
+		}.Encode())
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+	})
+
 	t.Run("should return 400 if not all arguments were provided", func(t *testing.T) {
 		requestPath := "/oauth/v2/auth?" + url.Values{
 			"redirect_uri": {""},
@@ -132,34 +163,157 @@ func TestAuthorizeEndpoint(t *testing.T) {
 		}
 	})
 
-	t.Run("should render authorize page on success", func(t *testing.T) {
-		tmpl, err := template.ParseFiles("templates/authorize.tmpl")
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-
-		var want bytes.Buffer
-		buf := bufio.NewWriter(&want)
+	t.Run("should not redirect to unregistered uris", func(t *testing.T) {
+		requestPath := "/oauth/v2/auth?" + url.Values{
+			"client_id":    {"authorize-test-app"},
+			"redirect_uri": {"http://attacker.example/callback"},
+			"grant_type":   {"code"},
+			"state":        {"random-state"},
+		}.Encode()
 
-		if err := tmpl.Execute(buf, nil); err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		buf.Flush()
+		resp, err := client.Get(srv.URL + requestPath)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		assert.Equal(t, resp.Header.Get("location"), "")
+	})
 
+	t.Run("should return 400 if the client is not registered", func(t *testing.T) {
 		requestPath := "/oauth/v2/auth?" + url.Values{
-			"client_id":  {"-"},
-			"grant_type": {"code"},
+			"client_id":    {"unregistered-app"},
+			"redirect_uri": {"http://client.example/callback"},
+			"grant_type":   {"code"},
+			"state":        {"random-state"},
 		}.Encode()
+
 		resp, err := client.Get(srv.URL + requestPath)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	})
+
+	t.Run("errors on valid redirect uris should be sent to the client", func(t *testing.T) {
+		tt := []struct {
+			TcName    string
+			Params    url.Values
+			WantError string
+		}{
+			{
+				TcName: "missing state",
+				Params: url.Values{
+					"client_id":  {"authorize-test-app"},
+					"grant_type": {"code"},
+				},
+				WantError: "invalid_request",
+			},
+			{
+				TcName: "scope not allowed for the client",
+				Params: url.Values{
+					"client_id":  {"authorize-test-app"},
+					"grant_type": {"code"},
+					"scope":      {"profile admin"},
+					"state":      {"random-state"},
+				},
+				WantError: "invalid_scope",
+			},
+		}
+
+		for i, tc := range tt {
+			t.Run(fmt.Sprintf("[%d] %s", i, tc.TcName), func(t *testing.T) {
+				resp, err := client.Get(srv.URL + "/oauth/v2/auth?" + tc.Params.Encode())
+				assert.NilError(t, err)
+				assert.Equal(t, resp.StatusCode, http.StatusFound)
+
+				redirect, err := resp.Location()
+				assert.NilError(t, err)
+				assert.Equal(t, redirect.Host, "client.example")
+				assert.Equal(t, redirect.Query().Get("error"), tc.WantError)
+				assert.Equal(t, redirect.Query().Get("state"), tc.Params.Get("state"))
+			})
+		}
+	})
+
+	t.Run("should render authorize page on success", func(t *testing.T) {
+		resp, err := client.Get(srv.URL + "/oauth/v2/auth?" + validRequest.Encode())
+		assert.NilError(t, err)
 
 		got, err := ioutil.ReadAll(resp.Body)
+		assert.NilError(t, err)
 
-		strGot := string(got)
-		strWant := string(want.Bytes())
+		assert.Check(t, strings.Contains(string(got), "Authorize Test App"))
+		assert.Check(t, strings.Contains(string(got), "profile"))
+		assert.Check(t, strings.Contains(string(got), `name="csrf_token"`))
+		assert.Check(t, strings.Contains(string(got), `action="/oauth/v2/auth?`))
+	})
 
-		if strGot != strWant {
-			t.Errorf(diff.Diff(strWant, strGot))
-		}
+	t.Run("consent should be rejected without csrf token", func(t *testing.T) {
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/auth?"+validRequest.Encode(), url.Values{
+			"consent": {"allow"},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+	})
+
+	t.Run("denied consent should redirect with access_denied", func(t *testing.T) {
+		csrfToken := getCSRFToken(t, client, srv.URL+"/oauth/v2/auth?"+validRequest.Encode())
+
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/auth?"+validRequest.Encode(), url.Values{
+			"consent":    {"deny"},
+			"csrf_token": {csrfToken},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusFound)
+
+		redirect, err := resp.Location()
+		assert.NilError(t, err)
+		assert.Equal(t, redirect.Query().Get("error"), "access_denied")
+		assert.Equal(t, redirect.Query().Get("state"), "random-state")
+		assert.Equal(t, redirect.Query().Get("code"), "")
+	})
+
+	t.Run("granted consent should redirect with code and state", func(t *testing.T) {
+		csrfToken := getCSRFToken(t, client, srv.URL+"/oauth/v2/auth?"+validRequest.Encode())
+
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/auth?"+validRequest.Encode(), url.Values{
+			"consent":    {"allow"},
+			"csrf_token": {csrfToken},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusFound)
+
+		redirect, err := resp.Location()
+		assert.NilError(t, err)
+		assert.Equal(t, redirect.Scheme+"://"+redirect.Host+redirect.Path, "http://client.example/callback")
+		assert.Check(t, redirect.Query().Get("code") != "")
+		assert.Equal(t, redirect.Query().Get("state"), "random-state")
+	})
+
+	t.Run("sessions of disabled users should redirect to login", func(t *testing.T) {
+		_, err := cnf.Database.Collection("identities").InsertOne(context.Background(), bson.D{
+			{Key: "_id", Value: "authorize-disabled-user"},
+			{Key: "disabled", Value: true},
+		})
+		assert.NilError(t, err)
+		t.Cleanup(func() {
+			cnf.Database.Collection("identities").DeleteOne(
+				context.Background(),
+				bson.D{{Key: "_id", Value: "authorize-disabled-user"}},
+			)
+		})
+
+		sid, err := handlers.NewSession(cnf, "authorize-disabled-user")
+		assert.NilError(t, err)
+
+		// copied, the client of the server is shared with the other tests
+		disabledClient := *NoFollowRedirectClient(srv)
+		disabledClient.Jar, _ = cookiejar.New(nil)
+		disabledClient.Jar.SetCookies(location, []*http.Cookie{{Name: "sid", Value: sid}})
+
+		resp, err := disabledClient.Get(srv.URL + "/oauth/v2/auth?" + validRequest.Encode())
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusFound)
+
+		redirect, err := resp.Location()
+		assert.NilError(t, err)
+		assert.Equal(t, redirect.Path, "/login")
 	})
 
 	t.Run("should return 400 if grant type is not registered", func(t *testing.T) {
@@ -172,3 +326,19 @@ func TestAuthorizeEndpoint(t *testing.T) {
 		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
 	})
 }
+
+var csrfInputRegexp = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// Renders the consent page, returning the csrf token contained in the form
+func getCSRFToken(t *testing.T, client *http.Client, authorizeURL string) string {
+	resp, err := client.Get(authorizeURL)
+	assert.NilError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NilError(t, err)
+
+	matches := csrfInputRegexp.FindSubmatch(body)
+	assert.Assert(t, matches != nil, "csrf token not found in consent page")
+	return string(matches[1])
+}
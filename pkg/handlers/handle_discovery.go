@@ -0,0 +1,83 @@
+// OpenID Connect discovery
+// Describes the endpoints and capabilities of the server, as defined in
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/ale-cci/oauthsrv/pkg/scopes"
+)
+
+type providerMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint,omitempty"`
+	JwksURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+/**
+ * Returns the scopes that could be requested. Scopes in the `scopes`
+ * collection are regular expressions, only the ones matching a single
+ * value are listed.
+ */
+func supportedScopes(cnf *Config, r *http.Request) ([]string, error) {
+	definitions, err := loadScopes(r.Context(), cnf)
+	if err != nil {
+		return nil, err
+	}
+
+	literals := scopes.Literals(definitions)
+	sort.Strings(literals)
+	return append(append([]string{}, standardScopes...), literals...), nil
+}
+
+/**
+ * Discovery document, endpoints are the urls of the registered routes
+ * with the same name.
+ */
+func handleDiscovery(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	scopes, err := supportedScopes(cnf, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	issuer := cnf.issuer(r)
+	endpointURL := func(name string) string {
+		endpoint, err := cnf.url(name)
+		if err != nil {
+			return ""
+		}
+		return issuer + endpoint
+	}
+
+	metadata := providerMetadata{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             endpointURL("authorization_endpoint"),
+		TokenEndpoint:                     endpointURL("token_endpoint"),
+		UserinfoEndpoint:                  endpointURL("userinfo_endpoint"),
+		JwksURI:                           endpointURL("jwks_uri"),
+		ScopesSupported:                   scopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "password", "client_credentials", "refresh_token"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{cnf.signingAlgorithm()},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256", "plain"},
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "public, max-age=3600")
+	json.NewEncoder(w).Encode(metadata)
+}
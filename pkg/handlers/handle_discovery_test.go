@@ -0,0 +1,85 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"go.mongodb.org/mongo-driver/bson"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestDiscovery(t *testing.T) {
+	cnf, _ := handlers.EnvConfig()
+	cnf.Issuer = "https://auth.example"
+	srv := NewTestServer(cnf)
+	defer srv.Close()
+
+	_, err := cnf.Database.Collection("scopes").InsertMany(context.Background(), []interface{}{
+		bson.D{{Key: "pattern", Value: "repository:read"}},
+		bson.D{{Key: "pattern", Value: "project:(.*):(.*)"}},
+	})
+	assert.NilError(t, err)
+	t.Cleanup(func() {
+		cnf.Database.Collection("scopes").Drop(context.Background())
+	})
+
+	resp, err := srv.Client().Get(srv.URL + "/.well-known/openid-configuration")
+	assert.NilError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("content-type"), "application/json")
+
+	var metadata struct {
+		Issuer                string   `json:"issuer"`
+		AuthorizationEndpoint string   `json:"authorization_endpoint"`
+		TokenEndpoint         string   `json:"token_endpoint"`
+		JwksURI               string   `json:"jwks_uri"`
+		ScopesSupported       []string `json:"scopes_supported"`
+		GrantTypesSupported   []string `json:"grant_types_supported"`
+		SigningAlgs           []string `json:"id_token_signing_alg_values_supported"`
+	}
+	assert.NilError(t, json.NewDecoder(resp.Body).Decode(&metadata))
+
+	t.Run("endpoints should be relative to the issuer", func(t *testing.T) {
+		assert.Equal(t, metadata.Issuer, "https://auth.example")
+		assert.Equal(t, metadata.AuthorizationEndpoint, "https://auth.example/oauth/v2/auth")
+		assert.Equal(t, metadata.TokenEndpoint, "https://auth.example/oauth/v2/token")
+		assert.Equal(t, metadata.JwksURI, "https://auth.example/.well-known/jwks.json")
+	})
+
+	t.Run("grant types should be listed", func(t *testing.T) {
+		for _, grantType := range []string{"authorization_code", "password", "client_credentials", "refresh_token"} {
+			assert.Check(t, is.Contains(metadata.GrantTypesSupported, grantType))
+		}
+	})
+
+	t.Run("signing algorithms should be the one of the id tokens", func(t *testing.T) {
+		assert.DeepEqual(t, metadata.SigningAlgs, []string{"RS256"})
+	})
+
+	t.Run("scopes should contain the ones in the scopes collection", func(t *testing.T) {
+		assert.Check(t, is.Contains(metadata.ScopesSupported, "openid"))
+		assert.Check(t, is.Contains(metadata.ScopesSupported, "repository:read"))
+
+		for _, scope := range metadata.ScopesSupported {
+			assert.Check(t, scope != "project:(.*):(.*)")
+		}
+	})
+
+	t.Run("issuer should default to the request host", func(t *testing.T) {
+		cnf.Issuer = ""
+		defer func() { cnf.Issuer = "https://auth.example" }()
+
+		resp, err := srv.Client().Get(srv.URL + "/.well-known/openid-configuration")
+		assert.NilError(t, err)
+
+		var metadata struct {
+			Issuer string `json:"issuer"`
+		}
+		assert.NilError(t, json.NewDecoder(resp.Body).Decode(&metadata))
+		assert.Equal(t, metadata.Issuer, srv.URL)
+	})
+}
@@ -3,53 +3,37 @@
 package handlers
 
 import (
-	"encoding/json"
-	"github.com/ale-cci/oauthsrv/pkg/jwt"
-	"github.com/ale-cci/oauthsrv/pkg/passwords"
-	"go.mongodb.org/mongo-driver/bson"
+	"fmt"
 	"net/http"
 )
 
 func handleClientCredentials(cnf *Config, w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	app, err := authenticateClient(cnf, r)
+	if err != nil {
+		writeClientAuthError(w, err)
 		return
 	}
-	client_id := r.FormValue("client_id")
-	client_secret := r.FormValue("client_secret")
 
-	var app struct {
-		Id     string `bson:"_id"`
-		Secret string `bson:"client_secret"`
+	// public clients can't keep a secret, so they're never authenticated
+	// https://datatracker.ietf.org/doc/html/rfc6749#section-4.4
+	if app.isPublic() {
+		writeClientAuthError(w, fmt.Errorf("Client %q is public", app.Id))
+		return
 	}
 
-	err := cnf.Database.Collection("apps").FindOne(r.Context(), bson.D{
-		{Key: "_id", Value: client_id},
-	}).Decode(&app)
-
-	if err != nil || passwords.Validate(app.Secret, client_secret) != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-	} else {
-		token := jwt.JWT{
-			Head: &jwt.JWTHead{
-				Typ: "JWT",
-				Alg: "none",
-			},
-			Body: jwt.JWTBody{
-				// uniquely identifies the user
-				"sub": client_id,
-			},
-		}
-
-		tokenB64, _ := token.Encode(nil)
-		jsonBody, err := json.Marshal(struct {
-			Jwt string `json:"jwt"`
-		}{tokenB64})
-
-		if err != nil {
-			http.Error(w, "unable to build jwt", http.StatusInternalServerError)
-		} else {
-			w.Write(jsonBody)
-		}
+	// refresh tokens are not issued, as described in
+	// https://datatracker.ietf.org/doc/html/rfc6749#section-4.4.3
+	response, err := issueAccessToken(r, cnf, tokenGrant{
+		// uniquely identifies the client
+		Sub:      app.Id,
+		ClientId: app.Id,
+		Scope:    r.FormValue("scope"),
+		Client:   true,
+	})
+	if err != nil {
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "Unable to issue access token")
+		return
 	}
+
+	writeTokenResponse(w, response)
 }
@@ -34,15 +34,81 @@ func TestClientCredentials(t *testing.T) {
 		"grant_type": {"client_credentials"},
 	}.Encode()
 
-	t.Run("should return method not allowed for get requests", func(t *testing.T) {
-		resp, err := client.Get(urlPath)
+	t.Run("get requests should not issue tokens", func(t *testing.T) {
+		resp, err := client.Get(urlPath + "&" + url.Values{
+			"client_id":     {"client-id"},
+			"client_secret": {"client-secret"},
+		}.Encode())
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	})
 
-		assert.Assert(t, is.Nil(err))
+	t.Run("credentials could be sent with basic authentication", func(t *testing.T) {
+		req, err := http.NewRequest("POST", urlPath, nil)
+		assert.NilError(t, err)
+		req.SetBasicAuth("client-id", "client-secret")
 
-		expect := http.StatusMethodNotAllowed
-		got := resp.StatusCode
+		resp, err := client.Do(req)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+	})
 
-		assert.Equal(t, expect, got)
+	t.Run("clients without secret should be rejected", func(t *testing.T) {
+		_, err := cnf.Database.Collection("apps").InsertMany(context.Background(), []interface{}{
+			bson.D{
+				{Key: "_id", Value: "public-client"},
+				{Key: "type", Value: "public"},
+			},
+			bson.D{
+				{Key: "_id", Value: "secretless-client"},
+			},
+		})
+		assert.NilError(t, err)
+
+		for _, clientId := range []string{"public-client", "secretless-client"} {
+			resp, err := client.PostForm(urlPath, url.Values{"client_id": {clientId}})
+			assert.NilError(t, err)
+			assert.Equal(t, resp.StatusCode, http.StatusUnauthorized)
+			assert.Equal(t, decodeTokenResponse(t, resp).Error, "invalid_client")
+		}
+	})
+
+	t.Run("should return 500 if the stored secret is malformed", func(t *testing.T) {
+		_, err := cnf.Database.Collection("apps").InsertOne(context.Background(), bson.D{
+			{Key: "_id", Value: "malformed-secret-client"},
+			{Key: "client_secret", Value: "sha256$malformed"},
+		})
+		assert.NilError(t, err)
+
+		resp, err := client.PostForm(urlPath, url.Values{
+			"client_id":     {"malformed-secret-client"},
+			"client_secret": {"test"},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	})
+
+	t.Run("legacy client secrets should be upgraded", func(t *testing.T) {
+		legacy, err := passwords.Encode(passwords.SHA256, "salt", "legacy-secret")
+		assert.NilError(t, err)
+
+		_, err = cnf.Database.Collection("apps").InsertOne(context.Background(), bson.D{
+			{Key: "_id", Value: "legacy-secret-client"},
+			{Key: "client_secret", Value: legacy},
+		})
+		assert.NilError(t, err)
+
+		resp, err := client.PostForm(urlPath, url.Values{
+			"client_id":     {"legacy-secret-client"},
+			"client_secret": {"legacy-secret"},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		app, err := handlers.GetApp(context.Background(), cnf, "legacy-secret-client")
+		assert.NilError(t, err)
+		assert.Check(t, app.Secret != legacy)
+		assert.Check(t, !passwords.NeedsRehash(app.Secret))
 	})
 
 	t.Run("should return 401 if credentials are wrong", func(t *testing.T) {
@@ -68,19 +134,25 @@ func TestClientCredentials(t *testing.T) {
 		body, err := ioutil.ReadAll(resp.Body)
 		assert.NilError(t, err)
 		var jsonBody struct {
-			Jwt string `json:"jwt"`
+			AccessToken  string `json:"access_token"`
+			RefreshToken string `json:"refresh_token"`
 		}
 		err = json.Unmarshal(body, &jsonBody)
 		assert.NilError(t, err)
 
+		t.Run("refresh token should not be issued", func(t *testing.T) {
+			assert.Equal(t, jsonBody.RefreshToken, "")
+		})
+
 		t.Run("jwt is valid", func(t *testing.T) {
-			t.Logf("Value of jwt: %q", jsonBody.Jwt)
-			jwt, err := jwt.Decode(jsonBody.Jwt)
+			t.Logf("Value of jwt: %q", jsonBody.AccessToken)
+			jwt, err := jwt.Decode(jsonBody.AccessToken)
 			assert.NilError(t, err)
+			assert.NilError(t, jwt.Verify(cnf.Keystore))
 
 			t.Run("should contain valid head claims", func(t *testing.T) {
 				assert.Equal(t, jwt.Head.Typ, "JWT")
-				assert.Equal(t, jwt.Head.Alg, "none")
+				assert.Equal(t, jwt.Head.Alg, "RS256")
 			})
 			t.Run("should contain valid body claims", func(t *testing.T) {
 				assert.Equal(t, jwt.Body["sub"], "client-id")
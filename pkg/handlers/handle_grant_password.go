@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"time"
 
-	"github.com/ale-cci/oauthsrv/pkg/jwt"
 	"github.com/ale-cci/oauthsrv/pkg/passwords"
 	"go.mongodb.org/mongo-driver/bson"
 )
@@ -15,6 +18,33 @@ type Identity struct {
 	Uid      string `bson:"_id"`
 	Email    string `bson:"email"`
 	Password string `bson:"password"`
+
+	// profile, all the fields are optional
+	Name          string        `bson:"name"`
+	Surname       string        `bson:"surname"`
+	Address       string        `bson:"address"`
+	Picture       bson.RawValue `bson:"profile_picture"`
+	EmailVerified bool          `bson:"email_verified"`
+
+	Groups []string `bson:"groups"`
+
+	// disabled users could not authenticate
+	Disabled bool `bson:"disabled"`
+}
+
+// Fetch the identity with the given id
+func FindIdentity(ctx context.Context, cnf *Config, uid string) (*Identity, error) {
+	var identity Identity
+
+	err := cnf.Database.Collection("identities").FindOne(
+		ctx,
+		bson.D{{Key: "_id", Value: uid}},
+	).Decode(&identity)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch user: %w", err)
+	}
+	return &identity, nil
 }
 
 func GetIdentity(context context.Context, cnf *Config, username, password string) (*Identity, error) {
@@ -26,32 +56,92 @@ func GetIdentity(context context.Context, cnf *Config, username, password string
 	).Decode(&identity)
 
 	if err != nil {
-		return nil, fmt.Errorf("Unable to fetch user: %v", err)
+		return nil, fmt.Errorf("Unable to fetch user: %w", err)
+	}
+
+	// users without password could not authenticate with one
+	if identity.Password == "" {
+		return nil, fmt.Errorf("Password not set for user %q", identity.Uid)
 	}
 
 	if err := passwords.Validate(identity.Password, password); err != nil {
-		return nil, fmt.Errorf("Password validation failure: %v", err)
+		return nil, fmt.Errorf("Password validation failure: %w", err)
 	}
 
+	if identity.Disabled {
+		return nil, fmt.Errorf("User %q is disabled", identity.Uid)
+	}
+
+	if passwords.NeedsRehash(identity.Password) {
+		rehashPassword(context, cnf, &identity, password)
+	}
 	return &identity, nil
 }
 
+/**
+ * Reports if the credentials could not be verified because the stored
+ * hash is not valid, rather than because they're wrong.
+ */
+func isStoredHashError(err error) bool {
+	return errors.Is(err, passwords.ErrMalformedHash) ||
+		errors.Is(err, passwords.ErrUnknownAlgorithm) ||
+		errors.Is(err, passwords.ErrUnknownPepper)
+}
+
+/**
+ * Replaces the stored hash with one of the default algorithm.
+ * Failures are only logged, the user is authenticated anyway.
+ */
+func rehashPassword(ctx context.Context, cnf *Config, identity *Identity, password string) {
+	if hashed, ok := rehash(ctx, cnf, "identities", "password", identity.Uid, identity.Password, password); ok {
+		identity.Password = hashed
+	}
+}
+
+/**
+ * Replaces the hash stored in the field of the document with the given id,
+ * returning the new hash.
+ */
+func rehash(ctx context.Context, cnf *Config, collection, field, id, stored, plain string) (string, bool) {
+	hashed, err := passwords.New(rand.Reader, plain)
+	if err != nil {
+		log.Printf("Unable to rehash %s: %v", field, err)
+		return "", false
+	}
+
+	// the hash could have been changed in the meantime
+	_, err = cnf.Database.Collection(collection).UpdateOne(
+		ctx,
+		bson.D{
+			{Key: "_id", Value: id},
+			{Key: field, Value: stored},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: field, Value: hashed}}}},
+	)
+	if err != nil {
+		log.Printf("Unable to store rehashed %s: %v", field, err)
+		return "", false
+	}
+	return hashed, true
+}
+
 func handleGrantPassword(cnf *Config, w http.ResponseWriter, r *http.Request) {
 	enc := json.NewEncoder(w)
 
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+
+	identity, err := GetIdentity(r.Context(), cnf, username, password)
+	if isStoredHashError(err) {
+		log.Printf("Unable to verify credentials: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		enc.Encode(map[string]string{
 			"status":  "error",
-			"message": "Method not allowed",
+			"message": "Unable to verify credentials",
 		})
 		return
 	}
 
-	username := r.FormValue("username")
-	password := r.FormValue("password")
-
-	identity, err := GetIdentity(r.Context(), cnf, username, password)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		enc.Encode(map[string]string{
@@ -61,8 +151,11 @@ func handleGrantPassword(cnf *Config, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tokenB64, err := jwt.NewJWT(cnf.Keystore, jwt.JWTBody{
-		"sub": identity.Uid,
+	tokens, err := issueTokens(r, cnf, tokenGrant{
+		Sub:      identity.Uid,
+		Scope:    r.FormValue("scope"),
+		AuthTime: time.Now(),
+		Nonce:    r.FormValue("nonce"),
 	})
 
 	if err != nil {
@@ -74,8 +167,5 @@ func handleGrantPassword(cnf *Config, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	enc.Encode(map[string]string{
-		"access_token": tokenB64,
-	})
+	writeTokenResponse(w, tokens)
 }
@@ -34,24 +34,18 @@ func TestHandleAuthPassword(t *testing.T) {
 			{Key: "_id", Value: "unique-user-identifier"},
 			{Key: "email", Value: "test-grant-password@email.com"},
 		},
-		bson.D{{"$set", bson.D{{"password", password}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "password", Value: password}}}},
 		options.Update().SetUpsert(true),
 	)
 	assert.NilError(t, err)
 
-	t.Run("only post request should be allowed", func(t *testing.T) {
-		resp, err := client.Get(srv.URL + requestPath)
+	t.Run("credentials should not be accepted in get requests", func(t *testing.T) {
+		resp, err := client.Get(srv.URL + requestPath + "&" + url.Values{
+			"username": {"test-grant-password@email.com"},
+			"password": {"test"},
+		}.Encode())
 		assert.NilError(t, err)
-		assert.Equal(t, resp.StatusCode, http.StatusMethodNotAllowed)
-
-		t.Run("response should be a valid json", func(t *testing.T) {
-			data, err := io.ReadAll(resp.Body)
-			assert.NilError(t, err)
-
-			var fields map[string]string
-			err = json.Unmarshal(data, &fields)
-			assert.NilError(t, err)
-		})
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
 	})
 
 	t.Run("incorrect credentials should return 401", func(t *testing.T) {
@@ -84,15 +78,16 @@ func TestHandleAuthPassword(t *testing.T) {
 		body, err := io.ReadAll(resp.Body)
 		assert.NilError(t, err)
 
-		var fields map[string]string
+		var fields map[string]interface{}
 		err = json.Unmarshal(body, &fields)
 		assert.NilError(t, err)
 		assert.Equal(t, resp.StatusCode, http.StatusOK, fields["message"])
 
-		jwtData, err := jwt.Decode(fields["access_token"])
+		accessToken, _ := fields["access_token"].(string)
+		jwtData, err := jwt.Decode(accessToken)
 		assert.NilError(t, err)
 
-		assert.Check(t, jwtData.Head.Alg == "HS256")
+		assert.Check(t, jwtData.Head.Alg == "RS256")
 
 		err = jwtData.Verify(cnf.Keystore)
 		assert.NilError(t, err)
@@ -115,6 +110,11 @@ func TestHandleAuthPassword(t *testing.T) {
 			assert.Check(t, iatValue <= time.Now().Unix(), fmt.Sprintf("[iat is %v]", iatValue))
 		})
 
+		t.Run("response contains a refresh token", func(t *testing.T) {
+			refreshToken, _ := fields["refresh_token"].(string)
+			assert.Check(t, refreshToken != "")
+		})
+
 		t.Run("jwt has correct sub value", func(t *testing.T) {
 			sub, ok := jwtData.Body["sub"]
 			assert.Assert(t, ok, "Provided jwt doesn't have sub field")
@@ -122,4 +122,72 @@ func TestHandleAuthPassword(t *testing.T) {
 			assert.Equal(t, sub, "unique-user-identifier")
 		})
 	})
+
+	t.Run("legacy password hashes should be upgraded on login", func(t *testing.T) {
+		legacy, err := passwords.Encode(passwords.SHA256, "salt", "legacy")
+		assert.NilError(t, err)
+
+		_, err = cnf.Database.Collection("identities").InsertOne(context.Background(), bson.D{
+			{Key: "_id", Value: "legacy-password-user"},
+			{Key: "email", Value: "test-legacy-password@email.com"},
+			{Key: "password", Value: legacy},
+		})
+		assert.NilError(t, err)
+
+		resp, err := client.PostForm(srv.URL+requestPath, url.Values{
+			"username": {"test-legacy-password@email.com"},
+			"password": {"legacy"},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		identity, err := handlers.FindIdentity(context.Background(), cnf, "legacy-password-user")
+		assert.NilError(t, err)
+		assert.Check(t, identity.Password != legacy)
+		assert.Check(t, !passwords.NeedsRehash(identity.Password))
+		assert.NilError(t, passwords.Validate(identity.Password, "legacy"))
+	})
+
+	t.Run("stored password hashes should not crash the server", func(t *testing.T) {
+		tt := map[string]struct {
+			Password interface{}
+			Status   int
+		}{
+			"missing password":   {nil, http.StatusUnauthorized},
+			"malformed password": {"sha256", http.StatusInternalServerError},
+			"unknown algorithm":  {"md5$salt$hash", http.StatusInternalServerError},
+		}
+
+		for name, tc := range tt {
+			t.Run(name, func(t *testing.T) {
+				doc := bson.D{
+					{Key: "_id", Value: "stored-hash-" + name},
+					{Key: "email", Value: "test-stored-hash-" + name + "@email.com"},
+				}
+				if tc.Password != nil {
+					doc = append(doc, bson.E{Key: "password", Value: tc.Password})
+				}
+
+				_, err := cnf.Database.Collection("identities").InsertOne(context.Background(), doc)
+				assert.NilError(t, err)
+
+				resp, err := client.PostForm(srv.URL+requestPath, url.Values{
+					"username": {"test-stored-hash-" + name + "@email.com"},
+					"password": {"password"},
+				})
+				assert.NilError(t, err)
+				assert.Equal(t, resp.StatusCode, tc.Status)
+			})
+		}
+	})
+
+	t.Run("grant should be available on the token endpoint", func(t *testing.T) {
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/token", url.Values{
+			"grant_type": {"password"},
+			"username":   {"test-grant-password@email.com"},
+			"password":   {"test"},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+	})
 }
@@ -0,0 +1,148 @@
+// Refresh token
+// Renews an expired access token. Refresh tokens are rotated on each use,
+// presenting an already used token revokes every token of its family.
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const refreshTokenLifetime = 30 * 24 * time.Hour
+
+/**
+ * Refresh token stored in the `refresh_tokens` collection, only the hash
+ * of the token is saved.
+ * Each authorization originates a family of tokens, one for each rotation.
+ */
+type refreshToken struct {
+	Hash      string    `bson:"_id"`
+	Family    string    `bson:"family"`
+	Sub       string    `bson:"sub"`
+	ClientId  string    `bson:"client_id,omitempty"`
+	Scope     string    `bson:"scope"`
+	Used      bool      `bson:"used"`
+	Revoked   bool      `bson:"revoked"`
+	ExpiresAt time.Time `bson:"expires_at"`
+	AuthTime  time.Time `bson:"auth_time"`
+}
+
+func issueRefreshToken(ctx context.Context, cnf *Config, grant tokenGrant) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	family := grant.Family
+	if family == "" {
+		family = uuid.New().String()
+	}
+
+	_, err = cnf.Database.Collection("refresh_tokens").InsertOne(ctx, refreshToken{
+		Hash:      hashToken(token),
+		Family:    family,
+		Sub:       grant.Sub,
+		ClientId:  grant.ClientId,
+		Scope:     grant.Scope,
+		ExpiresAt: time.Now().Add(refreshTokenLifetime),
+		AuthTime:  grant.AuthTime,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Revokes all the tokens originated from the same authorization
+func revokeRefreshTokenFamily(ctx context.Context, cnf *Config, family string) error {
+	_, err := cnf.Database.Collection("refresh_tokens").UpdateMany(
+		ctx,
+		bson.D{{Key: "family", Value: family}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "revoked", Value: true}}}},
+	)
+	return err
+}
+
+func handleGrantRefreshToken(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	tokens := cnf.Database.Collection("refresh_tokens")
+	tokenHash := hashToken(r.PostFormValue("refresh_token"))
+
+	var stored refreshToken
+	err := tokens.FindOne(r.Context(), bson.D{{Key: "_id", Value: tokenHash}}).Decode(&stored)
+	if err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+		return
+	}
+
+	// tokens issued to a client could only be refreshed by the same client
+	if stored.ClientId != "" {
+		app, err := authenticateClient(cnf, r)
+		if err != nil {
+			writeClientAuthError(w, err)
+			return
+		}
+
+		if app.Id != stored.ClientId {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Refresh token was issued to another client")
+			return
+		}
+	}
+
+	// tokens stored while the user was being disabled are not revoked,
+	// checked before using the token so that failures could be retried
+	disabled, err := isDisabled(r.Context(), cnf, stored.Sub)
+	if err != nil {
+		log.Printf("Unable to check user %q: %v", stored.Sub, err)
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "Unable to check user")
+		return
+	}
+	if disabled {
+		revokeRefreshTokenFamily(r.Context(), cnf, stored.Family)
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "User is disabled")
+		return
+	}
+
+	// mark the token as used, the filter guarantees that concurrent
+	// requests could not use the same token twice
+	err = tokens.FindOneAndUpdate(
+		r.Context(),
+		bson.D{
+			{Key: "_id", Value: tokenHash},
+			{Key: "used", Value: false},
+			{Key: "revoked", Value: false},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "used", Value: true}}}},
+	).Err()
+
+	if err != nil {
+		// the token was already used: it was stolen or leaked, and either the
+		// attacker or the legitimate client holds a valid token of the family
+		revokeRefreshTokenFamily(r.Context(), cnf, stored.Family)
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Refresh token already used or revoked")
+		return
+	}
+
+	if !stored.ExpiresAt.After(time.Now()) {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Refresh token expired")
+		return
+	}
+
+	response, err := issueTokens(r, cnf, tokenGrant{
+		Sub:      stored.Sub,
+		ClientId: stored.ClientId,
+		Scope:    stored.Scope,
+		Family:   stored.Family,
+		AuthTime: stored.AuthTime,
+	})
+	if err != nil {
+		writeTokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	writeTokenResponse(w, response)
+}
@@ -0,0 +1,218 @@
+package handlers_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"github.com/ale-cci/oauthsrv/pkg/jwt"
+	"github.com/ale-cci/oauthsrv/pkg/passwords"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gotest.tools/assert"
+)
+
+type testTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+}
+
+func decodeTokenResponse(t *testing.T, resp *http.Response) testTokenResponse {
+	var body testTokenResponse
+	assert.NilError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return body
+}
+
+func TestGrantRefreshToken(t *testing.T) {
+	cnf, _ := handlers.EnvConfig()
+	srv := NewTestServer(cnf)
+	defer srv.Close()
+
+	client := NoFollowRedirectClient(srv)
+	requestPath := srv.URL + "/oauth/v2/auth?grant_type=refresh_token"
+
+	password, _ := passwords.New(rand.Reader, "test")
+	_, err := cnf.Database.Collection("identities").UpdateOne(
+		context.Background(),
+		bson.D{
+			{Key: "_id", Value: "refresh-token-user"},
+			{Key: "email", Value: "refresh-token@email.com"},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "password", Value: password}}}},
+		options.Update().SetUpsert(true),
+	)
+	assert.NilError(t, err)
+
+	login := func(t *testing.T) testTokenResponse {
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/auth?grant_type=password", url.Values{
+			"username": {"refresh-token@email.com"},
+			"password": {"test"},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		tokens := decodeTokenResponse(t, resp)
+		assert.Assert(t, tokens.RefreshToken != "")
+		return tokens
+	}
+
+	refresh := func(t *testing.T, refreshToken string) *http.Response {
+		resp, err := client.PostForm(requestPath, url.Values{
+			"refresh_token": {refreshToken},
+		})
+		assert.NilError(t, err)
+		return resp
+	}
+
+	t.Run("get requests should not refresh tokens", func(t *testing.T) {
+		resp, err := client.Get(requestPath)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	})
+
+	t.Run("unknown refresh tokens should be rejected", func(t *testing.T) {
+		resp := refresh(t, "random-token")
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		assert.Equal(t, decodeTokenResponse(t, resp).Error, "invalid_grant")
+	})
+
+	t.Run("refresh token should be rotated on use", func(t *testing.T) {
+		tokens := login(t)
+
+		resp := refresh(t, tokens.RefreshToken)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		refreshed := decodeTokenResponse(t, resp)
+		assert.Check(t, refreshed.RefreshToken != "")
+		assert.Check(t, refreshed.RefreshToken != tokens.RefreshToken)
+
+		accessToken, err := jwt.Decode(refreshed.AccessToken)
+		assert.NilError(t, err)
+		assert.NilError(t, accessToken.Verify(cnf.Keystore))
+		assert.Equal(t, accessToken.Body["sub"], "refresh-token-user")
+
+		t.Run("rotated token could be used", func(t *testing.T) {
+			resp := refresh(t, refreshed.RefreshToken)
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+		})
+	})
+
+	t.Run("reusing a refresh token should revoke the whole family", func(t *testing.T) {
+		tokens := login(t)
+
+		resp := refresh(t, tokens.RefreshToken)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		rotated := decodeTokenResponse(t, resp)
+
+		resp = refresh(t, tokens.RefreshToken)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		assert.Equal(t, decodeTokenResponse(t, resp).Error, "invalid_grant")
+
+		resp = refresh(t, rotated.RefreshToken)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+
+		t.Run("other families should not be affected", func(t *testing.T) {
+			other := login(t)
+			resp := refresh(t, other.RefreshToken)
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+		})
+	})
+
+	t.Run("tokens issued to a client should be refreshed only by the same client", func(t *testing.T) {
+		initCodeApp(t, cnf)
+
+		browser := NoFollowRedirectClient(srv)
+		browser.Jar, _ = cookiejar.New(nil)
+		sid, err := handlers.NewSession(cnf, "refresh-token-user")
+		assert.NilError(t, err)
+		location, _ := url.Parse(srv.URL)
+		browser.Jar.SetCookies(location, []*http.Cookie{{Name: "sid", Value: sid}})
+
+		code := obtainCode(t, srv, browser, url.Values{
+			"grant_type":   {"code"},
+			"client_id":    {TEST_CLIENT_ID},
+			"redirect_uri": {TEST_REDIRECT_URI},
+			"state":        {"state"},
+		})
+
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {TEST_REDIRECT_URI},
+			"client_id":     {TEST_CLIENT_ID},
+			"client_secret": {TEST_CLIENT_SECRET},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		tokens := decodeTokenResponse(t, resp)
+
+		resp = refresh(t, tokens.RefreshToken)
+		assert.Equal(t, resp.StatusCode, http.StatusUnauthorized)
+
+		resp, err = client.PostForm(srv.URL+"/oauth/v2/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {tokens.RefreshToken},
+			"client_id":     {TEST_CLIENT_ID},
+			"client_secret": {TEST_CLIENT_SECRET},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+	})
+
+	t.Run("grants obtained before disabling the user should be rejected", func(t *testing.T) {
+		initCodeApp(t, cnf)
+		tokens := login(t)
+
+		browser := NoFollowRedirectClient(srv)
+		browser.Jar, _ = cookiejar.New(nil)
+		sid, err := handlers.NewSession(cnf, "refresh-token-user")
+		assert.NilError(t, err)
+		location, _ := url.Parse(srv.URL)
+		browser.Jar.SetCookies(location, []*http.Cookie{{Name: "sid", Value: sid}})
+
+		code := obtainCode(t, srv, browser, url.Values{
+			"grant_type":   {"code"},
+			"client_id":    {TEST_CLIENT_ID},
+			"redirect_uri": {TEST_REDIRECT_URI},
+			"state":        {"state"},
+		})
+
+		setDisabled := func(disabled bool) {
+			_, err := cnf.Database.Collection("identities").UpdateOne(
+				context.Background(),
+				bson.D{{Key: "_id", Value: "refresh-token-user"}},
+				bson.D{{Key: "$set", Value: bson.D{{Key: "disabled", Value: disabled}}}},
+			)
+			assert.NilError(t, err)
+		}
+		setDisabled(true)
+		defer setDisabled(false)
+
+		resp := refresh(t, tokens.RefreshToken)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		assert.Equal(t, decodeTokenResponse(t, resp).Error, "invalid_grant")
+
+		resp, err = client.PostForm(srv.URL+"/oauth/v2/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {TEST_REDIRECT_URI},
+			"client_id":     {TEST_CLIENT_ID},
+			"client_secret": {TEST_CLIENT_SECRET},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		assert.Equal(t, decodeTokenResponse(t, resp).Error, "invalid_grant")
+
+		t.Run("refresh tokens should be revoked", func(t *testing.T) {
+			setDisabled(false)
+			resp := refresh(t, tokens.RefreshToken)
+			assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		})
+	})
+}
@@ -0,0 +1,51 @@
+// JSON Web Key Set
+// Publishes the public keys of the keystore, so tokens could be verified
+// by services without access to the keystore.
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ale-cci/oauthsrv/pkg/jwk"
+	"github.com/ale-cci/oauthsrv/pkg/keystore"
+)
+
+/**
+ * Cache duration of the key set, for keystores not rotating keys.
+ * Keys are generated on demand, consumers should fetch the set
+ * again when a token is signed with an unknown key id.
+ */
+const defaultJWKSMaxAge = 5 * time.Minute
+
+func jwksMaxAge(ks keystore.Keystore) time.Duration {
+	if policy, ok := ks.(keystore.CachePolicy); ok {
+		return policy.CacheMaxAge()
+	}
+	return defaultJWKSMaxAge
+}
+
+func handleJWKS(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	keys, err := cnf.Keystore.PublicKeys()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	set := jwk.Set{Keys: []*jwk.Key{}}
+	for _, keyInfo := range keys {
+		key, err := jwk.FromPublicKey(keyInfo.KeyID, keyInfo.Alg, keyInfo.PublicKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		set.Keys = append(set.Keys, key)
+	}
+
+	maxAge := int(jwksMaxAge(cnf.Keystore).Seconds())
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", fmt.Sprintf("public, max-age=%d", maxAge))
+	json.NewEncoder(w).Encode(set)
+}
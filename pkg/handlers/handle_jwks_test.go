@@ -0,0 +1,82 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"github.com/ale-cci/oauthsrv/pkg/jwk"
+	"github.com/ale-cci/oauthsrv/pkg/jwt"
+	"github.com/ale-cci/oauthsrv/pkg/keystore"
+	"gotest.tools/assert"
+)
+
+func TestJWKS(t *testing.T) {
+	cnf, _ := handlers.EnvConfig()
+	srv := NewTestServer(cnf)
+	defer srv.Close()
+
+	client := srv.Client()
+	requestPath := srv.URL + "/.well-known/jwks.json"
+
+	fetchKeys := func(t *testing.T) (*http.Response, jwk.Set) {
+		resp, err := client.Get(requestPath)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		var set jwk.Set
+		assert.NilError(t, json.NewDecoder(resp.Body).Decode(&set))
+		return resp, set
+	}
+
+	t.Run("key set should contain the keys used to sign tokens", func(t *testing.T) {
+		encoded, err := jwt.NewJWT(cnf.Keystore, jwt.JWTBody{"sub": "jwks-user"})
+		assert.NilError(t, err)
+		token, err := jwt.Decode(encoded)
+		assert.NilError(t, err)
+
+		_, set := fetchKeys(t)
+
+		var found *jwk.Key
+		for _, key := range set.Keys {
+			if key.Kid == token.Head.Kid {
+				found = key
+			}
+		}
+		assert.Assert(t, found != nil, "key %q not published", token.Head.Kid)
+		assert.Equal(t, found.Alg, "RS256")
+		assert.Equal(t, found.Use, "sig")
+		assert.Equal(t, found.Kty, "RSA")
+		assert.Check(t, found.N != "")
+		assert.Equal(t, found.E, "AQAB")
+	})
+
+	t.Run("secret keys should never be published", func(t *testing.T) {
+		secrets, ok := cnf.Keystore.(keystore.SecretKeyProvider)
+		if !ok {
+			t.Skip("keystore does not provide secret keys")
+		}
+
+		secret, err := secrets.GetSecretKey("HS256")
+		assert.NilError(t, err)
+
+		_, set := fetchKeys(t)
+		for _, key := range set.Keys {
+			assert.Check(t, key.Kid != secret.KeyID)
+			assert.Check(t, key.Kty != "oct")
+		}
+	})
+
+	t.Run("response should be cacheable", func(t *testing.T) {
+		resp, _ := fetchKeys(t)
+		assert.Equal(t, resp.Header.Get("content-type"), "application/json")
+		assert.Equal(t, resp.Header.Get("cache-control"), "public, max-age=300")
+	})
+
+	t.Run("only get requests should be allowed", func(t *testing.T) {
+		resp, err := client.Post(requestPath, "application/json", nil)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusMethodNotAllowed)
+	})
+}
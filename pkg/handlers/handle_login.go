@@ -2,10 +2,8 @@ package handlers
 
 import (
 	"html/template"
+	"log"
 	"net/http"
-
-	"github.com/ale-cci/oauthsrv/pkg/jwt"
-	"github.com/ale-cci/oauthsrv/pkg/passwords"
 )
 
 func handleLogin(cnf *Config, w http.ResponseWriter, r *http.Request) {
@@ -39,16 +37,19 @@ func handleLogin(cnf *Config, w http.ResponseWriter, r *http.Request) {
 		afterLogin := r.URL.Query().Get("continue")
 
 		identity, err := GetIdentity(r.Context(), cnf, username, password)
+		if isStoredHashError(err) {
+			log.Printf("Unable to verify credentials: %v", err)
+			http.Error(w, "Unable to verify credentials", http.StatusInternalServerError)
+			return
+		}
 
-		if err != nil || passwords.Validate(identity.Password, password) != nil {
+		if err != nil {
 			http.SetCookie(w, &http.Cookie{Name: "error", Value: "Wrong username or password"})
 			http.Redirect(w, r, r.URL.RequestURI(), http.StatusFound)
 			return
 		}
 
-		sid, _ := jwt.NewJWT(cnf.Keystore, jwt.JWTBody{
-			"sub": identity.Uid,
-		})
+		sid, _ := NewSession(cnf, identity.Uid)
 
 		http.SetCookie(w, &http.Cookie{Name: "sid", Value: sid})
 		http.Redirect(w, r, afterLogin, http.StatusFound)
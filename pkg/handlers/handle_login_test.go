@@ -17,6 +17,7 @@ import (
 	"github.com/ale-cci/oauthsrv/pkg/handlers"
 	"github.com/ale-cci/oauthsrv/pkg/jwt"
 	"github.com/ale-cci/oauthsrv/pkg/passwords"
+	"github.com/ale-cci/oauthsrv/pkg/server"
 	"github.com/kylelemons/godebug/diff"
 	"go.mongodb.org/mongo-driver/bson"
 	"golang.org/x/net/publicsuffix"
@@ -24,13 +25,10 @@ import (
 )
 
 func NewTestServer(cnf *handlers.Config) *httptest.Server {
-	router := http.NewServeMux()
 	if cnf == nil {
 		cnf, _ = handlers.EnvConfig()
 	}
-	handlers.AddRoutes(cnf, router)
-	srv := httptest.NewServer(router)
-	return srv
+	return httptest.NewServer(server.New(cnf))
 }
 
 func NoFollowRedirectClient(srv *httptest.Server) *http.Client {
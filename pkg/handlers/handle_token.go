@@ -0,0 +1,153 @@
+// Token endpoint
+// Exchanges the authorization code obtained from /oauth/v2/auth, a refresh
+// token or credentials, for an access token
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/ale-cci/oauthsrv/pkg/passwords"
+)
+
+func handleToken(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	switch grantType := r.PostFormValue("grant_type"); grantType {
+	case "authorization_code":
+		handleTokenAuthorizationCode(cnf, w, r)
+
+	case "refresh_token":
+		handleGrantRefreshToken(cnf, w, r)
+
+	case "password":
+		handleGrantPassword(cnf, w, r)
+
+	case "client_credentials":
+		handleClientCredentials(cnf, w, r)
+
+	default:
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type", "Grant type not supported")
+	}
+}
+
+/**
+ * Authenticates the client performing the request, credentials could be
+ * provided either with http basic authentication or in the request body.
+ * Public clients are only identified by their client_id.
+ */
+func authenticateClient(cnf *Config, r *http.Request) (*App, error) {
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientId = r.PostFormValue("client_id")
+		clientSecret = r.PostFormValue("client_secret")
+	}
+
+	app, err := GetApp(r.Context(), cnf, clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	if app.isPublic() {
+		return app, nil
+	}
+
+	// confidential clients registered without a secret can't authenticate
+	if app.Secret == "" {
+		return nil, fmt.Errorf("Client %q has no secret", app.Id)
+	}
+
+	if err := passwords.Validate(app.Secret, clientSecret); err != nil {
+		return nil, err
+	}
+
+	if passwords.NeedsRehash(app.Secret) {
+		if hashed, ok := rehash(r.Context(), cnf, "apps", "client_secret", app.Id, app.Secret, clientSecret); ok {
+			app.Secret = hashed
+		}
+	}
+	return app, nil
+}
+
+/**
+ * Writes the error of a failed client authentication. Errors of the stored
+ * secret are reported as server errors, so clients don't discard valid
+ * credentials.
+ */
+func writeClientAuthError(w http.ResponseWriter, err error) {
+	if isStoredHashError(err) {
+		log.Printf("Unable to verify client secret: %v", err)
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "Unable to verify client credentials")
+		return
+	}
+
+	w.Header().Set("www-authenticate", "Basic")
+	writeTokenError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+}
+
+/**
+ * Tokens are not issued to disabled users, even from grants obtained before
+ * they were disabled. Writes the response on failure.
+ */
+func checkEnabled(cnf *Config, w http.ResponseWriter, r *http.Request, sub string) bool {
+	disabled, err := isDisabled(r.Context(), cnf, sub)
+	if err != nil {
+		log.Printf("Unable to check user %q: %v", sub, err)
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "Unable to check user")
+		return false
+	}
+
+	if disabled {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "User is disabled")
+		return false
+	}
+	return true
+}
+
+func handleTokenAuthorizationCode(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	app, err := authenticateClient(cnf, r)
+	if err != nil {
+		writeClientAuthError(w, err)
+		return
+	}
+
+	authCode, err := consumeAuthorizationCode(r, cnf, r.PostFormValue("code"))
+	if err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+
+	if authCode.ClientId != app.Id || authCode.RedirectURI != r.PostFormValue("redirect_uri") {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Authorization code was issued to another client")
+		return
+	}
+
+	verifier := r.PostFormValue("code_verifier")
+	if authCode.CodeChallenge == "" && (verifier != "" || app.isPublic()) {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Authorization code was issued without code challenge")
+		return
+	}
+
+	if authCode.CodeChallenge != "" && !verifyCodeChallenge(authCode.CodeChallenge, authCode.CodeChallengeMethod, verifier) {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Code verifier does not match the code challenge")
+		return
+	}
+
+	if !checkEnabled(cnf, w, r, authCode.Sub) {
+		return
+	}
+
+	tokens, err := issueTokens(r, cnf, tokenGrant{
+		Sub:      authCode.Sub,
+		ClientId: app.Id,
+		Scope:    authCode.Scope,
+		AuthTime: authCode.AuthTime,
+		Nonce:    authCode.Nonce,
+		Code:     r.PostFormValue("code"),
+	})
+	if err != nil {
+		writeTokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	writeTokenResponse(w, tokens)
+}
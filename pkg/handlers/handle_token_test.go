@@ -0,0 +1,141 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"gotest.tools/assert"
+)
+
+func TestTokenEndpoint(t *testing.T) {
+	cnf, _ := handlers.EnvConfig()
+	srv := NewTestServer(cnf)
+	defer srv.Close()
+
+	client := NoFollowRedirectClient(srv)
+	client.Jar, _ = cookiejar.New(nil)
+
+	initCodeApp(t, cnf)
+
+	sid, err := handlers.NewSession(cnf, "token-test-user")
+	assert.NilError(t, err)
+	location, _ := url.Parse(srv.URL)
+	client.Jar.SetCookies(location, []*http.Cookie{{Name: "sid", Value: sid}})
+
+	authorizeParams := url.Values{
+		"grant_type":   {"code"},
+		"client_id":    {TEST_CLIENT_ID},
+		"redirect_uri": {TEST_REDIRECT_URI},
+		"state":        {"state"},
+	}
+
+	tokenError := func(t *testing.T, resp *http.Response) string {
+		var body struct {
+			Error string `json:"error"`
+		}
+		assert.NilError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body.Error
+	}
+
+	t.Run("only post requests should be allowed", func(t *testing.T) {
+		resp, err := client.Get(srv.URL + "/oauth/v2/token")
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusMethodNotAllowed)
+		assert.Equal(t, resp.Header.Get("allow"), "OPTIONS, POST")
+	})
+
+	t.Run("should return unsupported_grant_type for unknown grant types", func(t *testing.T) {
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/token", url.Values{
+			"grant_type": {"random"},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		assert.Equal(t, tokenError(t, resp), "unsupported_grant_type")
+	})
+
+	t.Run("should return 401 if client credentials are wrong", func(t *testing.T) {
+		code := obtainCode(t, srv, client, authorizeParams)
+
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {TEST_REDIRECT_URI},
+			"client_id":     {TEST_CLIENT_ID},
+			"client_secret": {"wrong-secret"},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusUnauthorized)
+		assert.Equal(t, tokenError(t, resp), "invalid_client")
+	})
+
+	t.Run("client should be able to authenticate with basic auth", func(t *testing.T) {
+		code := obtainCode(t, srv, client, authorizeParams)
+
+		form := url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {code},
+			"redirect_uri": {TEST_REDIRECT_URI},
+		}
+		req, err := http.NewRequest("POST", srv.URL+"/oauth/v2/token", strings.NewReader(form.Encode()))
+		assert.NilError(t, err)
+		req.SetBasicAuth(TEST_CLIENT_ID, TEST_CLIENT_SECRET)
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+
+		resp, err := client.Do(req)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+	})
+
+	t.Run("codes should be single use", func(t *testing.T) {
+		code := obtainCode(t, srv, client, authorizeParams)
+		values := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {TEST_REDIRECT_URI},
+			"client_id":     {TEST_CLIENT_ID},
+			"client_secret": {TEST_CLIENT_SECRET},
+		}
+
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/token", values)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		resp, err = client.PostForm(srv.URL+"/oauth/v2/token", values)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		assert.Equal(t, tokenError(t, resp), "invalid_grant")
+	})
+
+	t.Run("redirect uri should match the authorization request", func(t *testing.T) {
+		code := obtainCode(t, srv, client, authorizeParams)
+
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {"http://client.example/another"},
+			"client_id":     {TEST_CLIENT_ID},
+			"client_secret": {TEST_CLIENT_SECRET},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		assert.Equal(t, tokenError(t, resp), "invalid_grant")
+	})
+
+	t.Run("unknown codes should return invalid_grant", func(t *testing.T) {
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {"not-a-code"},
+			"redirect_uri":  {TEST_REDIRECT_URI},
+			"client_id":     {TEST_CLIENT_ID},
+			"client_secret": {TEST_CLIENT_SECRET},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		assert.Equal(t, tokenError(t, resp), "invalid_grant")
+	})
+}
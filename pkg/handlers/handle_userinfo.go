@@ -0,0 +1,47 @@
+// UserInfo endpoint
+// Returns the claims of the authenticated user, filtered by the scopes
+// granted to the access token.
+// https://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ale-cci/oauthsrv/pkg/jwt"
+)
+
+// Access tokens should be obtained with the `openid` scope
+func requireOpenIDScope(body jwt.JWTBody) error {
+	scope, _ := body["scope"].(string)
+	if !hasScope(scope, "openid") {
+		return fmt.Errorf("Missing openid scope")
+	}
+	return nil
+}
+
+func handleUserinfo(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	CheckJWT(handleUserinfoClaims, requireOpenIDScope)(cnf, w, r)
+}
+
+func handleUserinfoClaims(cnf *Config, w http.ResponseWriter, r *http.Request) {
+	token, _ := getJWTBody(r)
+	sub, _ := token["sub"].(string)
+	scope, _ := token["scope"].(string)
+
+	identity, err := FindIdentity(r.Context(), cnf, sub)
+	if err != nil || identity.Disabled {
+		// the user was removed or disabled after the token was issued
+		w.Header().Set("www-authenticate", "Bearer error=\"invalid_token\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	claims := identityClaims(identity, scope)
+	claims["sub"] = identity.Uid
+
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	json.NewEncoder(w).Encode(claims)
+}
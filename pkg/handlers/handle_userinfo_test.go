@@ -0,0 +1,146 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"github.com/ale-cci/oauthsrv/pkg/jwt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gotest.tools/assert"
+)
+
+func TestUserinfo(t *testing.T) {
+	cnf, _ := handlers.EnvConfig()
+	srv := NewTestServer(cnf)
+	defer srv.Close()
+
+	client := srv.Client()
+	requestPath := srv.URL + "/userinfo"
+
+	_, err := cnf.Database.Collection("identities").UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: "userinfo-user"}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "email", Value: "userinfo@email.com"},
+			{Key: "email_verified", Value: false},
+			{Key: "name", Value: "Anna"},
+			{Key: "surname", Value: "Bianchi"},
+			{Key: "profile_picture", Value: "https://cdn.example/anna.png"},
+			{Key: "address", Value: "Via Roma 1, Milano"},
+		}}},
+		options.Update().SetUpsert(true),
+	)
+	assert.NilError(t, err)
+
+	accessToken := func(t *testing.T, scope string) string {
+		token, err := handlers.NewAccessToken(cnf, jwt.JWTBody{"sub": "userinfo-user", "scope": scope})
+		assert.NilError(t, err)
+		return token
+	}
+
+	userinfo := func(t *testing.T, token string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest("GET", requestPath, nil)
+		assert.NilError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := client.Do(req)
+		assert.NilError(t, err)
+
+		var claims map[string]interface{}
+		if resp.StatusCode == http.StatusOK {
+			assert.NilError(t, json.NewDecoder(resp.Body).Decode(&claims))
+		}
+		return resp, claims
+	}
+
+	t.Run("claims should be filtered by scope", func(t *testing.T) {
+		resp, claims := userinfo(t, accessToken(t, "openid email"))
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		assert.DeepEqual(t, claims, map[string]interface{}{
+			"sub":            "userinfo-user",
+			"email":          "userinfo@email.com",
+			"email_verified": false,
+		})
+	})
+
+	t.Run("profile scope should return name and picture", func(t *testing.T) {
+		_, claims := userinfo(t, accessToken(t, "openid profile"))
+
+		assert.Equal(t, claims["name"], "Anna Bianchi")
+		assert.Equal(t, claims["given_name"], "Anna")
+		assert.Equal(t, claims["family_name"], "Bianchi")
+		assert.Equal(t, claims["picture"], "https://cdn.example/anna.png")
+		_, ok := claims["email"]
+		assert.Check(t, !ok)
+	})
+
+	t.Run("address scope should return the address", func(t *testing.T) {
+		_, claims := userinfo(t, accessToken(t, "openid address"))
+
+		assert.DeepEqual(t, claims["address"], map[string]interface{}{
+			"formatted": "Via Roma 1, Milano",
+		})
+	})
+
+	t.Run("tokens without openid scope should be rejected", func(t *testing.T) {
+		resp, _ := userinfo(t, accessToken(t, "email"))
+		assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+		assert.Equal(t, resp.Header.Get("www-authenticate"), "Bearer error=\"insufficient_scope\"")
+	})
+
+	t.Run("invalid tokens should be rejected", func(t *testing.T) {
+		resp, _ := userinfo(t, "a.b.c")
+		assert.Equal(t, resp.StatusCode, http.StatusUnauthorized)
+		assert.Equal(t, resp.Header.Get("www-authenticate"), "Bearer error=\"invalid_token\"")
+	})
+
+	t.Run("post requests should be supported", func(t *testing.T) {
+		req, err := http.NewRequest("POST", requestPath, nil)
+		assert.NilError(t, err)
+		req.Header.Set("Authorization", "Bearer "+accessToken(t, "openid"))
+
+		resp, err := client.Do(req)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		t.Run("with the token in the body", func(t *testing.T) {
+			body := url.Values{"access_token": {accessToken(t, "openid")}}.Encode()
+			resp, err := client.Post(requestPath, "application/x-www-form-urlencoded", strings.NewReader(body))
+			assert.NilError(t, err)
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+		})
+	})
+
+	t.Run("disabled users should be rejected", func(t *testing.T) {
+		setDisabled := func(disabled bool) {
+			_, err := cnf.Database.Collection("identities").UpdateOne(
+				context.Background(),
+				bson.D{{Key: "_id", Value: "userinfo-user"}},
+				bson.D{{Key: "$set", Value: bson.D{{Key: "disabled", Value: disabled}}}},
+			)
+			assert.NilError(t, err)
+		}
+		setDisabled(true)
+		defer setDisabled(false)
+
+		resp, _ := userinfo(t, accessToken(t, "openid email"))
+		assert.Equal(t, resp.StatusCode, http.StatusUnauthorized)
+		assert.Equal(t, resp.Header.Get("www-authenticate"), "Bearer error=\"invalid_token\"")
+	})
+
+	t.Run("other methods should not be allowed", func(t *testing.T) {
+		req, err := http.NewRequest("DELETE", requestPath, nil)
+		assert.NilError(t, err)
+
+		resp, err := client.Do(req)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusMethodNotAllowed)
+	})
+}
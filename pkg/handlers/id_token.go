@@ -0,0 +1,94 @@
+// OpenID Connect id token
+// Issued along with the access token when the `openid` scope is granted,
+// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/ale-cci/oauthsrv/pkg/jwt"
+)
+
+/**
+ * Standard claims of the identity, as defined in
+ * https://openid.net/specs/openid-connect-core-1_0.html#StandardClaims
+ * only the claims of the granted scopes are returned.
+ */
+func identityClaims(identity *Identity, scope string) jwt.JWTBody {
+	claims := jwt.JWTBody{}
+
+	if hasScope(scope, "profile") {
+		fullName := strings.TrimSpace(identity.Name + " " + identity.Surname)
+		if fullName != "" {
+			claims["name"] = fullName
+		}
+		if identity.Name != "" {
+			claims["given_name"] = identity.Name
+		}
+		if identity.Surname != "" {
+			claims["family_name"] = identity.Surname
+		}
+		// pictures are published only when stored as url
+		if picture, ok := identity.Picture.StringValueOK(); ok && picture != "" {
+			claims["picture"] = picture
+		}
+	}
+
+	if hasScope(scope, "email") {
+		claims["email"] = identity.Email
+		claims["email_verified"] = identity.EmailVerified
+	}
+
+	if hasScope(scope, "address") && identity.Address != "" {
+		claims["address"] = map[string]string{"formatted": identity.Address}
+	}
+
+	return claims
+}
+
+/**
+ * Issues the id token for the grant. The access token issued along with it
+ * is bound through the `at_hash` claim.
+ * Tokens not issued to a client have the issuer as audience.
+ */
+func issueIDToken(r *http.Request, cnf *Config, grant tokenGrant, accessToken string) (string, error) {
+	identity, err := FindIdentity(r.Context(), cnf, grant.Sub)
+	if err != nil {
+		return "", err
+	}
+
+	claims := identityClaims(identity, grant.Scope)
+
+	issuer := cnf.issuer(r)
+	claims[tokenUseClaim] = idTokenUse
+	claims["iss"] = issuer
+	claims["sub"] = grant.Sub
+	claims["aud"] = grant.ClientId
+	if grant.ClientId == "" {
+		claims["aud"] = issuer
+	}
+	if !grant.AuthTime.IsZero() {
+		claims["auth_time"] = grant.AuthTime.Unix()
+	}
+
+	if grant.Nonce != "" {
+		claims["nonce"] = grant.Nonce
+	}
+
+	// hashes are computed with the hash function of the signing algorithm
+	alg := cnf.signingAlgorithm()
+	claims["at_hash"], err = jwt.HalfHash(alg, accessToken)
+	if err != nil {
+		return "", err
+	}
+
+	if grant.Code != "" {
+		claims["c_hash"], err = jwt.HalfHash(alg, grant.Code)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return jwt.NewJWTWithAlgorithm(cnf.Keystore, alg, claims)
+}
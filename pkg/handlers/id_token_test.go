@@ -0,0 +1,145 @@
+package handlers_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"github.com/ale-cci/oauthsrv/pkg/jwt"
+	"github.com/ale-cci/oauthsrv/pkg/passwords"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gotest.tools/assert"
+)
+
+func TestIDToken(t *testing.T) {
+	cnf, _ := handlers.EnvConfig()
+	cnf.Issuer = "https://auth.example"
+	srv := NewTestServer(cnf)
+	defer srv.Close()
+
+	initCodeApp(t, cnf)
+
+	password, _ := passwords.New(rand.Reader, "test")
+	_, err := cnf.Database.Collection("identities").UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: "id-token-user"}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "email", Value: "id-token@email.com"},
+			{Key: "email_verified", Value: true},
+			{Key: "name", Value: "Mario"},
+			{Key: "surname", Value: "Rossi"},
+			{Key: "password", Value: password},
+		}}},
+		options.Update().SetUpsert(true),
+	)
+	assert.NilError(t, err)
+
+	client := NoFollowRedirectClient(srv)
+
+	decodeIDToken := func(t *testing.T, resp *http.Response) (*jwt.JWT, string) {
+		var body struct {
+			AccessToken string `json:"access_token"`
+			IDToken     string `json:"id_token"`
+		}
+		assert.NilError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Assert(t, body.IDToken != "", "id_token not found in response")
+
+		token, err := jwt.Decode(body.IDToken)
+		assert.NilError(t, err)
+		assert.NilError(t, token.Verify(cnf.Keystore))
+		return token, body.AccessToken
+	}
+
+	t.Run("code flow should return id token", func(t *testing.T) {
+		browser := NoFollowRedirectClient(srv)
+		browser.Jar, _ = cookiejar.New(nil)
+		sid, err := handlers.NewSession(cnf, "id-token-user")
+		assert.NilError(t, err)
+		location, _ := url.Parse(srv.URL)
+		browser.Jar.SetCookies(location, []*http.Cookie{{Name: "sid", Value: sid}})
+
+		code := obtainCode(t, srv, browser, url.Values{
+			"response_type": {"code"},
+			"client_id":     {TEST_CLIENT_ID},
+			"redirect_uri":  {TEST_REDIRECT_URI},
+			"state":         {"state"},
+			"scope":         {"openid email"},
+			"nonce":         {"n-0S6_WzA2Mj"},
+		})
+
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {TEST_REDIRECT_URI},
+			"client_id":     {TEST_CLIENT_ID},
+			"client_secret": {TEST_CLIENT_SECRET},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		token, accessToken := decodeIDToken(t, resp)
+		claims := token.Body
+
+		assert.Equal(t, claims["iss"], "https://auth.example")
+		assert.Equal(t, claims["sub"], "id-token-user")
+		assert.Equal(t, claims["aud"], TEST_CLIENT_ID)
+		assert.Equal(t, claims["nonce"], "n-0S6_WzA2Mj")
+
+		atHash, _ := jwt.HalfHash(token.Head.Alg, accessToken)
+		assert.Equal(t, claims["at_hash"], atHash)
+		cHash, _ := jwt.HalfHash(token.Head.Alg, code)
+		assert.Equal(t, claims["c_hash"], cHash)
+
+		authTime, err := claims["auth_time"].(json.Number).Int64()
+		assert.NilError(t, err)
+		assert.Check(t, authTime <= time.Now().Unix())
+
+		assert.Equal(t, claims["email"], "id-token@email.com")
+		assert.Equal(t, claims["email_verified"], true)
+
+		_, ok := claims["name"]
+		assert.Check(t, !ok, "profile claims should not be present without the profile scope")
+	})
+
+	t.Run("password grant should return id token", func(t *testing.T) {
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/auth?grant_type=password", url.Values{
+			"username": {"id-token@email.com"},
+			"password": {"test"},
+			"scope":    {"openid profile"},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		token, _ := decodeIDToken(t, resp)
+		claims := token.Body
+
+		assert.Equal(t, claims["aud"], "https://auth.example")
+		assert.Equal(t, claims["name"], "Mario Rossi")
+		assert.Equal(t, claims["given_name"], "Mario")
+		assert.Equal(t, claims["family_name"], "Rossi")
+
+		_, ok := claims["email"]
+		assert.Check(t, !ok, "email claims should not be present without the email scope")
+	})
+
+	t.Run("id token should not be returned without openid scope", func(t *testing.T) {
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/auth?grant_type=password", url.Values{
+			"username": {"id-token@email.com"},
+			"password": {"test"},
+			"scope":    {"profile"},
+		})
+		assert.NilError(t, err)
+
+		var body map[string]interface{}
+		assert.NilError(t, json.NewDecoder(resp.Body).Decode(&body))
+		_, ok := body["id_token"]
+		assert.Check(t, !ok)
+	})
+}
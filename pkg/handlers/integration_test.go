@@ -1,34 +1,136 @@
 package handlers_test
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
 	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"github.com/ale-cci/oauthsrv/pkg/jwt"
+	"github.com/ale-cci/oauthsrv/pkg/passwords"
+	"go.mongodb.org/mongo-driver/bson"
+	"gotest.tools/assert"
 )
 
+const TEST_CLIENT_ID = "code-test-app"
+const TEST_CLIENT_SECRET = "code-test-secret"
+const TEST_REDIRECT_URI = "http://client.example/callback"
+
+// Registers the confidential application used by the authorization code tests
+func initCodeApp(t *testing.T, cnf *handlers.Config) {
+	secret, err := passwords.New(rand.Reader, TEST_CLIENT_SECRET)
+	assert.NilError(t, err)
+
+	_, err = cnf.Database.Collection("apps").InsertOne(context.Background(), bson.D{
+		{Key: "_id", Value: TEST_CLIENT_ID},
+		{Key: "name", Value: "Code Test App"},
+		{Key: "type", Value: "confidential"},
+		{Key: "client_secret", Value: secret},
+		{Key: "redirect_uris", Value: []string{TEST_REDIRECT_URI}},
+	})
+	assert.NilError(t, err)
+	t.Cleanup(deinitApps(cnf))
+}
+
+// Performs the authorization request with an authenticated client,
+// granting the consent and returning the code sent to the redirect uri
+func obtainCode(t *testing.T, srv *httptest.Server, client *http.Client, params url.Values) string {
+	authorizeURL := srv.URL + "/oauth/v2/auth?" + params.Encode()
+	csrfToken := getCSRFToken(t, client, authorizeURL)
+
+	resp, err := client.PostForm(authorizeURL, url.Values{
+		"consent":    {"allow"},
+		"csrf_token": {csrfToken},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusFound)
+
+	redirect, err := resp.Location()
+	assert.NilError(t, err)
+
+	code := redirect.Query().Get("code")
+	assert.Assert(t, code != "", "code not found in redirect uri: %v", redirect)
+	return code
+}
+
 func TestGrantTypeCode(t *testing.T) {
 	cnf, _ := handlers.EnvConfig()
 	srv := NewTestServer(cnf)
 	defer srv.Close()
 
-	client := srv.Client()
+	client := NoFollowRedirectClient(srv)
 	client.Jar, _ = cookiejar.New(nil)
 
-	// TODO: register client application
-	const TEST_CLIENT_SECRET = ""
-	const TEST_CLIENT_ID = ""
+	initCodeApp(t, cnf)
+
+	password, _ := passwords.New(rand.Reader, "password")
+	cnf.Database.Collection("identities").DeleteOne(context.Background(), bson.D{{Key: "_id", Value: "code-flow-user"}})
+	_, err := cnf.Database.Collection("identities").InsertOne(context.Background(), bson.D{
+		{Key: "_id", Value: "code-flow-user"},
+		{Key: "email", Value: "code-flow@email.com"},
+		{Key: "password", Value: password},
+	})
+	assert.NilError(t, err)
 
 	t.Run("should return code token", func(t *testing.T) {
-		q := url.Values{
-			"client_id":     {TEST_CLIENT_ID},
-			"client_secret": {TEST_CLIENT_SECRET},
-		}
-		resp, _ := client.Get(srv.URL + "/oauth/v2/auth?" + q.Encode())
-		resp, _ = client.PostForm(resp.Request.URL.RequestURI(), url.Values{
-			"username": {"test@email.com"},
+		authorizePath := "/oauth/v2/auth?" + url.Values{
+			"grant_type":   {"code"},
+			"client_id":    {TEST_CLIENT_ID},
+			"redirect_uri": {TEST_REDIRECT_URI},
+			"state":        {"xyz"},
+		}.Encode()
+
+		// guest users are redirected to the login page
+		resp, err := client.Get(srv.URL + authorizePath)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusFound)
+
+		loginURL, err := resp.Location()
+		assert.NilError(t, err)
+
+		resp, err = client.PostForm(srv.URL+loginURL.RequestURI(), url.Values{
+			"username": {"code-flow@email.com"},
 			"password": {"password"},
 		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusFound)
+
+		continueURL, err := resp.Location()
+		assert.NilError(t, err)
+		assert.Equal(t, continueURL.RequestURI(), authorizePath)
+
+		code := obtainCode(t, srv, client, continueURL.Query())
+
+		t.Run("code should be exchanged for an access token", func(t *testing.T) {
+			resp, err := client.PostForm(srv.URL+"/oauth/v2/token", url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {code},
+				"redirect_uri":  {TEST_REDIRECT_URI},
+				"client_id":     {TEST_CLIENT_ID},
+				"client_secret": {TEST_CLIENT_SECRET},
+			})
+			assert.NilError(t, err)
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+			assert.Equal(t, resp.Header.Get("cache-control"), "no-store")
+
+			var body struct {
+				AccessToken string `json:"access_token"`
+				TokenType   string `json:"token_type"`
+				ExpiresIn   int64  `json:"expires_in"`
+			}
+			assert.NilError(t, json.NewDecoder(resp.Body).Decode(&body))
+			assert.Equal(t, body.TokenType, "Bearer")
+			assert.Equal(t, body.ExpiresIn, jwt.TokenLifetime)
+
+			token, err := jwt.Decode(body.AccessToken)
+			assert.NilError(t, err)
+			assert.NilError(t, token.Verify(cnf.Keystore))
+			assert.Equal(t, token.Body["sub"], "code-flow-user")
+		})
 	})
 }
@@ -0,0 +1,48 @@
+// Proof Key for Code Exchange
+// https://datatracker.ietf.org/doc/html/rfc7636
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"regexp"
+)
+
+const (
+	codeChallengePlain = "plain"
+	codeChallengeS256  = "S256"
+)
+
+// Both code verifiers and S256 challenges are strings of unreserved characters
+var codeVerifierRegexp = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// Checks the parameters of the authorization request, returns the
+// challenge method to store, defaults to `plain` as defined by the rfc
+func parseCodeChallenge(challenge, method string) (string, bool) {
+	if method == "" {
+		method = codeChallengePlain
+	}
+
+	if method != codeChallengePlain && method != codeChallengeS256 {
+		return "", false
+	}
+
+	return method, codeVerifierRegexp.MatchString(challenge)
+}
+
+// Checks that the verifier provided on the token request matches the
+// challenge sent on the authorization request
+func verifyCodeChallenge(challenge, method, verifier string) bool {
+	if !codeVerifierRegexp.MatchString(verifier) {
+		return false
+	}
+
+	computed := verifier
+	if method == codeChallengeS256 {
+		hash := sha256.Sum256([]byte(verifier))
+		computed = base64.RawURLEncoding.EncodeToString(hash[:])
+	}
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
@@ -0,0 +1,134 @@
+package handlers_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"go.mongodb.org/mongo-driver/bson"
+	"gotest.tools/assert"
+)
+
+// Example values from https://datatracker.ietf.org/doc/html/rfc7636#appendix-B
+const TEST_CODE_VERIFIER = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+const TEST_CODE_CHALLENGE = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+func TestPKCE(t *testing.T) {
+	cnf, _ := handlers.EnvConfig()
+	srv := NewTestServer(cnf)
+	defer srv.Close()
+
+	client := NoFollowRedirectClient(srv)
+	client.Jar, _ = cookiejar.New(nil)
+
+	initCodeApp(t, cnf)
+	_, err := cnf.Database.Collection("apps").InsertOne(context.Background(), bson.D{
+		{Key: "_id", Value: "public-test-app"},
+		{Key: "type", Value: "public"},
+		{Key: "redirect_uris", Value: []string{TEST_REDIRECT_URI}},
+	})
+	assert.NilError(t, err)
+
+	sid, err := handlers.NewSession(cnf, "pkce-test-user")
+	assert.NilError(t, err)
+	location, _ := url.Parse(srv.URL)
+	client.Jar.SetCookies(location, []*http.Cookie{{Name: "sid", Value: sid}})
+
+	authorizeParams := func(clientId, challenge, method string) url.Values {
+		params := url.Values{
+			"grant_type":   {"code"},
+			"client_id":    {clientId},
+			"redirect_uri": {TEST_REDIRECT_URI},
+			"state":        {"state"},
+		}
+		if challenge != "" {
+			params.Set("code_challenge", challenge)
+		}
+		if method != "" {
+			params.Set("code_challenge_method", method)
+		}
+		return params
+	}
+
+	exchange := func(clientId, code, verifier string) *http.Response {
+		form := url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {code},
+			"redirect_uri": {TEST_REDIRECT_URI},
+			"client_id":    {clientId},
+		}
+		if clientId == TEST_CLIENT_ID {
+			form.Set("client_secret", TEST_CLIENT_SECRET)
+		}
+		if verifier != "" {
+			form.Set("code_verifier", verifier)
+		}
+
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/token", form)
+		assert.NilError(t, err)
+		return resp
+	}
+
+	t.Run("invalid authorization requests should be redirected with error", func(t *testing.T) {
+		tt := []struct {
+			TcName string
+			Params url.Values
+		}{
+			{"public clients should provide a code challenge", authorizeParams("public-test-app", "", "")},
+			{"unknown challenge methods should be rejected", authorizeParams("public-test-app", TEST_CODE_CHALLENGE, "S512")},
+			{"too short challenges should be rejected", authorizeParams("public-test-app", "short", "plain")},
+		}
+
+		for i, tc := range tt {
+			t.Run(fmt.Sprintf("[%d] %s", i, tc.TcName), func(t *testing.T) {
+				resp, err := client.Get(srv.URL + "/oauth/v2/auth?" + tc.Params.Encode())
+				assert.NilError(t, err)
+				assert.Equal(t, resp.StatusCode, http.StatusFound)
+
+				redirect, err := resp.Location()
+				assert.NilError(t, err)
+				assert.Equal(t, redirect.Query().Get("error"), "invalid_request")
+			})
+		}
+	})
+
+	t.Run("public clients should exchange the code with a valid S256 verifier", func(t *testing.T) {
+		code := obtainCode(t, srv, client, authorizeParams("public-test-app", TEST_CODE_CHALLENGE, "S256"))
+		resp := exchange("public-test-app", code, TEST_CODE_VERIFIER)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+	})
+
+	t.Run("plain challenges should be compared with the verifier", func(t *testing.T) {
+		code := obtainCode(t, srv, client, authorizeParams("public-test-app", TEST_CODE_VERIFIER, ""))
+		resp := exchange("public-test-app", code, TEST_CODE_VERIFIER)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+	})
+
+	t.Run("wrong verifiers should be rejected", func(t *testing.T) {
+		code := obtainCode(t, srv, client, authorizeParams("public-test-app", TEST_CODE_CHALLENGE, "S256"))
+		resp := exchange("public-test-app", code, TEST_CODE_CHALLENGE)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	})
+
+	t.Run("public clients should not exchange codes without verifier", func(t *testing.T) {
+		code := obtainCode(t, srv, client, authorizeParams("public-test-app", TEST_CODE_CHALLENGE, "S256"))
+		resp := exchange("public-test-app", code, "")
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	})
+
+	t.Run("confidential clients could use pkce", func(t *testing.T) {
+		code := obtainCode(t, srv, client, authorizeParams(TEST_CLIENT_ID, TEST_CODE_CHALLENGE, "S256"))
+		resp := exchange(TEST_CLIENT_ID, code, TEST_CODE_VERIFIER)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		t.Run("verifier is required once challenge is provided", func(t *testing.T) {
+			code := obtainCode(t, srv, client, authorizeParams(TEST_CLIENT_ID, TEST_CODE_CHALLENGE, "S256"))
+			resp := exchange(TEST_CLIENT_ID, code, "")
+			assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		})
+	})
+}
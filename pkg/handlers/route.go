@@ -1,34 +1,119 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/ale-cci/oauthsrv/pkg/jwt"
+	"github.com/ale-cci/oauthsrv/pkg/mux"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type CnfHandlerFunc func(cnf *Config, w http.ResponseWriter, r *http.Request)
 
+// Wraps a handler, with access to the configuration
+type CnfMiddleware func(CnfHandlerFunc) CnfHandlerFunc
+
+/**
+ * Router with method routing, requests with methods not registered
+ * for a path are rejected by the router. Groups share a path prefix
+ * and middlewares.
+ */
 type Router interface {
-	HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+	Handle(method, pattern string, handler http.Handler) *mux.Route
+	Group(prefix string, middlewares ...mux.Middleware) *mux.Router
+	URL(name string, pairs ...string) (string, error)
+}
+
+type route struct {
+	Name     string // used to build the urls of the endpoint, e.g. on the discovery document
+	Methods  []string
+	Endpoint string
+	Handler  CnfHandlerFunc
 }
 
 // Register all handlers to a given router
 func AddRoutes(cnf *Config, router Router) {
-	routes := []struct {
-		Endpoint string
-		Handler  CnfHandlerFunc
+	api := []mux.Middleware{jsonResponse, cnf.middleware(RequireJWT(anyScope))}
+
+	groups := []struct {
+		Prefix      string
+		Middlewares []mux.Middleware
+		Routes      []route
 	}{
-		{"/healthcheck", handleHealthCheck},
-		{"/login", handleLogin},
-		{"/oauth/v2/auth", handleAuth},
-		{"/api/users/(?P<user_id>[\\w-]+)/groups", handleGroups},
+		{"", nil, []route{
+			{"healthcheck", []string{"GET"}, "/healthcheck", handleHealthCheck},
+			{"login", []string{"GET", "POST"}, "/login", handleLogin},
+			{"authorization_endpoint", []string{"GET"}, "/oauth/v2/auth", handleAuthorize},
+			{"authorization_endpoint", []string{"POST"}, "/oauth/v2/auth", handleAuth},
+			{"token_endpoint", []string{"POST"}, "/oauth/v2/token", handleToken},
+			{"jwks_uri", []string{"GET"}, "/.well-known/jwks.json", handleJWKS},
+			{"userinfo_endpoint", []string{"GET", "POST"}, "/userinfo", handleUserinfo},
+			{"openid_configuration", []string{"GET"}, "/.well-known/openid-configuration", handleDiscovery},
+		}},
+		// json endpoints, authenticated with the access token
+		{"/api", api, []route{
+			{"user-groups", []string{"GET"}, "/users/{user_id}/groups", handleGroups},
+		}},
+		{"/api/v1", api, []route{
+			{"users", []string{"GET"}, "/users", handleUsersList},
+			{"users", []string{"POST"}, "/users", handleUsersCreate},
+			{"user", []string{"GET"}, "/users/{user_id}", handleUserGet},
+			{"user", []string{"PATCH"}, "/users/{user_id}", handleUserUpdate},
+			{"user", []string{"DELETE"}, "/users/{user_id}", handleUserDisable},
+		}},
 	}
-	for _, route := range routes {
-		router.HandleFunc(route.Endpoint, cnf.apply(route.Handler))
+
+	// the middlewares of the router, e.g. `LogRequests`, are left to the caller
+	for _, group := range groups {
+		groupRouter := router.Group(group.Prefix, group.Middlewares...)
+
+		for _, route := range group.Routes {
+			for _, method := range route.Methods {
+				groupRouter.Handle(method, route.Endpoint, cnf.apply(route.Handler)).Name(route.Name)
+			}
+		}
 	}
+	cnf.urls = router
+}
+
+/**
+ * Records the status code written by the handler
+ */
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
 
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Logs method, path, status and duration of each request
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+		log.Printf("%s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(start))
+	})
+}
+
+// Responses of the json endpoints
+func jsonResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		next.ServeHTTP(w, r)
+	})
 }
 
 // Healthcheck endpoint, returns 500 in case of problems
@@ -45,7 +130,7 @@ func handleHealthCheck(cnf *Config, w http.ResponseWriter, r *http.Request) {
 /**
  * Middleware for server-side responses. If a user is calling an endpoint and
  * it's not authenticated, it is automatically redirected to the
- * login page.
+ * login page. Sessions of disabled users are not valid anymore.
  */
 func Authorize(handler CnfHandlerFunc) CnfHandlerFunc {
 	return func(cnf *Config, w http.ResponseWriter, r *http.Request) {
@@ -58,20 +143,101 @@ func Authorize(handler CnfHandlerFunc) CnfHandlerFunc {
 
 		isValid := (err != http.ErrNoCookie)
 		if isValid {
-			_, tokenErr := jwt.Decode(sid.Value)
-			isValid = tokenErr == nil
+			session, tokenErr := jwt.Decode(sid.Value)
+			isValid = tokenErr == nil && session.Verify(cnf.Keystore) == nil
+
+			sub := ""
+			if isValid {
+				sub, _ = session.Body["sub"].(string)
+				isValid = sub != "" && hasTokenUse(session.Body, sessionTokenUse)
+			}
 
+			if isValid {
+				disabled, err := isDisabled(r.Context(), cnf, sub)
+				if err != nil {
+					log.Printf("Unable to check session user: %v", err)
+					http.Error(w, "unable to check session", http.StatusInternalServerError)
+					return
+				}
+				isValid = !disabled
+			}
 		}
 
 		if !isValid {
-			continueTo := url.QueryEscape(r.RequestURI)
-			http.Redirect(w, r, "/login?continue="+continueTo, http.StatusFound)
+			loginURL, err := cnf.url("login")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			query := url.Values{"continue": {r.RequestURI}}
+			http.Redirect(w, r, loginURL+"?"+query.Encode(), http.StatusFound)
 		} else {
 			handler(cnf, w, r)
 		}
 	}
 }
 
+// Reports if the user was disabled, users not registered are not
+func isDisabled(ctx context.Context, cnf *Config, uid string) (bool, error) {
+	identity, err := FindIdentity(ctx, cnf, uid)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return identity.Disabled, nil
+}
+
+/**
+ * Returns the claims of the session cookie set on login.
+ * The session is not verified, handlers wrapped by `Authorize`
+ * can assume it's valid.
+ */
+func getSession(r *http.Request) (jwt.JWTBody, error) {
+	sid, err := r.Cookie("sid")
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := jwt.Decode(sid.Value)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode session: %v", err)
+	}
+	return session.Body, nil
+}
+
+/**
+ * Time of the user authentication, when the session was issued.
+ * Defaults to the current time if not found.
+ */
+func sessionAuthTime(session jwt.JWTBody) time.Time {
+	if iat, ok := session["iat"].(json.Number); ok {
+		if value, err := iat.Int64(); err == nil {
+			return time.Unix(value, 0)
+		}
+	}
+	return time.Now()
+}
+
+/**
+ * Returns the access token of the request, sent in the authorization header
+ * or, as described in https://datatracker.ietf.org/doc/html/rfc6750#section-2.2
+ * in the body of form-encoded POST requests.
+ */
+func bearerToken(r *http.Request) string {
+	var encodedJWT string
+	if _, err := fmt.Sscanf(r.Header.Get("authorization"), "Bearer %s", &encodedJWT); err == nil {
+		return encodedJWT
+	}
+
+	if r.Method == "POST" && strings.HasPrefix(r.Header.Get("content-type"), "application/x-www-form-urlencoded") {
+		return r.PostFormValue("access_token")
+	}
+	return ""
+}
+
 /**
  * Middleware that checks jwt validity before invoking an endpoint.
  * According to https://datatracker.ietf.org/doc/html/rfc6750#section-3.1
@@ -80,11 +246,9 @@ func Authorize(handler CnfHandlerFunc) CnfHandlerFunc {
  */
 func CheckJWT(handler CnfHandlerFunc, scopeChecker func(jwt.JWTBody) error) CnfHandlerFunc {
 	return func(cnf *Config, w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("authorization")
-		var encodedJWT string
-		_, err := fmt.Sscanf(auth, "Bearer %s", &encodedJWT)
+		encodedJWT := bearerToken(r)
 
-		if err != nil {
+		if encodedJWT == "" {
 			// JWT not provided
 			w.Header().Set("www-authenticate", "Bearer error=\"invalid_request\"")
 			w.WriteHeader(http.StatusBadRequest)
@@ -92,9 +256,9 @@ func CheckJWT(handler CnfHandlerFunc, scopeChecker func(jwt.JWTBody) error) CnfH
 		}
 
 		decodedJWT, err := jwt.Decode(encodedJWT)
-		if err != nil || decodedJWT.Verify(cnf.Keystore) != nil {
-			// the provided jwt doesn't rispect the jwt format or it's
-			// not verifiable.
+		if err != nil || decodedJWT.Verify(cnf.Keystore) != nil || !hasTokenUse(decodedJWT.Body, accessTokenUse) {
+			// the provided jwt doesn't rispect the jwt format, it's
+			// not verifiable or it's not an access token.
 			w.Header().Set("www-authenticate", "Bearer error=\"invalid_token\"")
 			w.WriteHeader(http.StatusUnauthorized)
 			return
@@ -109,3 +273,18 @@ func CheckJWT(handler CnfHandlerFunc, scopeChecker func(jwt.JWTBody) error) CnfH
 		}
 	}
 }
+
+/**
+ * Middleware version of `CheckJWT`, to share the jwt validation among
+ * a group of routes
+ */
+func RequireJWT(scopeChecker func(jwt.JWTBody) error) CnfMiddleware {
+	return func(handler CnfHandlerFunc) CnfHandlerFunc {
+		return CheckJWT(handler, scopeChecker)
+	}
+}
+
+// Accepts tokens with any scope
+func anyScope(_ jwt.JWTBody) error {
+	return nil
+}
@@ -7,20 +7,21 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
 	"github.com/ale-cci/oauthsrv/pkg/handlers"
 	"github.com/ale-cci/oauthsrv/pkg/jwt"
+	"github.com/ale-cci/oauthsrv/pkg/mux"
+	"github.com/ale-cci/oauthsrv/pkg/server"
 	"gotest.tools/assert"
 )
 
 func TestHealthcheck(t *testing.T) {
 	t.Run("/healthcheck should respond with 200", func(t *testing.T) {
-		router := http.NewServeMux()
 		cnf, _ := handlers.EnvConfig()
-		handlers.AddRoutes(cnf, router)
-		srv := httptest.NewServer(router)
+		srv := httptest.NewServer(server.New(cnf))
 		defer srv.Close()
 
 		resp, err := srv.Client().Get(srv.URL + "/healthcheck")
@@ -36,10 +37,8 @@ func TestHealthcheck(t *testing.T) {
 	})
 
 	t.Run("/healthcheck should return 500 if database connection is not valid", func(t *testing.T) {
-		router := http.NewServeMux()
 		cnf, _ := handlers.EnvConfig()
-		handlers.AddRoutes(cnf, router)
-		srv := httptest.NewServer(router)
+		srv := httptest.NewServer(server.New(cnf))
 		defer srv.Close()
 
 		cnf.Database.Client().Disconnect(context.TODO())
@@ -57,10 +56,8 @@ func TestHealthcheck(t *testing.T) {
 }
 
 func TestRoutedFunctions(t *testing.T) {
-	router := http.NewServeMux()
 	cnf, _ := handlers.EnvConfig()
-	handlers.AddRoutes(cnf, router)
-	srv := httptest.NewServer(router)
+	srv := httptest.NewServer(server.New(cnf))
 	defer srv.Close()
 
 	client := srv.Client()
@@ -93,8 +90,23 @@ func TestRoutedFunctions(t *testing.T) {
 		})
 	}
 }
+
+func TestApiRoutes(t *testing.T) {
+	cnf, _ := handlers.EnvConfig()
+	srv := httptest.NewServer(server.New(cnf))
+	defer srv.Close()
+
+	t.Run("api routes should require an access token", func(t *testing.T) {
+		resp, err := srv.Client().Get(srv.URL + "/api/users/someone/groups")
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+		assert.Equal(t, resp.Header.Get("content-type"), "application/json")
+		assert.Equal(t, resp.Header.Get("www-authenticate"), "Bearer error=\"invalid_request\"")
+	})
+}
+
 func TestTokenAuthorize(t *testing.T) {
-	router := http.NewServeMux()
+	router := mux.NewServeMux()
 	cnf, _ := handlers.EnvConfig()
 
 	scopeChecker := func(jwtBody jwt.JWTBody) error {
@@ -153,7 +165,7 @@ func TestTokenAuthorize(t *testing.T) {
 		req, err := http.NewRequest("POST", srv.URL+"/test", nil)
 		assert.NilError(t, err)
 
-		encodedJWT, err := jwt.NewJWT(cnf.Keystore, jwt.JWTBody{
+		encodedJWT, err := handlers.NewAccessToken(cnf, jwt.JWTBody{
 			"custom_field": true,
 		})
 		assert.NilError(t, err)
@@ -167,11 +179,43 @@ func TestTokenAuthorize(t *testing.T) {
 		assert.Check(t, string(body) == "ok!")
 	})
 
+	t.Run("token could be sent in the form-encoded body", func(t *testing.T) {
+		encodedJWT, err := handlers.NewAccessToken(cnf, jwt.JWTBody{
+			"custom_field": true,
+		})
+		assert.NilError(t, err)
+
+		resp, err := client.PostForm(srv.URL+"/test", url.Values{"access_token": {encodedJWT}})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+	})
+
+	t.Run("should return 401 if token is not an access token", func(t *testing.T) {
+		session, err := handlers.NewSession(cnf, "some-user")
+		assert.NilError(t, err)
+		idToken, err := jwt.NewJWT(cnf.Keystore, jwt.JWTBody{
+			"custom_field": true,
+			"token_use":    "id",
+		})
+		assert.NilError(t, err)
+
+		for _, encodedJWT := range []string{session, idToken} {
+			req, err := http.NewRequest("POST", srv.URL+"/test", nil)
+			assert.NilError(t, err)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", encodedJWT))
+
+			resp, err := client.Do(req)
+			assert.NilError(t, err)
+			assert.Equal(t, resp.StatusCode, http.StatusUnauthorized)
+			assert.Equal(t, resp.Header.Get("www-authenticate"), "Bearer error=\"invalid_token\"")
+		}
+	})
+
 	t.Run("should return 403 without calling the handler if scopeChecker returns an error", func(t *testing.T) {
 		req, err := http.NewRequest("POST", srv.URL+"/test", nil)
 		assert.NilError(t, err)
 
-		encodedJWT, err := jwt.NewJWT(cnf.Keystore, jwt.JWTBody{})
+		encodedJWT, err := handlers.NewAccessToken(cnf, jwt.JWTBody{})
 		assert.NilError(t, err)
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", encodedJWT))
 
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ale-cci/oauthsrv/pkg/scopes"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Scopes handled by the server itself, not stored in the `scopes` collection
+var standardScopes = []string{"openid", "profile", "email", "address"}
+
+// Loads the scope definitions from the `scopes` collection
+func loadScopes(ctx context.Context, cnf *Config) ([]scopes.Scope, error) {
+	cursor, err := cnf.Database.Collection("scopes").Find(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch scopes: %v", err)
+	}
+
+	var stored []struct {
+		Pattern string   `bson:"pattern"`
+		Groups  []string `bson:"groups"`
+		Grant   bson.Raw `bson:"grant"`
+	}
+	if err := cursor.All(ctx, &stored); err != nil {
+		return nil, fmt.Errorf("Unable to decode scopes: %v", err)
+	}
+
+	definitions := make([]scopes.Scope, 0, len(stored))
+	for _, scope := range stored {
+		definition := scopes.Scope{
+			Pattern: scope.Pattern,
+			Groups:  scope.Groups,
+			Grant:   map[string]interface{}{},
+		}
+
+		// grants are converted to plain json values, the same
+		// types of the decoded jwt claims
+		if len(scope.Grant) > 0 {
+			extJSON, err := bson.MarshalExtJSON(scope.Grant, false, false)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid grant for scope %q: %v", scope.Pattern, err)
+			}
+			if err := json.Unmarshal(extJSON, &definition.Grant); err != nil {
+				return nil, fmt.Errorf("Invalid grant for scope %q: %v", scope.Pattern, err)
+			}
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, nil
+}
+
+/**
+ * Evaluates the scopes requested for the grant. Standard scopes are always
+ * granted, the others only when they match a scope definition.
+ * Groups are the ones of the identity, clients do not belong to any group.
+ */
+func grantScopes(ctx context.Context, cnf *Config, grant tokenGrant) (*scopes.Grant, error) {
+	definitions, err := loadScopes(ctx, cnf)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	if !grant.Client {
+		identity, err := FindIdentity(ctx, cnf, grant.Sub)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+		if identity != nil {
+			groups = identity.Groups
+		}
+	}
+
+	result := scopes.Evaluate(definitions, grant.Scope, groups)
+
+	granted := []string{}
+	for _, name := range splitScope(grant.Scope) {
+		if contains(standardScopes, name) && !contains(granted, name) {
+			granted = append(granted, name)
+		}
+	}
+	result.Scopes = append(granted, result.Scopes...)
+	return result, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
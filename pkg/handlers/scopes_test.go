@@ -0,0 +1,130 @@
+package handlers_test
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"github.com/ale-cci/oauthsrv/pkg/jwt"
+	"github.com/ale-cci/oauthsrv/pkg/passwords"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gotest.tools/assert"
+)
+
+func TestScopeGrants(t *testing.T) {
+	cnf, _ := handlers.EnvConfig()
+	srv := NewTestServer(cnf)
+	defer srv.Close()
+
+	client := srv.Client()
+
+	_, err := cnf.Database.Collection("scopes").InsertMany(context.Background(), []interface{}{
+		bson.D{
+			{Key: "pattern", Value: "repository:(.*):(.*)"},
+			{Key: "grant", Value: bson.D{
+				{Key: "access", Value: bson.A{
+					bson.D{
+						{Key: "type", Value: "repository"},
+						{Key: "name", Value: "\\1"},
+						{Key: "actions", Value: bson.A{"\\2"}},
+					},
+				}},
+			}},
+		},
+		bson.D{
+			{Key: "pattern", Value: "metrics:write"},
+			{Key: "groups", Value: bson.A{"admin"}},
+			{Key: "grant", Value: bson.D{{Key: "metrics", Value: "write"}}},
+		},
+	})
+	assert.NilError(t, err)
+	t.Cleanup(func() {
+		cnf.Database.Collection("scopes").Drop(context.Background())
+	})
+
+	password, _ := passwords.New(rand.Reader, "test")
+	_, err = cnf.Database.Collection("identities").UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: "scope-user"}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "email", Value: "scope-user@email.com"},
+			{Key: "password", Value: password},
+			{Key: "groups", Value: bson.A{"users"}},
+		}}},
+		options.Update().SetUpsert(true),
+	)
+	assert.NilError(t, err)
+
+	login := func(t *testing.T, scope string) *jwt.JWT {
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/auth?grant_type=password", url.Values{
+			"username": {"scope-user@email.com"},
+			"password": {"test"},
+			"scope":    {scope},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		token, err := jwt.Decode(decodeTokenResponse(t, resp).AccessToken)
+		assert.NilError(t, err)
+		return token
+	}
+
+	t.Run("grant should be added to the access token", func(t *testing.T) {
+		token := login(t, "openid repository:samalba/my-app:pull")
+
+		assert.Equal(t, token.Body["scope"], "openid repository:samalba/my-app:pull")
+		assert.DeepEqual(t, token.Body["access"], []interface{}{
+			map[string]interface{}{
+				"type":    "repository",
+				"name":    "samalba/my-app",
+				"actions": []interface{}{"pull"},
+			},
+		})
+	})
+
+	t.Run("scopes restricted to other groups should not be granted", func(t *testing.T) {
+		token := login(t, "metrics:write")
+
+		_, ok := token.Body["metrics"]
+		assert.Check(t, !ok)
+		_, ok = token.Body["scope"]
+		assert.Check(t, !ok)
+	})
+
+	t.Run("scopes should be evaluated with the user groups", func(t *testing.T) {
+		_, err := cnf.Database.Collection("identities").UpdateOne(
+			context.Background(),
+			bson.D{{Key: "_id", Value: "scope-user"}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "groups", Value: bson.A{"admin"}}}}},
+		)
+		assert.NilError(t, err)
+
+		token := login(t, "metrics:write")
+		assert.Equal(t, token.Body["metrics"], "write")
+		assert.Equal(t, token.Body["scope"], "metrics:write")
+	})
+
+	t.Run("client credentials should receive the scope grants", func(t *testing.T) {
+		assert.NilError(t, initApps(cnf))
+		t.Cleanup(deinitApps(cnf))
+
+		resp, err := client.PostForm(srv.URL+"/oauth/v2/auth?grant_type=client_credentials", url.Values{
+			"client_id":     {"client-id"},
+			"client_secret": {"client-secret"},
+			"scope":         {"repository:ci:push metrics:write"},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+		token, err := jwt.Decode(decodeTokenResponse(t, resp).AccessToken)
+		assert.NilError(t, err)
+		assert.Equal(t, token.Body["scope"], "repository:ci:push")
+
+		_, ok := token.Body["metrics"]
+		assert.Check(t, !ok, "clients should not be granted scopes restricted to groups")
+	})
+}
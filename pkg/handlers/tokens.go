@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ale-cci/oauthsrv/pkg/jwt"
+)
+
+// Generates a random opaque token, base64-urlencoded
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Opaque tokens are stored hashed, so a database dump does not
+// leak usable credentials
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func splitScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+func hasScope(scope, name string) bool {
+	for _, value := range splitScope(scope) {
+		if value == name {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Tokens signed by the server carry their use in the `token_use` claim,
+ * so that id tokens and sessions could not be presented as access
+ * tokens, or the other way around.
+ */
+const tokenUseClaim = "token_use"
+
+const (
+	accessTokenUse  = "access"
+	idTokenUse      = "id"
+	sessionTokenUse = "session"
+)
+
+// Reports if the token was issued for the given use
+func hasTokenUse(claims jwt.JWTBody, use string) bool {
+	value, _ := claims[tokenUseClaim].(string)
+	return value == use
+}
+
+/**
+ * Signs an access token with the given claims, accepted by `CheckJWT`
+ */
+func NewAccessToken(cnf *Config, claims jwt.JWTBody) (string, error) {
+	claims[tokenUseClaim] = accessTokenUse
+	return cnf.signJWT(claims)
+}
+
+/**
+ * Signs the session of the user, stored in the `sid` cookie and
+ * accepted by `Authorize`
+ */
+func NewSession(cnf *Config, sub string) (string, error) {
+	return cnf.signJWT(jwt.JWTBody{
+		"sub":         sub,
+		tokenUseClaim: sessionTokenUse,
+	})
+}
+
+/**
+ * Successful response of the token endpoint
+ * https://datatracker.ietf.org/doc/html/rfc6749#section-5.1
+ */
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// Authorization granted to a subject, from which tokens are issued
+type tokenGrant struct {
+	Sub      string
+	ClientId string
+	Scope    string // requested scope
+
+	// the subject is the client itself, as in client credentials grant
+	Client bool
+
+	// refresh token family, empty for new authorizations
+	Family string
+
+	// time of the user authentication
+	AuthTime time.Time
+	// openid connect parameters of the authorization request
+	Nonce string
+	Code  string
+}
+
+/**
+ * Issues an access token containing the claims granted by the requested
+ * scopes, along with the `scope` claim listing the granted scopes.
+ */
+func issueAccessToken(r *http.Request, cnf *Config, grant tokenGrant) (*tokenResponse, error) {
+	granted, err := grantScopes(r.Context(), cnf, grant)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.JWTBody(granted.Claims)
+	claims["sub"] = grant.Sub
+
+	scope := strings.Join(granted.Scopes, " ")
+	if scope != "" {
+		claims["scope"] = scope
+	}
+
+	accessToken, err := NewAccessToken(cnf, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   jwt.TokenLifetime,
+		Scope:       scope,
+	}, nil
+}
+
+/**
+ * Issues a new access token, along with a refresh token that could be used to
+ * renew it once expired.
+ * When the `openid` scope is granted an id token is issued too.
+ */
+func issueTokens(r *http.Request, cnf *Config, grant tokenGrant) (*tokenResponse, error) {
+	response, err := issueAccessToken(r, cnf, grant)
+	if err != nil {
+		return nil, err
+	}
+
+	response.RefreshToken, err = issueRefreshToken(r.Context(), cnf, grant)
+	if err != nil {
+		return nil, err
+	}
+
+	if hasScope(grant.Scope, "openid") {
+		response.IDToken, err = issueIDToken(r, cnf, grant, response.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+/**
+ * Writes a successful token response.
+ * According to https://datatracker.ietf.org/doc/html/rfc6749#section-5.1
+ * responses containing tokens should never be cached.
+ */
+func writeTokenResponse(w http.ResponseWriter, body *tokenResponse) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	w.Header().Set("pragma", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(body)
+}
+
+/**
+ * Writes an error response as described in
+ * https://datatracker.ietf.org/doc/html/rfc6749#section-5.2
+ */
+func writeTokenError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	w.Header().Set("pragma", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
@@ -0,0 +1,115 @@
+/**
+ * JSON Web Keys, as described in https://datatracker.ietf.org/doc/html/rfc7517
+ * Used to publish the public keys of the keystore, so tokens could be
+ * verified outside of the application.
+ */
+package jwk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+type Key struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+
+	// RSA parameters
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP parameters
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type Set struct {
+	Keys []*Key `json:"keys"`
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Encodes the integer in the minimum amount of bytes, big endian
+func encodeInt(value *big.Int) string {
+	return encode(value.Bytes())
+}
+
+// Encodes the coordinate padded to the curve size
+func encodeCoordinate(value *big.Int, size int) string {
+	buf := make([]byte, size)
+	value.FillBytes(buf)
+	return encode(buf)
+}
+
+/**
+ * Converts a public key to its JWK representation, the key
+ * is marked to be used for signature verification.
+ */
+func FromPublicKey(kid, alg string, key crypto.PublicKey) (*Key, error) {
+	jwk := &Key{
+		Kid: kid,
+		Alg: alg,
+		Use: "sig",
+	}
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeInt(pub.N)
+		jwk.E = encodeInt(big.NewInt(int64(pub.E)))
+
+	case *ecdsa.PublicKey:
+		params := pub.Curve.Params()
+		size := (params.BitSize + 7) / 8
+
+		jwk.Kty = "EC"
+		jwk.Crv = params.Name
+		jwk.X = encodeCoordinate(pub.X, size)
+		jwk.Y = encodeCoordinate(pub.Y, size)
+
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encode(pub)
+
+	default:
+		return nil, fmt.Errorf("Unsupported key type %T", key)
+	}
+	return jwk, nil
+}
+
+/**
+ * JWK thumbprint of the public key, as described in
+ * https://datatracker.ietf.org/doc/html/rfc7638
+ * the hash of the required members, in lexicographic order.
+ */
+func Thumbprint(key crypto.PublicKey) (string, error) {
+	jwk, err := FromPublicKey("", "", key)
+	if err != nil {
+		return "", err
+	}
+
+	var members string
+	switch jwk.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, jwk.E, jwk.Kty, jwk.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, jwk.Crv, jwk.Kty, jwk.X)
+	}
+
+	hash := sha256.Sum256([]byte(members))
+	return encode(hash[:]), nil
+}
@@ -0,0 +1,123 @@
+package jwk_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/jwk"
+	"gotest.tools/assert"
+)
+
+func decodeInt(t *testing.T, value string) *big.Int {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	assert.NilError(t, err)
+	return new(big.Int).SetBytes(decoded)
+}
+
+func TestFromPublicKey(t *testing.T) {
+	t.Run("rsa keys should be encoded with modulus and exponent", func(t *testing.T) {
+		// https://datatracker.ietf.org/doc/html/rfc7517#appendix-A.1
+		n := "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw"
+		key := &rsa.PublicKey{N: decodeInt(t, n), E: 65537}
+
+		got, err := jwk.FromPublicKey("2011-04-29", "RS256", key)
+		assert.NilError(t, err)
+
+		assert.DeepEqual(t, got, &jwk.Key{
+			Kty: "RSA",
+			Kid: "2011-04-29",
+			Alg: "RS256",
+			Use: "sig",
+			N:   n,
+			E:   "AQAB",
+		})
+	})
+
+	t.Run("ec keys should be encoded with curve and coordinates", func(t *testing.T) {
+		// https://datatracker.ietf.org/doc/html/rfc7517#appendix-A.1
+		x := "MKBCTNIcKUSDii11ySs3526iDZ8AiTo7Tu6KPAqv7D4"
+		y := "4Etl6SRW2YiLUrN5vfvVHuhp7x8PxltmWWlbbM4IFyM"
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: decodeInt(t, x), Y: decodeInt(t, y)}
+
+		got, err := jwk.FromPublicKey("1", "ES256", key)
+		assert.NilError(t, err)
+
+		assert.DeepEqual(t, got, &jwk.Key{
+			Kty: "EC",
+			Kid: "1",
+			Alg: "ES256",
+			Use: "sig",
+			Crv: "P-256",
+			X:   x,
+			Y:   y,
+		})
+	})
+
+	t.Run("ec coordinates should be padded to the curve size", func(t *testing.T) {
+		key := &ecdsa.PublicKey{Curve: elliptic.P521(), X: big.NewInt(1), Y: big.NewInt(2)}
+
+		got, err := jwk.FromPublicKey("small", "ES512", key)
+		assert.NilError(t, err)
+		assert.Equal(t, got.Crv, "P-521")
+
+		x, err := base64.RawURLEncoding.DecodeString(got.X)
+		assert.NilError(t, err)
+		assert.Equal(t, len(x), 66)
+	})
+
+	t.Run("ed25519 keys should be encoded as octet key pairs", func(t *testing.T) {
+		// https://datatracker.ietf.org/doc/html/rfc8037#appendix-A.2
+		x := "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"
+		pub, err := base64.RawURLEncoding.DecodeString(x)
+		assert.NilError(t, err)
+
+		got, err := jwk.FromPublicKey("ed", "EdDSA", ed25519.PublicKey(pub))
+		assert.NilError(t, err)
+
+		assert.DeepEqual(t, got, &jwk.Key{
+			Kty: "OKP",
+			Kid: "ed",
+			Alg: "EdDSA",
+			Use: "sig",
+			Crv: "Ed25519",
+			X:   x,
+		})
+	})
+
+	t.Run("unsupported keys should return error", func(t *testing.T) {
+		_, err := jwk.FromPublicKey("secret", "HS256", []byte("secret"))
+		assert.Check(t, err != nil)
+	})
+}
+
+func TestThumbprint(t *testing.T) {
+	t.Run("rsa thumbprint should match rfc7638 example", func(t *testing.T) {
+		// https://datatracker.ietf.org/doc/html/rfc7638#section-3.1
+		n := "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw"
+		key := &rsa.PublicKey{N: decodeInt(t, n), E: 65537}
+
+		thumbprint, err := jwk.Thumbprint(key)
+		assert.NilError(t, err)
+		assert.Equal(t, thumbprint, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs")
+	})
+
+	t.Run("ed25519 thumbprint should match rfc8037 example", func(t *testing.T) {
+		// https://datatracker.ietf.org/doc/html/rfc8037#appendix-A.3
+		pub, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+		assert.NilError(t, err)
+
+		thumbprint, err := jwk.Thumbprint(ed25519.PublicKey(pub))
+		assert.NilError(t, err)
+		assert.Equal(t, thumbprint, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k")
+	})
+
+	t.Run("unsupported keys should return error", func(t *testing.T) {
+		_, err := jwk.Thumbprint([]byte("secret"))
+		assert.Check(t, err != nil)
+	})
+}
@@ -0,0 +1,282 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+
+	"github.com/ale-cci/oauthsrv/pkg/keystore"
+)
+
+// Signing algorithm, as defined in https://datatracker.ietf.org/doc/html/rfc7518#section-3
+type algorithm interface {
+	// hash function used to digest the signing input
+	hash() crypto.Hash
+
+	sign(ks keystore.PrivateKeystore, head *JWTHead, payload []byte) ([]byte, error)
+	verify(ks keystore.PublicKeystore, head *JWTHead, payload, signature []byte) error
+}
+
+var algorithms = map[string]algorithm{
+	"HS256": hmacAlgorithm{crypto.SHA256},
+	"HS384": hmacAlgorithm{crypto.SHA384},
+	"HS512": hmacAlgorithm{crypto.SHA512},
+	"RS256": rsaAlgorithm{crypto.SHA256},
+	"ES256": ecdsaAlgorithm{crypto.SHA256, elliptic.P256()},
+	"ES384": ecdsaAlgorithm{crypto.SHA384, elliptic.P384()},
+	"ES512": ecdsaAlgorithm{crypto.SHA512, elliptic.P521()},
+	"EdDSA": eddsaAlgorithm{},
+}
+
+func digest(hash crypto.Hash, payload []byte) []byte {
+	hasher := hash.New()
+	hasher.Write(payload)
+	return hasher.Sum(nil)
+}
+
+/**
+ * Left-most half of the hash of value, base64url encoded, computed with the
+ * hash function of the signing algorithm. Used for the `at_hash` and `c_hash`
+ * claims, https://openid.net/specs/openid-connect-core-1_0.html#CodeIDToken
+ */
+func HalfHash(alg, value string) (string, error) {
+	algorithm, ok := algorithms[alg]
+	if !ok {
+		return "", fmt.Errorf("Unsupported signing algorithm %q", alg)
+	}
+
+	sum := digest(algorithm.hash(), []byte(value))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
+
+/**
+ * HMAC with SHA-2, https://datatracker.ietf.org/doc/html/rfc7518#section-3.2
+ * Keys are retrieved from a `keystore.SecretKeystore`, and are bound
+ * to a single algorithm.
+ */
+type hmacAlgorithm struct {
+	hashFunc crypto.Hash
+}
+
+func (alg hmacAlgorithm) hash() crypto.Hash {
+	return alg.hashFunc
+}
+
+func (alg hmacAlgorithm) key(ks interface{}, head *JWTHead) ([]byte, error) {
+	secrets, ok := ks.(keystore.SecretKeystore)
+	if !ok {
+		return nil, fmt.Errorf("Keystore does not support %s", head.Alg)
+	}
+
+	keyInfo, err := secrets.SecretKey(head.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyInfo.Alg != head.Alg {
+		return nil, fmt.Errorf("Key %q could not be used with %s", head.Kid, head.Alg)
+	}
+	return keyInfo.Key, nil
+}
+
+func (alg hmacAlgorithm) sign(ks keystore.PrivateKeystore, head *JWTHead, payload []byte) ([]byte, error) {
+	key, err := alg.key(ks, head)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(alg.hashFunc.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil), nil
+}
+
+func (alg hmacAlgorithm) verify(ks keystore.PublicKeystore, head *JWTHead, payload, signature []byte) error {
+	key, err := alg.key(ks, head)
+	if err != nil {
+		return fmt.Errorf("Unable to verify jwt: %v", err)
+	}
+
+	mac := hmac.New(alg.hashFunc.New, key)
+	mac.Write(payload)
+
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return fmt.Errorf("Invalid signature")
+	}
+	return nil
+}
+
+/**
+ * RSASSA-PKCS1-v1_5, https://datatracker.ietf.org/doc/html/rfc7518#section-3.3
+ */
+type rsaAlgorithm struct {
+	hashFunc crypto.Hash
+}
+
+func (alg rsaAlgorithm) hash() crypto.Hash {
+	return alg.hashFunc
+}
+
+func (alg rsaAlgorithm) sign(ks keystore.PrivateKeystore, head *JWTHead, payload []byte) ([]byte, error) {
+	signer, err := ks.PrivateKey(head.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("Key %q could not be used with %s", head.Kid, head.Alg)
+	}
+
+	signature, err := signer.Sign(rand.Reader, digest(alg.hashFunc, payload), alg.hashFunc)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to sign jwt: %v", err)
+	}
+	return signature, nil
+}
+
+func (alg rsaAlgorithm) verify(ks keystore.PublicKeystore, head *JWTHead, payload, signature []byte) error {
+	key, err := ks.PublicKey(head.Kid)
+	if err != nil {
+		return fmt.Errorf("Unable to verify jwt: %v", err)
+	}
+
+	pubKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("Key %q could not be used with %s", head.Kid, head.Alg)
+	}
+
+	return rsa.VerifyPKCS1v15(pubKey, alg.hashFunc, digest(alg.hashFunc, payload), signature)
+}
+
+/**
+ * ECDSA, https://datatracker.ietf.org/doc/html/rfc7518#section-3.4
+ * Signatures are the concatenation of R and S, each one padded
+ * to the curve size.
+ */
+type ecdsaAlgorithm struct {
+	hashFunc crypto.Hash
+	curve    elliptic.Curve
+}
+
+func (alg ecdsaAlgorithm) hash() crypto.Hash {
+	return alg.hashFunc
+}
+
+func (alg ecdsaAlgorithm) keySize() int {
+	return (alg.curve.Params().BitSize + 7) / 8
+}
+
+func (alg ecdsaAlgorithm) checkKey(key crypto.PublicKey, head *JWTHead) (*ecdsa.PublicKey, error) {
+	pubKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || pubKey.Curve != alg.curve {
+		return nil, fmt.Errorf("Key %q could not be used with %s", head.Kid, head.Alg)
+	}
+	return pubKey, nil
+}
+
+func (alg ecdsaAlgorithm) sign(ks keystore.PrivateKeystore, head *JWTHead, payload []byte) ([]byte, error) {
+	signer, err := ks.PrivateKey(head.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := alg.checkKey(signer.Public(), head); err != nil {
+		return nil, err
+	}
+
+	der, err := signer.Sign(rand.Reader, digest(alg.hashFunc, payload), alg.hashFunc)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to sign jwt: %v", err)
+	}
+
+	// crypto.Signer returns ASN.1 encoded signatures
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("Unable to decode ecdsa signature: %v", err)
+	}
+
+	size := alg.keySize()
+	signature := make([]byte, 2*size)
+	sig.R.FillBytes(signature[:size])
+	sig.S.FillBytes(signature[size:])
+	return signature, nil
+}
+
+func (alg ecdsaAlgorithm) verify(ks keystore.PublicKeystore, head *JWTHead, payload, signature []byte) error {
+	key, err := ks.PublicKey(head.Kid)
+	if err != nil {
+		return fmt.Errorf("Unable to verify jwt: %v", err)
+	}
+
+	pubKey, err := alg.checkKey(key, head)
+	if err != nil {
+		return err
+	}
+
+	size := alg.keySize()
+	if len(signature) != 2*size {
+		return fmt.Errorf("Invalid signature length")
+	}
+
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+
+	if !ecdsa.Verify(pubKey, digest(alg.hashFunc, payload), r, s) {
+		return fmt.Errorf("Invalid signature")
+	}
+	return nil
+}
+
+/**
+ * EdDSA with Ed25519 keys, https://datatracker.ietf.org/doc/html/rfc8037#section-3.1
+ */
+type eddsaAlgorithm struct{}
+
+// ed25519 does not pre-hash, SHA-512 is used internally
+func (alg eddsaAlgorithm) hash() crypto.Hash {
+	return crypto.SHA512
+}
+
+func (alg eddsaAlgorithm) sign(ks keystore.PrivateKeystore, head *JWTHead, payload []byte) ([]byte, error) {
+	signer, err := ks.PrivateKey(head.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := signer.Public().(ed25519.PublicKey); !ok {
+		return nil, fmt.Errorf("Key %q could not be used with %s", head.Kid, head.Alg)
+	}
+
+	// ed25519 signs the whole message, without pre-hashing
+	signature, err := signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to sign jwt: %v", err)
+	}
+	return signature, nil
+}
+
+func (alg eddsaAlgorithm) verify(ks keystore.PublicKeystore, head *JWTHead, payload, signature []byte) error {
+	key, err := ks.PublicKey(head.Kid)
+	if err != nil {
+		return fmt.Errorf("Unable to verify jwt: %v", err)
+	}
+
+	pubKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("Key %q could not be used with %s", head.Kid, head.Alg)
+	}
+
+	if !ed25519.Verify(pubKey, payload, signature) {
+		return fmt.Errorf("Invalid signature")
+	}
+	return nil
+}
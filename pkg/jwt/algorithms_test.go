@@ -0,0 +1,157 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// Keystore holding a single, fixed key
+type vectorKeystore struct {
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+func (vks vectorKeystore) PrivateKey(kid string) (crypto.Signer, error) {
+	if vks.private == nil {
+		return nil, fmt.Errorf("key not found")
+	}
+	return vks.private, nil
+}
+
+func (vks vectorKeystore) PublicKey(kid string) (crypto.PublicKey, error) {
+	return vks.public, nil
+}
+
+func decodeB64(t *testing.T, value string) []byte {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	assert.NilError(t, err)
+	return decoded
+}
+
+func ecdsaKey(t *testing.T, curve elliptic.Curve, x, y, d string) *ecdsa.PrivateKey {
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(decodeB64(t, x)),
+			Y:     new(big.Int).SetBytes(decodeB64(t, y)),
+		},
+	}
+	if d != "" {
+		key.D = new(big.Int).SetBytes(decodeB64(t, d))
+	}
+	return key
+}
+
+// Builds a token from a compact serialization, without decoding the payload
+func vectorToken(t *testing.T, serialized string) *JWT {
+	chunks := strings.Split(serialized, ".")
+	assert.Equal(t, len(chunks), 3)
+
+	var head JWTHead
+	assert.NilError(t, decodeChunk(chunks[0], &head))
+
+	return &JWT{
+		Head:      &head,
+		Body:      JWTBody{},
+		Signature: chunks[2],
+		payload:   chunks[0] + "." + chunks[1],
+	}
+}
+
+func TestECDSAVectors(t *testing.T) {
+	t.Run("ES256 signature from rfc7515 A.3 should be verified", func(t *testing.T) {
+		// https://datatracker.ietf.org/doc/html/rfc7515#appendix-A.3
+		key := ecdsaKey(t, elliptic.P256(),
+			"f83OJ3D2xF1Bg8vub9tLe1gHMzV76e8Tus9uPHvRVEU",
+			"x_FEzRu9m36HLN_tue659LNpXW6pCyStikYjKIWI5a0",
+			"",
+		)
+
+		token := vectorToken(t, "eyJhbGciOiJFUzI1NiJ9"+
+			".eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ"+
+			".DtEhU3ljbEg8L38VWAfUAqOyKAM6-Xx-F4GawxaepmXFCgfTjDxw5djxLa8ISlSApmWQxfKTUJqPP3-Kg6NU1Q")
+
+		assert.NilError(t, token.Verify(vectorKeystore{public: &key.PublicKey}))
+
+		t.Run("tampered signatures should be rejected", func(t *testing.T) {
+			token.Signature = "AA" + token.Signature[2:]
+			assert.Check(t, token.Verify(vectorKeystore{public: &key.PublicKey}) != nil)
+		})
+	})
+
+	t.Run("ES512 signature from rfc7515 A.4 should be verified", func(t *testing.T) {
+		// https://datatracker.ietf.org/doc/html/rfc7515#appendix-A.4
+		key := ecdsaKey(t, elliptic.P521(),
+			"AekpBQ8ST8a8VcfVOTNl353vSrDCLLJXmPk06wTjxrrjcBpXp5EOnYG_NjFZ6OvLFV1jSfS9tsz4qUxcWceqwQGk",
+			"ADSmRA43Z1DSNx_RvcLI87cdL07l6jQyyBXMoxVg_l2Th-x3S1WDhjDly79ajL4Kkd0AZMaZmh9ubmf63e3kyMj2",
+			"AY5pb7A0UFiB3RELSD64fTLOSV_jazdF7fLYyuTw8lOfRhWg6Y6rUrPAxerEzgdRhajnu0ferB0d53vM9mE15j2C",
+		)
+		ks := vectorKeystore{private: key, public: &key.PublicKey}
+
+		token := vectorToken(t, "eyJhbGciOiJFUzUxMiJ9"+
+			".UGF5bG9hZA"+
+			".AdwMgeerwtHoh-l192l60hp9wAHZFVJbLfD_UxMi70cwnZOYaRI1bKPWROc-mZZqwqT2SI-KGDKB34XO0aw_7XdtAG8GaSwFKdCAPZgoXD2YBJZCPEX3xKpRwcdOO8KpEHwJjyqOgzDO7iKvU8vcnwNrmxYbSW9ERBXukOXolLzeO_Jn")
+
+		assert.NilError(t, token.Verify(ks))
+
+		t.Run("signatures should be 132 bytes long, R||S padded to the key size", func(t *testing.T) {
+			// ecdsa signatures are randomized, sign again and check the encoding
+			signature, err := algorithms["ES512"].sign(ks, token.Head, []byte(token.payload))
+			assert.NilError(t, err)
+			assert.Equal(t, len(signature), 132)
+
+			err = algorithms["ES512"].verify(ks, token.Head, []byte(token.payload), signature)
+			assert.NilError(t, err)
+		})
+	})
+
+	t.Run("signature should not be verified with keys of another curve", func(t *testing.T) {
+		key := ecdsaKey(t, elliptic.P256(),
+			"f83OJ3D2xF1Bg8vub9tLe1gHMzV76e8Tus9uPHvRVEU",
+			"x_FEzRu9m36HLN_tue659LNpXW6pCyStikYjKIWI5a0",
+			"",
+		)
+
+		token := vectorToken(t, "eyJhbGciOiJFUzI1NiJ9"+
+			".eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ"+
+			".DtEhU3ljbEg8L38VWAfUAqOyKAM6-Xx-F4GawxaepmXFCgfTjDxw5djxLa8ISlSApmWQxfKTUJqPP3-Kg6NU1Q")
+		token.Head.Alg = "ES384"
+
+		assert.Check(t, token.Verify(vectorKeystore{public: &key.PublicKey}) != nil)
+	})
+}
+
+func TestEdDSAVectors(t *testing.T) {
+	// https://datatracker.ietf.org/doc/html/rfc8037#appendix-A.4
+	seed := decodeB64(t, "nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A")
+	key := ed25519.NewKeyFromSeed(seed)
+	ks := vectorKeystore{private: key, public: key.Public()}
+
+	const signingInput = "eyJhbGciOiJFZERTQSJ9.RXhhbXBsZSBvZiBFZDI1NTE5IHNpZ25pbmc"
+	const signature = "hgyY0il_MGCjP0JzlnLWG1PPOt7-09PGcvMg3AIbQR6dWbhijcNR4ki4iylGjg5BhVsPt9g7sVvpAr_MuM0KAg"
+
+	t.Run("public key should match rfc8037 A.1", func(t *testing.T) {
+		x := base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+		assert.Equal(t, x, "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	})
+
+	t.Run("signature should match rfc8037 A.4", func(t *testing.T) {
+		got, err := algorithms["EdDSA"].sign(ks, &JWTHead{Alg: "EdDSA"}, []byte(signingInput))
+		assert.NilError(t, err)
+		assert.Equal(t, base64.RawURLEncoding.EncodeToString(got), signature)
+	})
+
+	t.Run("signature from rfc8037 A.5 should be verified", func(t *testing.T) {
+		token := vectorToken(t, signingInput+"."+signature)
+		assert.NilError(t, token.Verify(ks))
+	})
+}
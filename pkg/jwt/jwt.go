@@ -2,9 +2,6 @@ package jwt
 
 import (
 	"bytes"
-	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
@@ -15,10 +12,17 @@ import (
 	"github.com/ale-cci/oauthsrv/pkg/keystore"
 )
 
+// Lifetime of the tokens generated by NewJWT, in seconds
+const TokenLifetime int64 = 3600
+
 type JWT struct {
 	Head      *JWTHead
 	Body      JWTBody
 	Signature string
+
+	// header and payload as received, signatures of decoded
+	// tokens are verified against it
+	payload string
 }
 
 type JWTHead struct {
@@ -68,21 +72,26 @@ func Decode(token string) (*JWT, error) {
 		return nil, err
 	}
 
-	return &JWT{&jwtHead, jwtBody, chunks[2]}, nil
+	return &JWT{
+		Head:      &jwtHead,
+		Body:      jwtBody,
+		Signature: chunks[2],
+		payload:   chunks[0] + "." + chunks[1],
+	}, nil
 }
 
 func (j *JWT) SigPayload() (string, error) {
 	headBytes, _ := json.Marshal(j.Head)
 	bodyBytes, _ := json.Marshal(j.Body)
 
-	encHead := base64.RawStdEncoding.EncodeToString(headBytes)
-	encBody := base64.RawStdEncoding.EncodeToString(bodyBytes)
+	encHead := base64.RawURLEncoding.EncodeToString(headBytes)
+	encBody := base64.RawURLEncoding.EncodeToString(bodyBytes)
 
 	return encHead + "." + encBody, nil
 }
 
 func (j *JWT) Verify(ks keystore.PublicKeystore) error {
-	if j.Head.Alg == "none" {
+	if j.Head == nil || j.Head.Alg == "none" {
 		return fmt.Errorf("Tokens with algorithm 'none' could not be verified")
 	}
 
@@ -104,47 +113,45 @@ func (j *JWT) Verify(ks keystore.PublicKeystore) error {
 		}
 	}
 
-	pubKey, err := ks.PublicKey(j.Head.Kid)
-	if err != nil {
-		return fmt.Errorf("Unable to verify jwt: %v", err)
-	}
 	signature, err := base64.RawURLEncoding.DecodeString(j.Signature)
 	if err != nil {
 		return fmt.Errorf("Unable to decode signature: %v", err)
 	}
 
-	hasher := sha256.New()
-	payload, _ := j.SigPayload()
-	hasher.Write([]byte(payload))
-	hash := hasher.Sum(nil)
+	payload := j.payload
+	if payload == "" {
+		payload, _ = j.SigPayload()
+	}
 
-	return rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hash[:], signature)
+	alg, ok := algorithms[j.Head.Alg]
+	if !ok {
+		return fmt.Errorf("Unsupported signing algorithm %q", j.Head.Alg)
+	}
+	return alg.verify(ks, j.Head, []byte(payload), signature)
 }
 
 // Calculates token signature, base64-urlencoded
 func (j JWT) Sign(ks keystore.PrivateKeystore) (string, error) {
-	hasher := sha256.New()
 	payload, _ := j.SigPayload()
-	hasher.Write([]byte(payload))
-	hash := hasher.Sum(nil)
-
 	var signature []byte
 
 	if j.Head == nil || j.Head.Alg == "none" {
+		hash := sha256.Sum256([]byte(payload))
 		signature = hash[:]
 	} else {
 		if ks == nil {
 			return "", fmt.Errorf("PrivateKeystore not provided")
 		}
 
-		privKey, err := ks.PrivateKey(j.Head.Kid)
-		if err != nil {
-			return "", err
+		alg, ok := algorithms[j.Head.Alg]
+		if !ok {
+			return "", fmt.Errorf("Unsupported signing algorithm %q", j.Head.Alg)
 		}
 
-		signature, err = rsa.SignPKCS1v15(rand.Reader, privKey, crypto.SHA256, hash[:])
+		var err error
+		signature, err = alg.sign(ks, j.Head, []byte(payload))
 		if err != nil {
-			return "", fmt.Errorf("Unable to sign jwt: %v", err)
+			return "", err
 		}
 	}
 
@@ -152,19 +159,44 @@ func (j JWT) Sign(ks keystore.PrivateKeystore) (string, error) {
 	return b64signature, nil
 }
 
+// Used by keystores not listing the algorithms they could sign with
+const DefaultAlgorithm = "RS256"
+
+/**
+ * Algorithm used by NewJWT, the first one the keystore could sign with,
+ * so keystores with only EC or Ed25519 keys are usable as well
+ */
+func SigningAlgorithm(ks keystore.PrivateKeyProvider) string {
+	if lister, ok := ks.(keystore.AlgorithmLister); ok {
+		if algorithms := lister.SigningAlgorithms(); len(algorithms) > 0 {
+			return algorithms[0]
+		}
+	}
+	return DefaultAlgorithm
+}
+
 // Generate new signed JWT, containing the provided claims
 // requires a private key provider to sign the jwt.
 func NewJWT(ks keystore.PrivateKeyProvider, claims map[string]interface{}) (string, error) {
-	keyInfo, _ := ks.GetSigningKey("HS256")
+	return NewJWTWithAlgorithm(ks, SigningAlgorithm(ks), claims)
+}
+
+// Same as NewJWT, signing the token with the requested algorithm
+func NewJWTWithAlgorithm(ks keystore.PrivateKeyProvider, alg string, claims map[string]interface{}) (string, error) {
+	keyInfo, err := ks.GetSigningKey(alg)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get signing key: %v", err)
+	}
 
 	// add protocol claims
 	issuedAt := time.Now().Unix()
 	claims["iat"] = issuedAt
-	claims["exp"] = issuedAt + 3600
+	claims["exp"] = issuedAt + TokenLifetime
 
 	token := JWT{
 		Head: &JWTHead{
 			Alg: keyInfo.Alg,
+			Typ: "JWT",
 			Kid: keyInfo.KeyID,
 		},
 		Body: claims,
@@ -0,0 +1,425 @@
+package keystore
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ale-cci/oauthsrv/pkg/jwk"
+)
+
+// Defaults of the key lifecycle of `FileKeystore`
+const (
+	defaultFilePublishDelay = 5 * time.Minute
+	defaultFileRetention    = time.Hour
+)
+
+/**
+ * Keystore loading the private keys from the PEM files of a directory.
+ * Supported formats are PKCS#1 and SEC1 (`RSA PRIVATE KEY`, `EC PRIVATE KEY`)
+ * and PKCS#8 (`PRIVATE KEY`), other files are ignored.
+ * Key ids are the RFC 7638 thumbprints of the keys, so they don't change
+ * among restarts.
+ *
+ * Keys found on reload are published `PublishDelay` before being used for
+ * signing, so consumers caching the key set know them. Keys of removed files
+ * still verify tokens for `Retention`, which should be longer than the
+ * lifetime of the issued tokens, and keep signing until the new keys of
+ * their algorithm are used, so replacing a key file does not stop the
+ * server from signing.
+ */
+type FileKeystore struct {
+	Dir string
+
+	PublishDelay time.Duration
+	Retention    time.Duration
+
+	mu       sync.RWMutex
+	keys     map[string]*fileKey
+	loaded   bool   // keys of the first load sign tokens immediately
+	snapshot string // directory content at the last load
+}
+
+type fileKey struct {
+	*PrivateKeyInfo
+
+	// when the key starts to be used for signing
+	activeAt time.Time
+	// when the key of a removed file is dropped, zero while the file exists
+	expiresAt time.Time
+	// when the key of a removed file stops signing, once its successor is active
+	retiresAt time.Time
+}
+
+func (key *fileKey) removed() bool {
+	return !key.expiresAt.IsZero()
+}
+
+// Reports if the key could still verify tokens
+func (key *fileKey) valid(now time.Time) bool {
+	return !key.removed() || now.Before(key.expiresAt)
+}
+
+// Reports if the key could sign tokens
+func (key *fileKey) signing(now time.Time) bool {
+	if key.removed() {
+		return now.Before(key.retiresAt)
+	}
+	return !key.activeAt.After(now)
+}
+
+/**
+ * Creates a keystore with the keys in the given directory.
+ * Returns an error if the directory does not contain any private key.
+ */
+func NewFileKeystore(dir string) (*FileKeystore, error) {
+	ks := &FileKeystore{
+		Dir:          dir,
+		PublishDelay: defaultFilePublishDelay,
+		Retention:    defaultFileRetention,
+	}
+	if err := ks.Load(); err != nil {
+		return nil, err
+	}
+
+	if len(ks.keys) == 0 {
+		return nil, fmt.Errorf("No private keys found in %q", dir)
+	}
+	return ks, nil
+}
+
+// Signing algorithm of the key, derived from its type
+func keyAlgorithm(key crypto.Signer) (string, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		switch pub.Curve.Params().Name {
+		case "P-256":
+			return "ES256", nil
+		case "P-384":
+			return "ES384", nil
+		case "P-521":
+			return "ES512", nil
+		}
+	case ed25519.PublicKey:
+		return "EdDSA", nil
+	}
+	return "", fmt.Errorf("Unsupported key type %T", key)
+}
+
+// Parses the private keys contained in a PEM file
+func parsePEM(data []byte) ([]crypto.Signer, error) {
+	keys := []crypto.Signer{}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return keys, nil
+		}
+
+		var parsed interface{}
+		var err error
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			parsed, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			// public keys and certificates
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse %s: %v", block.Type, err)
+		}
+
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported key type %T", parsed)
+		}
+		keys = append(keys, signer)
+	}
+}
+
+// Reads the keys of a PEM file
+func loadFile(path string, modTime time.Time) ([]*PrivateKeyInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signers, err := parsePEM(data)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*PrivateKeyInfo{}
+	for _, signer := range signers {
+		alg, err := keyAlgorithm(signer)
+		if err != nil {
+			return nil, err
+		}
+
+		kid, err := jwk.Thumbprint(signer.Public())
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &PrivateKeyInfo{
+			Alg:        alg,
+			KeyID:      kid,
+			PrivateKey: signer,
+			CreatedAt:  modTime,
+		})
+	}
+	return keys, nil
+}
+
+/**
+ * (Re)loads the keys from the `*.pem` files of the directory. Files that
+ * could not be loaded are logged and skipped.
+ */
+func (ks *FileKeystore) Load() error {
+	files, err := ioutil.ReadDir(ks.Dir)
+	if err != nil {
+		return fmt.Errorf("Unable to read keystore directory: %v", err)
+	}
+
+	loaded := map[string]*PrivateKeyInfo{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".pem") {
+			continue
+		}
+
+		path := filepath.Join(ks.Dir, file.Name())
+		fileKeys, err := loadFile(path, file.ModTime())
+		if err != nil {
+			log.Printf("Skipping key file %q: %v", path, err)
+			continue
+		}
+
+		for _, key := range fileKeys {
+			loaded[key.KeyID] = key
+		}
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := time.Now()
+	keys := map[string]*fileKey{}
+	for kid, keyInfo := range loaded {
+		key := &fileKey{PrivateKeyInfo: keyInfo}
+
+		if previous, ok := ks.keys[kid]; ok {
+			key.activeAt = previous.activeAt
+		} else if ks.loaded {
+			key.activeAt = now.Add(ks.PublishDelay)
+		}
+		keys[kid] = key
+	}
+
+	// keys of removed files verify the tokens they signed until retention
+	for kid, previous := range ks.keys {
+		if _, ok := keys[kid]; ok || !previous.valid(now) {
+			continue
+		}
+
+		if !previous.removed() {
+			previous = &fileKey{
+				PrivateKeyInfo: previous.PrivateKeyInfo,
+				activeAt:       previous.activeAt,
+				expiresAt:      now.Add(ks.Retention),
+				retiresAt:      successorActiveAt(keys, previous.Alg),
+			}
+		}
+		keys[kid] = previous
+	}
+
+	// nothing could sign until the new keys are published, e.g. all the
+	// files were replaced by keys of another algorithm
+	if ks.loaded && !anySigning(keys, now) {
+		for _, key := range keys {
+			if !key.removed() && key.activeAt.After(now) {
+				log.Printf("No signing keys left, using %s key %q before publishing it", key.Alg, key.KeyID)
+				key.activeAt = now
+			}
+		}
+	}
+
+	ks.keys = keys
+	ks.loaded = true
+	ks.snapshot = snapshot(files)
+	return nil
+}
+
+// When the first of the loaded keys of the algorithm is used for signing
+func successorActiveAt(keys map[string]*fileKey, alg string) time.Time {
+	var activeAt time.Time
+	found := false
+	for _, key := range keys {
+		if key.removed() || key.Alg != alg {
+			continue
+		}
+		if !found || key.activeAt.Before(activeAt) {
+			activeAt = key.activeAt
+			found = true
+		}
+	}
+	return activeAt
+}
+
+func anySigning(keys map[string]*fileKey, now time.Time) bool {
+	for _, key := range keys {
+		if key.signing(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary of the directory content, used to detect changes
+func snapshot(files []os.FileInfo) string {
+	var summary strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&summary, "%s:%d:%d;", file.Name(), file.Size(), file.ModTime().UnixNano())
+	}
+	return summary.String()
+}
+
+/**
+ * Polls the directory for changes every interval, reloading the keys when
+ * files are added, removed or modified. Blocks until the context is done.
+ */
+func (ks *FileKeystore) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			files, err := ioutil.ReadDir(ks.Dir)
+			if err != nil {
+				continue
+			}
+
+			ks.mu.RLock()
+			changed := snapshot(files) != ks.snapshot
+			ks.mu.RUnlock()
+
+			if !changed {
+				continue
+			}
+
+			if err := ks.Load(); err != nil {
+				log.Printf("Unable to reload keystore: %v", err)
+			}
+		}
+	}
+}
+
+/**
+ * Returns the key for the given algorithm. When there are multiple keys,
+ * the most recently modified file among the published ones is used.
+ */
+func (ks *FileKeystore) GetSigningKey(alg string) (*PrivateKeyInfo, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := time.Now()
+	var signing *PrivateKeyInfo
+	for _, key := range ks.keys {
+		if key.Alg != alg || !key.signing(now) {
+			continue
+		}
+
+		if signing == nil || key.CreatedAt.After(signing.CreatedAt) ||
+			(key.CreatedAt.Equal(signing.CreatedAt) && key.KeyID < signing.KeyID) {
+			signing = key.PrivateKeyInfo
+		}
+	}
+
+	if signing == nil {
+		return nil, fmt.Errorf("No keys available for %s", alg)
+	}
+	return signing, nil
+}
+
+func (ks *FileKeystore) PrivateKey(kid string) (crypto.Signer, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[kid]
+	if !ok || !key.valid(time.Now()) {
+		return nil, fmt.Errorf("Key %q not registered", kid)
+	}
+	return key.PrivateKey, nil
+}
+
+func (ks *FileKeystore) PublicKey(kid string) (crypto.PublicKey, error) {
+	key, err := ks.PrivateKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	return key.Public(), nil
+}
+
+// Published keys, including the ones not yet used for signing
+func (ks *FileKeystore) PublicKeys() ([]*PublicKeyInfo, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := time.Now()
+	keys := make([]*PublicKeyInfo, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		if key.valid(now) {
+			keys = append(keys, key.public())
+		}
+	}
+	return keys, nil
+}
+
+// Algorithms of the keys that could sign tokens
+func (ks *FileKeystore) SigningAlgorithms() []string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := time.Now()
+	algorithms := []string{}
+	for _, alg := range asymmetricAlgorithms {
+		for _, key := range ks.keys {
+			if key.Alg == alg && key.signing(now) {
+				algorithms = append(algorithms, alg)
+				break
+			}
+		}
+	}
+	return algorithms
+}
+
+/**
+ * Consumers could cache the key set until new keys are used for signing
+ */
+func (ks *FileKeystore) CacheMaxAge() time.Duration {
+	return ks.PublishDelay
+}
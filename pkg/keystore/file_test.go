@@ -0,0 +1,301 @@
+package keystore_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ale-cci/oauthsrv/pkg/jwk"
+	"github.com/ale-cci/oauthsrv/pkg/keystore"
+	"gotest.tools/assert"
+)
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	assert.NilError(t, ioutil.WriteFile(path, data, 0600))
+}
+
+func writePKCS8(t *testing.T, path string, key crypto.Signer) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NilError(t, err)
+	writePEM(t, path, "PRIVATE KEY", der)
+}
+
+func TestFileKeystore(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NilError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NilError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NilError(t, err)
+
+	t.Run("should load pkcs1, sec1 and pkcs8 keys", func(t *testing.T) {
+		dir := t.TempDir()
+		writePEM(t, filepath.Join(dir, "rsa.pem"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+		der, err := x509.MarshalECPrivateKey(ecKey)
+		assert.NilError(t, err)
+		writePEM(t, filepath.Join(dir, "ec.pem"), "EC PRIVATE KEY", der)
+		writePKCS8(t, filepath.Join(dir, "ed.pem"), edKey)
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ks.SigningAlgorithms(), []string{"RS256", "ES384", "EdDSA"})
+
+		keys, err := ks.PublicKeys()
+		assert.NilError(t, err)
+		assert.Equal(t, len(keys), 3)
+	})
+
+	t.Run("key ids should be the jwk thumbprints", func(t *testing.T) {
+		dir := t.TempDir()
+		writePKCS8(t, filepath.Join(dir, "private.pem"), rsaKey)
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+
+		info, err := ks.GetSigningKey("RS256")
+		assert.NilError(t, err)
+
+		thumbprint, err := jwk.Thumbprint(rsaKey.Public())
+		assert.NilError(t, err)
+		assert.Equal(t, info.KeyID, thumbprint)
+
+		pubKey, err := ks.PublicKey(info.KeyID)
+		assert.NilError(t, err)
+		assert.Check(t, rsaKey.PublicKey.Equal(pubKey))
+	})
+
+	t.Run("public keys and other files should be ignored", func(t *testing.T) {
+		dir := t.TempDir()
+		writePKCS8(t, filepath.Join(dir, "private.pem"), rsaKey)
+
+		der, err := x509.MarshalPKIXPublicKey(ecKey.Public())
+		assert.NilError(t, err)
+		writePEM(t, filepath.Join(dir, "public.pem"), "PUBLIC KEY", der)
+		writePKCS8(t, filepath.Join(dir, "ed.key"), edKey)
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ks.SigningAlgorithms(), []string{"RS256"})
+	})
+
+	t.Run("should return error if directory has no keys", func(t *testing.T) {
+		_, err := keystore.NewFileKeystore(t.TempDir())
+		assert.Check(t, err != nil)
+
+		_, err = keystore.NewFileKeystore(filepath.Join(t.TempDir(), "missing"))
+		assert.Check(t, err != nil)
+	})
+
+	t.Run("should return error on malformed keys", func(t *testing.T) {
+		dir := t.TempDir()
+		writePEM(t, filepath.Join(dir, "private.pem"), "RSA PRIVATE KEY", []byte("invalid"))
+
+		_, err := keystore.NewFileKeystore(dir)
+		assert.Check(t, err != nil)
+	})
+
+	t.Run("should return error if no key matches the algorithm", func(t *testing.T) {
+		dir := t.TempDir()
+		writePKCS8(t, filepath.Join(dir, "private.pem"), rsaKey)
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+
+		_, err = ks.GetSigningKey("ES256")
+		assert.Check(t, err != nil)
+	})
+
+	t.Run("most recent key should be used for signing", func(t *testing.T) {
+		dir := t.TempDir()
+		old, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NilError(t, err)
+
+		writePKCS8(t, filepath.Join(dir, "old.pem"), old)
+		writePKCS8(t, filepath.Join(dir, "new.pem"), rsaKey)
+		past := time.Now().Add(-time.Hour)
+		assert.NilError(t, os.Chtimes(filepath.Join(dir, "old.pem"), past, past))
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+
+		info, err := ks.GetSigningKey("RS256")
+		assert.NilError(t, err)
+		assert.Check(t, rsaKey.Equal(info.PrivateKey))
+
+		// old keys are still used to verify tokens
+		keys, err := ks.PublicKeys()
+		assert.NilError(t, err)
+		assert.Equal(t, len(keys), 2)
+	})
+
+	t.Run("invalid files should be skipped", func(t *testing.T) {
+		dir := t.TempDir()
+		writePKCS8(t, filepath.Join(dir, "private.pem"), rsaKey)
+
+		// unsupported curve
+		p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+		assert.NilError(t, err)
+		der, err := x509.MarshalECPrivateKey(p224)
+		assert.NilError(t, err)
+		writePEM(t, filepath.Join(dir, "p224.pem"), "EC PRIVATE KEY", der)
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+
+		writePEM(t, filepath.Join(dir, "broken.pem"), "PRIVATE KEY", []byte("invalid"))
+		assert.NilError(t, ks.Load())
+
+		_, err = ks.GetSigningKey("RS256")
+		assert.NilError(t, err)
+
+		keys, err := ks.PublicKeys()
+		assert.NilError(t, err)
+		assert.Equal(t, len(keys), 1)
+	})
+
+	t.Run("new keys should be published before signing", func(t *testing.T) {
+		dir := t.TempDir()
+		old, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NilError(t, err)
+		writePKCS8(t, filepath.Join(dir, "old.pem"), old)
+		past := time.Now().Add(-time.Hour)
+		assert.NilError(t, os.Chtimes(filepath.Join(dir, "old.pem"), past, past))
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+		ks.PublishDelay = 200 * time.Millisecond
+
+		writePKCS8(t, filepath.Join(dir, "new.pem"), rsaKey)
+		writePKCS8(t, filepath.Join(dir, "ed.pem"), edKey)
+		assert.NilError(t, ks.Load())
+
+		keys, err := ks.PublicKeys()
+		assert.NilError(t, err)
+		assert.Equal(t, len(keys), 3)
+
+		info, err := ks.GetSigningKey("RS256")
+		assert.NilError(t, err)
+		assert.Check(t, old.Equal(info.PrivateKey))
+		assert.DeepEqual(t, ks.SigningAlgorithms(), []string{"RS256"})
+
+		time.Sleep(ks.PublishDelay)
+
+		info, err = ks.GetSigningKey("RS256")
+		assert.NilError(t, err)
+		assert.Check(t, rsaKey.Equal(info.PrivateKey))
+		assert.DeepEqual(t, ks.SigningAlgorithms(), []string{"RS256", "EdDSA"})
+	})
+
+	t.Run("replacing the only key file should not stop signing", func(t *testing.T) {
+		dir := t.TempDir()
+		old, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NilError(t, err)
+		writePKCS8(t, filepath.Join(dir, "private.pem"), old)
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+		ks.PublishDelay = 200 * time.Millisecond
+
+		writePKCS8(t, filepath.Join(dir, "private.pem"), rsaKey)
+		assert.NilError(t, ks.Load())
+
+		info, err := ks.GetSigningKey("RS256")
+		assert.NilError(t, err)
+		assert.Check(t, old.Equal(info.PrivateKey))
+		assert.DeepEqual(t, ks.SigningAlgorithms(), []string{"RS256"})
+
+		time.Sleep(ks.PublishDelay)
+
+		info, err = ks.GetSigningKey("RS256")
+		assert.NilError(t, err)
+		assert.Check(t, rsaKey.Equal(info.PrivateKey))
+		assert.DeepEqual(t, ks.SigningAlgorithms(), []string{"RS256"})
+	})
+
+	t.Run("keys of another algorithm should sign when no key is left", func(t *testing.T) {
+		dir := t.TempDir()
+		writePKCS8(t, filepath.Join(dir, "private.pem"), ecKey)
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+		ks.PublishDelay = time.Hour
+
+		writePKCS8(t, filepath.Join(dir, "private.pem"), edKey)
+		assert.NilError(t, ks.Load())
+
+		_, err = ks.GetSigningKey("ES384")
+		assert.Check(t, err != nil)
+		_, err = ks.GetSigningKey("EdDSA")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ks.SigningAlgorithms(), []string{"EdDSA"})
+	})
+
+	t.Run("removed keys should verify tokens until retention", func(t *testing.T) {
+		dir := t.TempDir()
+		writePKCS8(t, filepath.Join(dir, "private.pem"), rsaKey)
+		writePKCS8(t, filepath.Join(dir, "ed.pem"), edKey)
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+		ks.Retention = 200 * time.Millisecond
+
+		thumbprint, err := jwk.Thumbprint(rsaKey.Public())
+		assert.NilError(t, err)
+
+		assert.NilError(t, os.Remove(filepath.Join(dir, "private.pem")))
+		assert.NilError(t, ks.Load())
+
+		_, err = ks.PublicKey(thumbprint)
+		assert.NilError(t, err)
+		_, err = ks.GetSigningKey("RS256")
+		assert.Check(t, err != nil)
+
+		time.Sleep(ks.Retention)
+
+		_, err = ks.PublicKey(thumbprint)
+		assert.Check(t, err != nil)
+
+		keys, err := ks.PublicKeys()
+		assert.NilError(t, err)
+		assert.Equal(t, len(keys), 1)
+	})
+
+	t.Run("watch should pick up new keys", func(t *testing.T) {
+		dir := t.TempDir()
+		writePKCS8(t, filepath.Join(dir, "private.pem"), rsaKey)
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+		ks.PublishDelay = 0
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go ks.Watch(ctx, 10*time.Millisecond)
+
+		writePKCS8(t, filepath.Join(dir, "ed.pem"), edKey)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := ks.GetSigningKey("EdDSA"); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("new key was not loaded")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
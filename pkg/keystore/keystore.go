@@ -5,21 +5,52 @@
 package keystore
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type PrivateKeyInfo struct {
-	Alg        string          // signing algorithm
-	KeyID      string          // unique identifier of the key in the keystore
-	PrivateKey *rsa.PrivateKey // actual key
+	Alg        string        // signing algorithm
+	KeyID      string        // unique identifier of the key in the keystore
+	PrivateKey crypto.Signer // actual key
+	CreatedAt  time.Time     // when the key was added to the keystore
+}
+
+func (keyInfo *PrivateKeyInfo) public() *PublicKeyInfo {
+	return &PublicKeyInfo{
+		Alg:       keyInfo.Alg,
+		KeyID:     keyInfo.KeyID,
+		PublicKey: keyInfo.PrivateKey.Public(),
+		CreatedAt: keyInfo.CreatedAt,
+	}
+}
+
+// Public part of a signing key, could be shared outside the application
+type PublicKeyInfo struct {
+	Alg       string           // signing algorithm
+	KeyID     string           // unique identifier of the key in the keystore
+	PublicKey crypto.PublicKey // actual key
+	CreatedAt time.Time        // when the key was added to the keystore
+}
+
+// Symmetric key, used for HMAC signatures
+type SecretKeyInfo struct {
+	Alg   string // signing algorithm, the key could be used only with it
+	KeyID string // unique identifier of the key in the keystore
+	Key   []byte // actual key
 }
 
 type PrivateKeystore interface {
-	PrivateKey(kid string) (*rsa.PrivateKey, error)
+	PrivateKey(kid string) (crypto.Signer, error)
 }
 
 type PrivateKeyProvider interface {
@@ -28,40 +59,150 @@ type PrivateKeyProvider interface {
 }
 
 type PublicKeystore interface {
-	PublicKey(kid string) (*rsa.PublicKey, error)
+	PublicKey(kid string) (crypto.PublicKey, error)
+}
+
+// Keystore able to enumerate its public keys, secret keys are never listed
+type PublicKeyLister interface {
+	PublicKeys() ([]*PublicKeyInfo, error)
+}
+
+// Keystore able to report the algorithms it could sign tokens with
+type AlgorithmLister interface {
+	SigningAlgorithms() []string
+}
+
+/**
+ * Implemented by keystores that rotate their keys. New keys are published
+ * at least `CacheMaxAge` before being used for signing, so the public keys
+ * could be cached by consumers for that long.
+ */
+type CachePolicy interface {
+	CacheMaxAge() time.Duration
+}
+
+/**
+ * Keystore whose keys could be added and removed, the lifecycle of
+ * the keys is managed by a `RotatingKeystore`.
+ */
+type ManagedKeystore interface {
+	PrivateKeystore
+	PublicKeystore
+	PublicKeyLister
+
+	// generates and stores a new key for the signing algorithm
+	AddKey(alg string) (*PublicKeyInfo, error)
+	DeleteKey(kid string) error
+}
+
+type SecretKeystore interface {
+	SecretKey(kid string) (*SecretKeyInfo, error)
+}
+
+type SecretKeyProvider interface {
+	SecretKeystore
+	GetSecretKey(alg string) (*SecretKeyInfo, error)
 }
 
 type Keystore interface {
 	PrivateKeyProvider
 	PublicKeystore
+	PublicKeyLister
+	AlgorithmLister
+}
+
+// Asymmetric algorithms for which keys could be generated
+var asymmetricAlgorithms = []string{"RS256", "ES256", "ES384", "ES512", "EdDSA"}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Generate a new private key, usable with the given signing algorithm
+ */
+func GenerateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, 2096)
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ES512":
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "EdDSA":
+		_, pk, err := ed25519.GenerateKey(rand.Reader)
+		return pk, err
+	default:
+		return nil, fmt.Errorf("Signing algorithm not recognize")
+	}
 }
 
 /**
  * Volatile Keystore, keys are generated on the fly when
  * requested.
  * When the application shuts off, all the keys are lost.
+ * Safe for concurrent use, the maps should not be accessed
+ * directly while the keystore is in use.
  */
 type TempKeystore struct {
-	Keys map[string](*PrivateKeyInfo)
+	Keys    map[string](*PrivateKeyInfo)
+	Secrets map[string](*SecretKeyInfo)
+
+	mu sync.RWMutex
+	// serializes key generation, so concurrent requests
+	// don't generate multiple keys for the same algorithm
+	generating sync.Mutex
+}
+
+// Size in bytes of the generated secrets, equal to the hash output size
+var secretKeySizes = map[string]int{
+	"HS256": 32,
+	"HS384": 48,
+	"HS512": 64,
+}
+
+func (ks *TempKeystore) findSigningKey(alg string) *PrivateKeyInfo {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, value := range ks.Keys {
+		if value.Alg == alg {
+			return value
+		}
+	}
+	return nil
 }
 
 /**
  * Get the signing key from the keystore. If none exist one
  * is created
- * Ideally private keys should have an expiration date, and
- * rotate.
+ * Keys never expire, wrap the keystore in a `RotatingKeystore`
+ * to rotate them.
  */
 func (ks *TempKeystore) GetSigningKey(alg string) (*PrivateKeyInfo, error) {
-	if alg != "HS256" {
-		return nil, fmt.Errorf("Signing algorithm not recognize")
+	if keyInfo := ks.findSigningKey(alg); keyInfo != nil {
+		return keyInfo, nil
 	}
-	if len(ks.Keys) > 0 {
-		for _, value := range ks.Keys {
-			return value, nil
-		}
+
+	ks.generating.Lock()
+	defer ks.generating.Unlock()
+
+	// the key could have been generated while waiting
+	if keyInfo := ks.findSigningKey(alg); keyInfo != nil {
+		return keyInfo, nil
 	}
+	return ks.addKey(alg)
+}
 
-	pk, err := rsa.GenerateKey(rand.Reader, 2096)
+func (ks *TempKeystore) addKey(alg string) (*PrivateKeyInfo, error) {
+	pk, err := GenerateKey(alg)
 
 	if err != nil {
 		return nil, fmt.Errorf("Unable to generate private key: %v", err)
@@ -73,36 +214,161 @@ func (ks *TempKeystore) GetSigningKey(alg string) (*PrivateKeyInfo, error) {
 		Alg:        alg,
 		KeyID:      kid,
 		PrivateKey: pk,
+		CreatedAt:  time.Now(),
 	}
+
+	ks.mu.Lock()
 	ks.Keys[kid] = keyInfo
+	ks.mu.Unlock()
 
 	return keyInfo, nil
 }
 
 /**
- * Fetch a private key given it's key id
+ * Generate a new key for the algorithm, even if one already exists
  */
-func (ks *TempKeystore) PublicKey(kid string) (*rsa.PublicKey, error) {
-	keyInfo, ok := ks.Keys[kid]
-	if !ok {
-		return nil, fmt.Errorf("Key %q not registered", kid)
+func (ks *TempKeystore) AddKey(alg string) (*PublicKeyInfo, error) {
+	keyInfo, err := ks.addKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	return keyInfo.public(), nil
+}
+
+func (ks *TempKeystore) DeleteKey(kid string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if _, ok := ks.Keys[kid]; !ok {
+		return fmt.Errorf("Key %q not registered", kid)
 	}
-	return &keyInfo.PrivateKey.PublicKey, nil
+	delete(ks.Keys, kid)
+	return nil
+}
+
+/**
+ * Signing keys are generated on demand, so all the asymmetric
+ * algorithms are supported
+ */
+func (ks *TempKeystore) SigningAlgorithms() []string {
+	return append([]string{}, asymmetricAlgorithms...)
 }
 
 /**
  * Fetch a public key given it's key id
  */
-func (ks *TempKeystore) PrivateKey(kid string) (*rsa.PrivateKey, error) {
+func (ks *TempKeystore) PublicKey(kid string) (crypto.PublicKey, error) {
+	keyInfo, err := ks.privateKeyInfo(kid)
+	if err != nil {
+		return nil, err
+	}
+	return keyInfo.PrivateKey.Public(), nil
+}
+
+/**
+ * List the public keys of all the generated signing keys
+ */
+func (ks *TempKeystore) PublicKeys() ([]*PublicKeyInfo, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keys := make([]*PublicKeyInfo, 0, len(ks.Keys))
+	for _, keyInfo := range ks.Keys {
+		keys = append(keys, keyInfo.public())
+	}
+	return keys, nil
+}
+
+func (ks *TempKeystore) privateKeyInfo(kid string) (*PrivateKeyInfo, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
 	keyInfo, ok := ks.Keys[kid]
 	if !ok {
 		return nil, fmt.Errorf("Key %q not registered", kid)
 	}
+	return keyInfo, nil
+}
+
+/**
+ * Fetch a private key given it's key id
+ */
+func (ks *TempKeystore) PrivateKey(kid string) (crypto.Signer, error) {
+	keyInfo, err := ks.privateKeyInfo(kid)
+	if err != nil {
+		return nil, err
+	}
 	return keyInfo.PrivateKey, nil
 }
 
+func (ks *TempKeystore) findSecretKey(alg string) *SecretKeyInfo {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, value := range ks.Secrets {
+		if value.Alg == alg {
+			return value
+		}
+	}
+	return nil
+}
+
+/**
+ * Get the secret key used to sign tokens with the given hmac
+ * algorithm. If none exist one is created.
+ */
+func (ks *TempKeystore) GetSecretKey(alg string) (*SecretKeyInfo, error) {
+	size, ok := secretKeySizes[alg]
+	if !ok {
+		return nil, fmt.Errorf("Signing algorithm not recognize")
+	}
+
+	if keyInfo := ks.findSecretKey(alg); keyInfo != nil {
+		return keyInfo, nil
+	}
+
+	ks.generating.Lock()
+	defer ks.generating.Unlock()
+
+	if keyInfo := ks.findSecretKey(alg); keyInfo != nil {
+		return keyInfo, nil
+	}
+
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("Unable to generate secret key: %v", err)
+	}
+
+	keyInfo := &SecretKeyInfo{
+		Alg:   alg,
+		KeyID: uuid.New().String(),
+		Key:   key,
+	}
+
+	ks.mu.Lock()
+	ks.Secrets[keyInfo.KeyID] = keyInfo
+	ks.mu.Unlock()
+
+	return keyInfo, nil
+}
+
+/**
+ * Fetch a secret key given it's key id
+ */
+func (ks *TempKeystore) SecretKey(kid string) (*SecretKeyInfo, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keyInfo, ok := ks.Secrets[kid]
+	if !ok {
+		return nil, fmt.Errorf("Key %q not registered", kid)
+	}
+	return keyInfo, nil
+}
+
 func NewTempKeystore() (*TempKeystore, error) {
 	return &TempKeystore{
-		Keys: make(map[string](*PrivateKeyInfo)),
+		Keys:    make(map[string](*PrivateKeyInfo)),
+		Secrets: make(map[string](*SecretKeyInfo)),
 	}, nil
 }
@@ -1,6 +1,14 @@
 package keystore_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 	"unicode"
 
@@ -13,10 +21,10 @@ func TestKeystore(t *testing.T) {
 		ks, err := keystore.NewTempKeystore()
 		assert.NilError(t, err)
 
-		pkInfo, err := ks.GetSigningKey("HS256")
+		pkInfo, err := ks.GetSigningKey("RS256")
 		assert.NilError(t, err)
 
-		assert.Check(t, pkInfo.Alg == "HS256")
+		assert.Check(t, pkInfo.Alg == "RS256")
 		assert.Check(t, pkInfo.KeyID != "")
 		assert.Check(t, pkInfo.PrivateKey != nil)
 	})
@@ -25,20 +33,20 @@ func TestKeystore(t *testing.T) {
 		ks, err := keystore.NewTempKeystore()
 		assert.NilError(t, err)
 
-		pkInfo, err := ks.GetSigningKey("HS256")
+		pkInfo, err := ks.GetSigningKey("RS256")
 		assert.NilError(t, err)
 
 		pubKey, err := ks.PublicKey(pkInfo.KeyID)
 
 		assert.NilError(t, err)
-		assert.Check(t, pubKey == &pkInfo.PrivateKey.PublicKey)
+		assert.Check(t, pubKey == pkInfo.PrivateKey.Public())
 	})
 
 	t.Run("should be able to retrieve private key", func(t *testing.T) {
 		ks, err := keystore.NewTempKeystore()
 		assert.NilError(t, err)
 
-		pkInfo, err := ks.GetSigningKey("HS256")
+		pkInfo, err := ks.GetSigningKey("RS256")
 		assert.NilError(t, err)
 
 		privKey, err := ks.PrivateKey(pkInfo.KeyID)
@@ -51,10 +59,10 @@ func TestKeystore(t *testing.T) {
 		ks, err := keystore.NewTempKeystore()
 		assert.NilError(t, err)
 
-		fst, err := ks.GetSigningKey("HS256")
+		fst, err := ks.GetSigningKey("RS256")
 		assert.NilError(t, err)
 
-		snd, err := ks.GetSigningKey("HS256")
+		snd, err := ks.GetSigningKey("RS256")
 		assert.NilError(t, err)
 
 		assert.Check(t, fst.KeyID == snd.KeyID)
@@ -65,11 +73,11 @@ func TestKeystore(t *testing.T) {
 		ks1, err := keystore.NewTempKeystore()
 		assert.NilError(t, err)
 
-		key1, err := ks1.GetSigningKey("HS256")
+		key1, err := ks1.GetSigningKey("RS256")
 		assert.NilError(t, err)
 
 		ks2, err := keystore.NewTempKeystore()
-		key2, err := ks2.GetSigningKey("HS256")
+		key2, err := ks2.GetSigningKey("RS256")
 		assert.NilError(t, err)
 
 		assert.Check(t, key1.KeyID != key2.KeyID)
@@ -97,7 +105,7 @@ func TestKeystore(t *testing.T) {
 		ks, err := keystore.NewTempKeystore()
 		assert.NilError(t, err)
 
-		info, err := ks.GetSigningKey("HS256")
+		info, err := ks.GetSigningKey("RS256")
 		assert.NilError(t, err)
 
 		for _, c := range info.KeyID {
@@ -112,4 +120,266 @@ func TestKeystore(t *testing.T) {
 		_, err = ks.PrivateKey("random-kid")
 		assert.Check(t, err != nil)
 	})
+
+	t.Run("keys should be generated for each asymmetric algorithm", func(t *testing.T) {
+		ks, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		for alg, want := range map[string]interface{}{
+			"RS256": &rsa.PublicKey{},
+			"ES256": &ecdsa.PublicKey{},
+			"ES384": &ecdsa.PublicKey{},
+			"ES512": &ecdsa.PublicKey{},
+			"EdDSA": ed25519.PublicKey{},
+		} {
+			info, err := ks.GetSigningKey(alg)
+			assert.NilError(t, err)
+			assert.Equal(t, info.Alg, alg)
+
+			pubKey, err := ks.PublicKey(info.KeyID)
+			assert.NilError(t, err)
+			assert.Equal(t, reflect.TypeOf(pubKey), reflect.TypeOf(want), alg)
+		}
+	})
+
+	t.Run("signing keys should be bound to their algorithm", func(t *testing.T) {
+		ks, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		es256, err := ks.GetSigningKey("ES256")
+		assert.NilError(t, err)
+		es384, err := ks.GetSigningKey("ES384")
+		assert.NilError(t, err)
+
+		assert.Check(t, es256.KeyID != es384.KeyID)
+		assert.Check(t, es384.PrivateKey.Public().(*ecdsa.PublicKey).Curve == elliptic.P384())
+	})
+
+	t.Run("public keys of generated keys should be listed", func(t *testing.T) {
+		ks, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		rsaKey, err := ks.GetSigningKey("RS256")
+		assert.NilError(t, err)
+		ecKey, err := ks.GetSigningKey("ES256")
+		assert.NilError(t, err)
+		_, err = ks.GetSecretKey("HS256")
+		assert.NilError(t, err)
+
+		keys, err := ks.PublicKeys()
+		assert.NilError(t, err)
+		assert.Equal(t, len(keys), 2)
+
+		for _, info := range keys {
+			switch info.KeyID {
+			case rsaKey.KeyID:
+				assert.Check(t, info.Alg == "RS256")
+				assert.Check(t, info.PublicKey == rsaKey.PrivateKey.Public())
+			case ecKey.KeyID:
+				assert.Check(t, info.Alg == "ES256")
+			default:
+				t.Errorf("unexpected key %q", info.KeyID)
+			}
+		}
+	})
+
+	t.Run("rsa signing keys should not be returned for hmac algorithms", func(t *testing.T) {
+		ks, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		_, err = ks.GetSigningKey("HS256")
+		assert.Check(t, err != nil)
+	})
+}
+
+func TestSecretKeys(t *testing.T) {
+	t.Run("keystore should generate secret keys of the hash size", func(t *testing.T) {
+		ks, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		for alg, size := range map[string]int{"HS256": 32, "HS384": 48, "HS512": 64} {
+			info, err := ks.GetSecretKey(alg)
+			assert.NilError(t, err)
+			assert.Equal(t, info.Alg, alg)
+			assert.Equal(t, len(info.Key), size)
+		}
+	})
+
+	t.Run("consecutive calls should return the same key", func(t *testing.T) {
+		ks, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		fst, err := ks.GetSecretKey("HS256")
+		assert.NilError(t, err)
+		snd, err := ks.GetSecretKey("HS256")
+		assert.NilError(t, err)
+
+		assert.Equal(t, fst.KeyID, snd.KeyID)
+	})
+
+	t.Run("should be able to retrieve the secret key by id", func(t *testing.T) {
+		ks, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		info, err := ks.GetSecretKey("HS512")
+		assert.NilError(t, err)
+
+		got, err := ks.SecretKey(info.KeyID)
+		assert.NilError(t, err)
+		assert.Check(t, got == info)
+	})
+
+	t.Run("secret and private keys should not share ids", func(t *testing.T) {
+		ks, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		secret, err := ks.GetSecretKey("HS256")
+		assert.NilError(t, err)
+		private, err := ks.GetSigningKey("RS256")
+		assert.NilError(t, err)
+
+		_, err = ks.PublicKey(secret.KeyID)
+		assert.Check(t, err != nil)
+		_, err = ks.SecretKey(private.KeyID)
+		assert.Check(t, err != nil)
+	})
+
+	t.Run("should return error if algorithm is not hmac", func(t *testing.T) {
+		ks, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		_, err = ks.GetSecretKey("RS256")
+		assert.Check(t, err != nil)
+	})
+}
+
+/**
+ * Requests the signing key and its public key from many goroutines,
+ * all of them should receive the same key.
+ */
+func hammer(t *testing.T, ks keystore.Keystore, alg string) {
+	const workers = 50
+
+	var wg sync.WaitGroup
+	kids := make(chan string, workers)
+	errs := make(chan error, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			info, err := ks.GetSigningKey(alg)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if _, err := ks.PublicKey(info.KeyID); err != nil {
+				errs <- err
+				return
+			}
+
+			if _, err := ks.PublicKeys(); err != nil {
+				errs <- err
+				return
+			}
+			kids <- info.KeyID
+		}()
+	}
+	wg.Wait()
+	close(kids)
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	seen := map[string]bool{}
+	for kid := range kids {
+		seen[kid] = true
+	}
+	assert.Equal(t, len(seen), 1, "signing keys: %v", seen)
+
+	keys, err := ks.PublicKeys()
+	assert.NilError(t, err)
+	assert.Equal(t, len(keys), 1)
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	t.Run("temporary keystore should generate a single key", func(t *testing.T) {
+		ks, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		hammer(t, ks, "ES256")
+	})
+
+	t.Run("temporary keystore should generate a single secret", func(t *testing.T) {
+		ks, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		var wg sync.WaitGroup
+		kids := make([]string, 20)
+		for i := range kids {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				info, err := ks.GetSecretKey("HS256")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				kids[i] = info.KeyID
+			}(i)
+		}
+		wg.Wait()
+
+		for _, kid := range kids {
+			assert.Equal(t, kid, kids[0])
+		}
+	})
+
+	t.Run("file keystore should be readable while reloading", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NilError(t, err)
+
+		dir := t.TempDir()
+		writePKCS8(t, filepath.Join(dir, "private.pem"), key)
+
+		ks, err := keystore.NewFileKeystore(dir)
+		assert.NilError(t, err)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 20; i++ {
+				ks.Load()
+			}
+		}()
+
+		hammer(t, ks, "ES256")
+		<-done
+	})
+
+	t.Run("rotating keystore should generate a single key", func(t *testing.T) {
+		ks, _ := newRotatingKeystore(t)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 20; i++ {
+				ks.Rotate()
+			}
+		}()
+
+		hammer(t, ks, "ES256")
+		<-done
+	})
+
+	t.Run("mongo keystore should generate a single key", func(t *testing.T) {
+		ks, err := keystore.NewMongoKeystore(testDatabase(t), testKEK(1))
+		assert.NilError(t, err)
+
+		hammer(t, ks, "ES256")
+	})
 }
@@ -0,0 +1,526 @@
+package keystore
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ale-cci/oauthsrv/pkg/jwk"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Size in bytes of the key-encryption key, used with AES-256-GCM
+const KEKSize = 32
+
+// Timeout of the queries to the keys collection
+const mongoTimeout = 5 * time.Second
+
+// How long the signing key choice is cached, before checking for newer keys
+const signingKeyTTL = time.Minute
+
+// How long keys are cached, before checking they were not deleted
+const keyCacheTTL = time.Minute
+
+// Key ids of token headers are not authenticated, so unknown ones are looked
+// up listing the collection at most once per interval
+const keyListInterval = 5 * time.Second
+
+/**
+ * Key document of the `keys` collection. The private key is stored as
+ * PKCS#8, encrypted with the key-encryption key.
+ */
+type storedKey struct {
+	KeyID      string    `bson:"_id"`
+	Alg        string    `bson:"alg"`
+	PublicKey  []byte    `bson:"public_key"`  // PKIX
+	PrivateKey []byte    `bson:"private_key"` // nonce + encrypted PKCS#8
+	CreatedAt  time.Time `bson:"created_at"`
+}
+
+type signingKey struct {
+	kid       string
+	fetchedAt time.Time
+}
+
+type cachedPrivateKey struct {
+	info      *PrivateKeyInfo
+	fetchedAt time.Time
+}
+
+type cachedPublicKey struct {
+	info      *PublicKeyInfo
+	fetchedAt time.Time
+}
+
+/**
+ * Keystore shared among all the instances connected to the same database.
+ * Keys are generated on demand, and the most recent key of an algorithm is
+ * used for signing. Key ids are the RFC 7638 thumbprints of the keys.
+ *
+ * Keys are cached in memory for `keyCacheTTL`, so keys deleted by other
+ * instances stop being used within that time, and as soon as `PublicKeys`
+ * lists the collection. Keys created by other instances verify tokens
+ * within `keyListInterval`. The signing key choice is refreshed every
+ * `signingKeyTTL`.
+ * Safe for concurrent use.
+ */
+type MongoKeystore struct {
+	collection *mongo.Collection
+	kek        cipher.AEAD
+
+	// serializes key generation within the instance
+	generating sync.Mutex
+
+	// serializes the listings triggered by unknown key ids
+	listing sync.Mutex
+
+	mu       sync.RWMutex
+	keys     map[string]cachedPrivateKey
+	public   map[string]cachedPublicKey
+	signing  map[string]signingKey
+	listedAt time.Time
+}
+
+/**
+ * Creates a keystore on the `keys` collection of the database,
+ * private keys are encrypted with the given key-encryption key.
+ * The index used to select the signing keys is created if missing.
+ */
+func NewMongoKeystore(db *mongo.Database, kek []byte) (*MongoKeystore, error) {
+	if len(kek) != KEKSize {
+		return nil, fmt.Errorf("Key-encryption key should be %d bytes long", KEKSize)
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key-encryption key: %v", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key-encryption key: %v", err)
+	}
+
+	collection := db.Collection("keys")
+	if err := createKeyIndexes(collection); err != nil {
+		return nil, err
+	}
+
+	return &MongoKeystore{
+		collection: collection,
+		kek:        aead,
+		keys:       make(map[string]cachedPrivateKey),
+		public:     make(map[string]cachedPublicKey),
+		signing:    make(map[string]signingKey),
+	}, nil
+}
+
+/**
+ * Signing keys are looked up by algorithm, the most recent first,
+ * on each refresh of the signing key choice
+ */
+func createKeyIndexes(collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "alg", Value: 1},
+			{Key: "created_at", Value: -1},
+			{Key: "_id", Value: 1},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to create keys index: %v", err)
+	}
+	return nil
+}
+
+// Encrypts the private key, bound to its key id
+func (ks *MongoKeystore) seal(kid string, der []byte) ([]byte, error) {
+	nonce := make([]byte, ks.kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Unable to generate nonce: %v", err)
+	}
+	return ks.kek.Seal(nonce, nonce, der, []byte(kid)), nil
+}
+
+func (ks *MongoKeystore) open(kid string, sealed []byte) ([]byte, error) {
+	size := ks.kek.NonceSize()
+	if len(sealed) < size {
+		return nil, fmt.Errorf("Invalid encrypted key %q", kid)
+	}
+
+	der, err := ks.kek.Open(nil, sealed[:size], sealed[size:], []byte(kid))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt key %q: %v", kid, err)
+	}
+	return der, nil
+}
+
+// Generates a new key and stores it in the collection
+func (ks *MongoKeystore) addKey(ctx context.Context, alg string) (*PublicKeyInfo, error) {
+	pk, err := GenerateKey(alg)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate private key: %v", err)
+	}
+
+	kid, err := jwk.Thumbprint(pk.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	pubDer, err := x509.MarshalPKIXPublicKey(pk.Public())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode public key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode private key: %v", err)
+	}
+
+	sealed, err := ks.seal(kid, der)
+	if err != nil {
+		return nil, err
+	}
+
+	// mongo stores dates with millisecond precision
+	createdAt := time.Now().Truncate(time.Millisecond)
+
+	_, err = ks.collection.InsertOne(ctx, storedKey{
+		KeyID:      kid,
+		Alg:        alg,
+		PublicKey:  pubDer,
+		PrivateKey: sealed,
+		CreatedAt:  createdAt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to store key: %v", err)
+	}
+
+	return &PublicKeyInfo{
+		Alg:       alg,
+		KeyID:     kid,
+		PublicKey: pk.Public(),
+		CreatedAt: createdAt,
+	}, nil
+}
+
+/**
+ * Generate a new key for the algorithm, even if one already exists
+ */
+func (ks *MongoKeystore) AddKey(alg string) (*PublicKeyInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	return ks.addKey(ctx, alg)
+}
+
+/**
+ * Removes the key from the collection. Other instances drop their cached
+ * copy within `keyCacheTTL`.
+ */
+func (ks *MongoKeystore) DeleteKey(kid string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	result, err := ks.collection.DeleteOne(ctx, bson.D{{Key: "_id", Value: kid}})
+	if err != nil {
+		return fmt.Errorf("Unable to delete key %q: %v", kid, err)
+	}
+	if result.DeletedCount == 0 {
+		return fmt.Errorf("Key %q not registered", kid)
+	}
+
+	ks.evict(kid)
+	return nil
+}
+
+// Removes the deleted key from the caches
+func (ks *MongoKeystore) evict(kid string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	delete(ks.keys, kid)
+	delete(ks.public, kid)
+	for alg, signing := range ks.signing {
+		if signing.kid == kid {
+			delete(ks.signing, alg)
+		}
+	}
+}
+
+/**
+ * Finds the key id of the current signing key for the algorithm, every
+ * instance picks the most recent key, ties are broken by key id.
+ */
+func (ks *MongoKeystore) findSigningKey(ctx context.Context, alg string) (string, error) {
+	var key storedKey
+	err := ks.collection.FindOne(
+		ctx,
+		bson.D{{Key: "alg", Value: alg}},
+		options.FindOne().
+			SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: 1}}).
+			SetProjection(bson.D{{Key: "_id", Value: 1}}),
+	).Decode(&key)
+
+	if err != nil {
+		return "", err
+	}
+	return key.KeyID, nil
+}
+
+/**
+ * Get the signing key for the algorithm. If none exist one is created.
+ * When multiple instances create a key at the same time, all of them
+ * converge to the same key once the other keys are stored.
+ */
+func (ks *MongoKeystore) GetSigningKey(alg string) (*PrivateKeyInfo, error) {
+	ks.mu.RLock()
+	cached, ok := ks.signing[alg]
+	ks.mu.RUnlock()
+
+	if ok && time.Since(cached.fetchedAt) < signingKeyTTL {
+		return ks.privateKeyInfo(cached.kid)
+	}
+
+	if !contains(asymmetricAlgorithms, alg) {
+		return nil, fmt.Errorf("Signing algorithm not recognize")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	kid, err := ks.findSigningKey(ctx, alg)
+	if err == mongo.ErrNoDocuments {
+		kid, err = ks.createSigningKey(ctx, alg)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find signing key: %v", err)
+	}
+
+	ks.mu.Lock()
+	ks.signing[alg] = signingKey{kid: kid, fetchedAt: time.Now()}
+	ks.mu.Unlock()
+
+	return ks.privateKeyInfo(kid)
+}
+
+// Generates the first key of the algorithm, one goroutine at a time
+func (ks *MongoKeystore) createSigningKey(ctx context.Context, alg string) (string, error) {
+	ks.generating.Lock()
+	defer ks.generating.Unlock()
+
+	// the key could have been generated while waiting
+	kid, err := ks.findSigningKey(ctx, alg)
+	if err != mongo.ErrNoDocuments {
+		return kid, err
+	}
+
+	if _, err := ks.addKey(ctx, alg); err != nil {
+		return "", err
+	}
+
+	// another instance could have created a key in the meantime
+	return ks.findSigningKey(ctx, alg)
+}
+
+// Fetches the key from the cache, or decrypts it from the collection
+func (ks *MongoKeystore) privateKeyInfo(kid string) (*PrivateKeyInfo, error) {
+	ks.mu.RLock()
+	cached, ok := ks.keys[kid]
+	ks.mu.RUnlock()
+
+	if ok && time.Since(cached.fetchedAt) < keyCacheTTL {
+		return cached.info, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	var key storedKey
+	err := ks.collection.FindOne(ctx, bson.D{{Key: "_id", Value: kid}}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		ks.evict(kid)
+		return nil, fmt.Errorf("Key %q not registered", kid)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch key %q: %v", kid, err)
+	}
+
+	der, err := ks.open(kid, key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse key %q: %v", kid, err)
+	}
+
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported key type %T", parsed)
+	}
+
+	keyInfo := &PrivateKeyInfo{
+		Alg:        key.Alg,
+		KeyID:      kid,
+		PrivateKey: signer,
+		CreatedAt:  key.CreatedAt,
+	}
+
+	// tokens signed with the key should verify without listing the collection
+	now := time.Now()
+	ks.mu.Lock()
+	ks.keys[kid] = cachedPrivateKey{info: keyInfo, fetchedAt: now}
+	ks.public[kid] = cachedPublicKey{info: keyInfo.public(), fetchedAt: now}
+	ks.mu.Unlock()
+
+	return keyInfo, nil
+}
+
+func (ks *MongoKeystore) PrivateKey(kid string) (crypto.Signer, error) {
+	keyInfo, err := ks.privateKeyInfo(kid)
+	if err != nil {
+		return nil, err
+	}
+	return keyInfo.PrivateKey, nil
+}
+
+func publicKeyInfo(key *storedKey) (*PublicKeyInfo, error) {
+	pubKey, err := x509.ParsePKIXPublicKey(key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse key %q: %v", key.KeyID, err)
+	}
+
+	return &PublicKeyInfo{
+		Alg:       key.Alg,
+		KeyID:     key.KeyID,
+		PublicKey: pubKey,
+		CreatedAt: key.CreatedAt,
+	}, nil
+}
+
+/**
+ * Fetch a public key given it's key id, private keys are not decrypted.
+ * Keys not cached are looked up listing the collection, at most once
+ * every `keyListInterval`, so forged key ids don't reach the database.
+ */
+func (ks *MongoKeystore) PublicKey(kid string) (crypto.PublicKey, error) {
+	if keyInfo, ok := ks.cachedPublicKey(kid); ok {
+		return keyInfo.PublicKey, nil
+	}
+
+	ks.listing.Lock()
+	defer ks.listing.Unlock()
+
+	// the collection could have been listed while waiting
+	ks.mu.RLock()
+	listedAt := ks.listedAt
+	ks.mu.RUnlock()
+
+	if time.Since(listedAt) >= keyListInterval {
+		if _, err := ks.PublicKeys(); err != nil {
+			return nil, err
+		}
+	}
+
+	if keyInfo, ok := ks.cachedPublicKey(kid); ok {
+		return keyInfo.PublicKey, nil
+	}
+	return nil, fmt.Errorf("Key %q not registered", kid)
+}
+
+// Returns the public key from the cache, if not expired
+func (ks *MongoKeystore) cachedPublicKey(kid string) (*PublicKeyInfo, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	cached, ok := ks.public[kid]
+	if !ok || time.Since(cached.fetchedAt) >= keyCacheTTL {
+		return nil, false
+	}
+	return cached.info, true
+}
+
+/**
+ * List the public keys stored in the collection, including the ones
+ * generated by other instances. The cached keys not listed anymore,
+ * deleted by other instances, are evicted.
+ */
+func (ks *MongoKeystore) PublicKeys() ([]*PublicKeyInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	cursor, err := ks.collection.Find(
+		ctx,
+		bson.D{},
+		options.Find().SetProjection(bson.D{{Key: "private_key", Value: 0}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list keys: %v", err)
+	}
+
+	var stored []storedKey
+	if err := cursor.All(ctx, &stored); err != nil {
+		return nil, fmt.Errorf("Unable to list keys: %v", err)
+	}
+
+	keys := make([]*PublicKeyInfo, 0, len(stored))
+	for i := range stored {
+		keyInfo, err := publicKeyInfo(&stored[i])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, keyInfo)
+	}
+
+	ks.refreshCache(keys)
+	return keys, nil
+}
+
+// Replaces the cached public keys with the listed ones, evicting the others
+func (ks *MongoKeystore) refreshCache(keys []*PublicKeyInfo) {
+	now := time.Now()
+	public := make(map[string]cachedPublicKey, len(keys))
+	for _, keyInfo := range keys {
+		public[keyInfo.KeyID] = cachedPublicKey{info: keyInfo, fetchedAt: now}
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.public = public
+	ks.listedAt = now
+	for kid, cached := range ks.keys {
+		if _, ok := public[kid]; !ok {
+			delete(ks.keys, kid)
+		} else {
+			ks.keys[kid] = cachedPrivateKey{info: cached.info, fetchedAt: now}
+		}
+	}
+	for alg, signing := range ks.signing {
+		if _, ok := public[signing.kid]; !ok {
+			delete(ks.signing, alg)
+		}
+	}
+}
+
+/**
+ * Signing keys are generated on demand, so all the asymmetric
+ * algorithms are supported
+ */
+func (ks *MongoKeystore) SigningAlgorithms() []string {
+	return append([]string{}, asymmetricAlgorithms...)
+}
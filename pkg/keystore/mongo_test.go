@@ -0,0 +1,197 @@
+package keystore_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/jwk"
+	"github.com/ale-cci/oauthsrv/pkg/keystore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gotest.tools/assert"
+)
+
+// Database used by the keystore tests, dropped at the end of each test
+func testDatabase(t *testing.T) *mongo.Database {
+	connStr := os.Getenv("MONGO_CONNSTR")
+	if connStr == "" {
+		t.Skip("MONGO_CONNSTR not set")
+	}
+
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(connStr))
+	assert.NilError(t, err)
+
+	db := client.Database("test-keystore")
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return db
+}
+
+func testKEK(fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, keystore.KEKSize)
+}
+
+func TestMongoKeystore(t *testing.T) {
+	t.Run("key-encryption key should be 32 bytes long", func(t *testing.T) {
+		_, err := keystore.NewMongoKeystore(nil, []byte("short"))
+		assert.Check(t, err != nil)
+	})
+
+	t.Run("instances should share the signing key", func(t *testing.T) {
+		db := testDatabase(t)
+
+		ks1, err := keystore.NewMongoKeystore(db, testKEK(1))
+		assert.NilError(t, err)
+		ks2, err := keystore.NewMongoKeystore(db, testKEK(1))
+		assert.NilError(t, err)
+
+		key1, err := ks1.GetSigningKey("ES256")
+		assert.NilError(t, err)
+		key2, err := ks2.GetSigningKey("ES256")
+		assert.NilError(t, err)
+
+		assert.Equal(t, key1.KeyID, key2.KeyID)
+
+		pubKey, err := ks2.PublicKey(key1.KeyID)
+		assert.NilError(t, err)
+		thumbprint, err := jwk.Thumbprint(pubKey)
+		assert.NilError(t, err)
+		assert.Equal(t, thumbprint, key1.KeyID)
+	})
+
+	t.Run("keys generated by other instances should be listed", func(t *testing.T) {
+		db := testDatabase(t)
+
+		ks1, err := keystore.NewMongoKeystore(db, testKEK(1))
+		assert.NilError(t, err)
+		ks2, err := keystore.NewMongoKeystore(db, testKEK(1))
+		assert.NilError(t, err)
+
+		_, err = ks1.GetSigningKey("RS256")
+		assert.NilError(t, err)
+		_, err = ks1.GetSigningKey("EdDSA")
+		assert.NilError(t, err)
+
+		keys, err := ks2.PublicKeys()
+		assert.NilError(t, err)
+		assert.Equal(t, len(keys), 2)
+	})
+
+	t.Run("private keys should be encrypted at rest", func(t *testing.T) {
+		db := testDatabase(t)
+
+		ks, err := keystore.NewMongoKeystore(db, testKEK(1))
+		assert.NilError(t, err)
+		key, err := ks.GetSigningKey("EdDSA")
+		assert.NilError(t, err)
+
+		var stored bson.M
+		err = db.Collection("keys").FindOne(
+			context.Background(),
+			bson.D{{Key: "_id", Value: key.KeyID}},
+		).Decode(&stored)
+		assert.NilError(t, err)
+		assert.Check(t, stored["private_key"] != nil)
+
+		other, err := keystore.NewMongoKeystore(db, testKEK(2))
+		assert.NilError(t, err)
+
+		_, err = other.PrivateKey(key.KeyID)
+		assert.Check(t, err != nil)
+
+		// public keys are readable without the key-encryption key
+		_, err = other.PublicKey(key.KeyID)
+		assert.NilError(t, err)
+	})
+
+	t.Run("signing key lookup should be indexed", func(t *testing.T) {
+		db := testDatabase(t)
+
+		_, err := keystore.NewMongoKeystore(db, testKEK(1))
+		assert.NilError(t, err)
+
+		cursor, err := db.Collection("keys").Indexes().List(context.Background())
+		assert.NilError(t, err)
+
+		var indexes []bson.M
+		assert.NilError(t, cursor.All(context.Background(), &indexes))
+
+		found := false
+		for _, index := range indexes {
+			keys, _ := index["key"].(bson.M)
+			found = found || (keys["alg"] != nil && keys["created_at"] != nil)
+		}
+		assert.Check(t, found, "missing index on alg and created_at")
+	})
+
+	t.Run("keys deleted by other instances should be evicted", func(t *testing.T) {
+		db := testDatabase(t)
+
+		ks1, err := keystore.NewMongoKeystore(db, testKEK(1))
+		assert.NilError(t, err)
+		ks2, err := keystore.NewMongoKeystore(db, testKEK(1))
+		assert.NilError(t, err)
+
+		key, err := ks1.GetSigningKey("ES256")
+		assert.NilError(t, err)
+
+		_, err = ks2.PublicKey(key.KeyID)
+		assert.NilError(t, err)
+		_, err = ks2.PrivateKey(key.KeyID)
+		assert.NilError(t, err)
+
+		assert.NilError(t, ks1.DeleteKey(key.KeyID))
+
+		keys, err := ks2.PublicKeys()
+		assert.NilError(t, err)
+		assert.Equal(t, len(keys), 0)
+
+		_, err = ks2.PublicKey(key.KeyID)
+		assert.Check(t, err != nil)
+		_, err = ks2.PrivateKey(key.KeyID)
+		assert.Check(t, err != nil)
+	})
+
+	t.Run("unknown key ids should not be looked up on each request", func(t *testing.T) {
+		db := testDatabase(t)
+
+		ks1, err := keystore.NewMongoKeystore(db, testKEK(1))
+		assert.NilError(t, err)
+		ks2, err := keystore.NewMongoKeystore(db, testKEK(1))
+		assert.NilError(t, err)
+
+		_, err = ks1.PublicKey("forged-kid")
+		assert.Check(t, err != nil)
+
+		// the collection was just listed, the new key is not known yet
+		key, err := ks2.AddKey("ES256")
+		assert.NilError(t, err)
+		_, err = ks1.PublicKey(key.KeyID)
+		assert.Check(t, err != nil)
+
+		// signing keys are known right away by the instance using them
+		signing, err := ks1.GetSigningKey("EdDSA")
+		assert.NilError(t, err)
+		_, err = ks1.PublicKey(signing.KeyID)
+		assert.NilError(t, err)
+	})
+
+	t.Run("unknown keys should return error", func(t *testing.T) {
+		db := testDatabase(t)
+
+		ks, err := keystore.NewMongoKeystore(db, testKEK(1))
+		assert.NilError(t, err)
+
+		_, err = ks.PublicKey("random-kid")
+		assert.Check(t, err != nil)
+		_, err = ks.PrivateKey("random-kid")
+		assert.Check(t, err != nil)
+		_, err = ks.GetSigningKey("HS256")
+		assert.Check(t, err != nil)
+	})
+}
@@ -0,0 +1,296 @@
+package keystore
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+ * Lifecycle of the keys of a `RotatingKeystore`:
+ * - keys are published `PublishDelay` before being used for signing, so
+ *   consumers caching the key set for at most that long always know them;
+ * - each key signs tokens for `Interval`, then the next key takes its place;
+ * - retired keys are still published for `Retention`, which should be longer
+ *   than the lifetime of the issued tokens, then they're deleted.
+ */
+type RotationPolicy struct {
+	Interval     time.Duration
+	PublishDelay time.Duration
+	Retention    time.Duration
+}
+
+func (p RotationPolicy) validate() error {
+	if p.Interval <= 0 || p.PublishDelay <= 0 || p.Retention <= 0 {
+		return fmt.Errorf("Rotation durations should be positive")
+	}
+
+	if p.PublishDelay >= p.Interval {
+		return fmt.Errorf("Publish delay should be shorter than the rotation interval")
+	}
+	return nil
+}
+
+// When the key starts to be used for signing
+func (p RotationPolicy) activeAt(key *PublicKeyInfo) time.Time {
+	return key.CreatedAt.Add(p.PublishDelay)
+}
+
+/**
+ * Keystore rotating the signing keys of the underlying keystore, following
+ * the rotation policy. Rotation is driven by `Run`, new keys are generated
+ * ahead of time and old keys are deleted once retired.
+ *
+ * Every instance sharing the same underlying keystore selects the same
+ * signing key, as the choice depends only on the creation time of the keys.
+ */
+type RotatingKeystore struct {
+	Keystore ManagedKeystore
+	Policy   RotationPolicy
+
+	// serializes the generation of new keys
+	rotating sync.Mutex
+
+	mu   sync.RWMutex
+	keys map[string][]*PublicKeyInfo // keys by algorithm, most recent first
+}
+
+func NewRotatingKeystore(ks ManagedKeystore, policy RotationPolicy) (*RotatingKeystore, error) {
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+
+	return &RotatingKeystore{
+		Keystore: ks,
+		Policy:   policy,
+	}, nil
+}
+
+// Reads again the keys of the underlying keystore
+func (ks *RotatingKeystore) refresh() (map[string][]*PublicKeyInfo, error) {
+	keys, err := ks.Keystore.PublicKeys()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list keys: %v", err)
+	}
+
+	byAlg := make(map[string][]*PublicKeyInfo)
+	for _, key := range keys {
+		byAlg[key.Alg] = append(byAlg[key.Alg], key)
+	}
+
+	for _, algKeys := range byAlg {
+		sort.Slice(algKeys, func(i, j int) bool {
+			if algKeys[i].CreatedAt.Equal(algKeys[j].CreatedAt) {
+				return algKeys[i].KeyID < algKeys[j].KeyID
+			}
+			return algKeys[i].CreatedAt.After(algKeys[j].CreatedAt)
+		})
+	}
+
+	ks.mu.Lock()
+	ks.keys = byAlg
+	ks.mu.Unlock()
+	return byAlg, nil
+}
+
+/**
+ * Index of the signing key among the keys of an algorithm, the most recent
+ * active key. Returns -1 if there are no active keys.
+ */
+func (ks *RotatingKeystore) signingIndex(algKeys []*PublicKeyInfo, now time.Time) int {
+	for i, key := range algKeys {
+		if !ks.Policy.activeAt(key).After(now) {
+			return i
+		}
+	}
+	return -1
+}
+
+/**
+ * Generates the next key of each algorithm in use, and deletes the keys
+ * retired for longer than the retention period.
+ */
+func (ks *RotatingKeystore) Rotate() error {
+	ks.rotating.Lock()
+	defer ks.rotating.Unlock()
+
+	keys, err := ks.refresh()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	changed := false
+
+	for alg, algKeys := range keys {
+		// the next key is published ahead of time, to be active
+		// when the interval of the current key elapses
+		newest := algKeys[0]
+		if !newest.CreatedAt.Add(ks.Policy.Interval - ks.Policy.PublishDelay).After(now) {
+			if _, err := ks.Keystore.AddKey(alg); err != nil {
+				return fmt.Errorf("Unable to rotate %s key: %v", alg, err)
+			}
+			changed = true
+		}
+
+		signing := ks.signingIndex(algKeys, now)
+		if signing < 0 {
+			continue
+		}
+
+		// keys older than the signing key are retired since the next key became active
+		for i := signing + 1; i < len(algKeys); i++ {
+			retiredAt := ks.Policy.activeAt(algKeys[i-1])
+			if retiredAt.Add(ks.Policy.Retention).After(now) {
+				continue
+			}
+
+			if err := ks.Keystore.DeleteKey(algKeys[i].KeyID); err != nil {
+				return fmt.Errorf("Unable to delete retired key: %v", err)
+			}
+			changed = true
+		}
+	}
+
+	if changed {
+		_, err = ks.refresh()
+	}
+	return err
+}
+
+/**
+ * Rotates the keys every interval, until the context is done. The interval
+ * should be shorter than the publish delay, so keys generated by other
+ * instances are known before being used.
+ */
+func (ks *RotatingKeystore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := ks.Rotate(); err != nil {
+				log.Printf("Unable to rotate keys: %v", err)
+			}
+		}
+	}
+}
+
+// Key used to sign tokens, or nil if the algorithm has no keys
+func (ks *RotatingKeystore) signingKey(keys map[string][]*PublicKeyInfo, alg string) *PublicKeyInfo {
+	algKeys := keys[alg]
+	if len(algKeys) == 0 {
+		return nil
+	}
+
+	if i := ks.signingIndex(algKeys, time.Now()); i >= 0 {
+		return algKeys[i]
+	}
+
+	// No key is active yet when the algorithm is used for the first time:
+	// tokens of this algorithm were never issued, so no consumer could
+	// have cached a key set without the key.
+	return algKeys[len(algKeys)-1]
+}
+
+/**
+ * Returns the active signing key of the algorithm. Keys are generated
+ * only when the algorithm has none, following keys are generated by `Rotate`.
+ */
+func (ks *RotatingKeystore) GetSigningKey(alg string) (*PrivateKeyInfo, error) {
+	if !contains(asymmetricAlgorithms, alg) {
+		return nil, fmt.Errorf("Signing algorithm not recognize")
+	}
+
+	ks.mu.RLock()
+	key := ks.signingKey(ks.keys, alg)
+	ks.mu.RUnlock()
+
+	if key == nil {
+		var err error
+		key, err = ks.firstKey(alg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signer, err := ks.Keystore.PrivateKey(key.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PrivateKeyInfo{
+		Alg:        key.Alg,
+		KeyID:      key.KeyID,
+		PrivateKey: signer,
+		CreatedAt:  key.CreatedAt,
+	}, nil
+}
+
+// Generates the first key of the algorithm, if no instance did it already
+func (ks *RotatingKeystore) firstKey(alg string) (*PublicKeyInfo, error) {
+	ks.rotating.Lock()
+	defer ks.rotating.Unlock()
+
+	keys, err := ks.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	if key := ks.signingKey(keys, alg); key != nil {
+		return key, nil
+	}
+
+	if _, err := ks.Keystore.AddKey(alg); err != nil {
+		return nil, err
+	}
+
+	keys, err = ks.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	if key := ks.signingKey(keys, alg); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("No keys available for %s", alg)
+}
+
+func (ks *RotatingKeystore) PrivateKey(kid string) (crypto.Signer, error) {
+	return ks.Keystore.PrivateKey(kid)
+}
+
+func (ks *RotatingKeystore) PublicKey(kid string) (crypto.PublicKey, error) {
+	return ks.Keystore.PublicKey(kid)
+}
+
+/**
+ * Lists all the keys not yet deleted: the ones to be used, the signing
+ * keys and the retired ones.
+ */
+func (ks *RotatingKeystore) PublicKeys() ([]*PublicKeyInfo, error) {
+	return ks.Keystore.PublicKeys()
+}
+
+/**
+ * Signing keys are generated on demand, so all the asymmetric
+ * algorithms are supported
+ */
+func (ks *RotatingKeystore) SigningAlgorithms() []string {
+	return append([]string{}, asymmetricAlgorithms...)
+}
+
+/**
+ * Consumers could cache the key set until the next key is used for signing
+ */
+func (ks *RotatingKeystore) CacheMaxAge() time.Duration {
+	return ks.Policy.PublishDelay
+}
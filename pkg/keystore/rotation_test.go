@@ -0,0 +1,143 @@
+package keystore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ale-cci/oauthsrv/pkg/keystore"
+	"gotest.tools/assert"
+)
+
+var testPolicy = keystore.RotationPolicy{
+	Interval:     24 * time.Hour,
+	PublishDelay: time.Hour,
+	Retention:    2 * time.Hour,
+}
+
+func newRotatingKeystore(t *testing.T) (*keystore.RotatingKeystore, *keystore.TempKeystore) {
+	temp, err := keystore.NewTempKeystore()
+	assert.NilError(t, err)
+
+	ks, err := keystore.NewRotatingKeystore(temp, testPolicy)
+	assert.NilError(t, err)
+	return ks, temp
+}
+
+// Moves the creation time of the key in the past
+func backdate(temp *keystore.TempKeystore, kid string, d time.Duration) {
+	temp.Keys[kid].CreatedAt = time.Now().Add(-d)
+}
+
+func TestRotatingKeystore(t *testing.T) {
+	t.Run("publish delay should be shorter than the interval", func(t *testing.T) {
+		temp, err := keystore.NewTempKeystore()
+		assert.NilError(t, err)
+
+		_, err = keystore.NewRotatingKeystore(temp, keystore.RotationPolicy{
+			Interval:     time.Hour,
+			PublishDelay: 2 * time.Hour,
+			Retention:    time.Hour,
+		})
+		assert.Check(t, err != nil)
+	})
+
+	t.Run("first key of an algorithm should be used immediately", func(t *testing.T) {
+		ks, _ := newRotatingKeystore(t)
+
+		fst, err := ks.GetSigningKey("ES256")
+		assert.NilError(t, err)
+		snd, err := ks.GetSigningKey("ES256")
+		assert.NilError(t, err)
+
+		assert.Equal(t, fst.KeyID, snd.KeyID)
+	})
+
+	t.Run("key should not be rotated before the interval", func(t *testing.T) {
+		ks, temp := newRotatingKeystore(t)
+
+		_, err := ks.GetSigningKey("ES256")
+		assert.NilError(t, err)
+
+		assert.NilError(t, ks.Rotate())
+		assert.Equal(t, len(temp.Keys), 1)
+	})
+
+	t.Run("next key should be published before being used", func(t *testing.T) {
+		ks, temp := newRotatingKeystore(t)
+
+		current, err := ks.GetSigningKey("ES256")
+		assert.NilError(t, err)
+		backdate(temp, current.KeyID, 23*time.Hour+30*time.Minute)
+
+		assert.NilError(t, ks.Rotate())
+
+		keys, err := ks.PublicKeys()
+		assert.NilError(t, err)
+		assert.Equal(t, len(keys), 2)
+
+		signing, err := ks.GetSigningKey("ES256")
+		assert.NilError(t, err)
+		assert.Equal(t, signing.KeyID, current.KeyID)
+	})
+
+	t.Run("next key should be used once the publish delay elapsed", func(t *testing.T) {
+		ks, temp := newRotatingKeystore(t)
+
+		current, err := ks.GetSigningKey("ES256")
+		assert.NilError(t, err)
+		backdate(temp, current.KeyID, 24*time.Hour)
+		assert.NilError(t, ks.Rotate())
+
+		var next string
+		for kid := range temp.Keys {
+			if kid != current.KeyID {
+				next = kid
+			}
+		}
+		backdate(temp, next, time.Hour)
+		assert.NilError(t, ks.Rotate())
+
+		signing, err := ks.GetSigningKey("ES256")
+		assert.NilError(t, err)
+		assert.Equal(t, signing.KeyID, next)
+
+		// retired keys could still be used for verification
+		_, err = ks.PublicKey(current.KeyID)
+		assert.NilError(t, err)
+	})
+
+	t.Run("retired keys should be deleted after the retention", func(t *testing.T) {
+		ks, temp := newRotatingKeystore(t)
+
+		old, err := temp.AddKey("RS256")
+		assert.NilError(t, err)
+		retired, err := temp.AddKey("RS256")
+		assert.NilError(t, err)
+		current, err := temp.AddKey("RS256")
+		assert.NilError(t, err)
+
+		backdate(temp, old.KeyID, 50*time.Hour)
+		backdate(temp, retired.KeyID, 26*time.Hour) // active 25 hours ago
+		backdate(temp, current.KeyID, 2*time.Hour)  // active 1 hour ago
+
+		assert.NilError(t, ks.Rotate())
+
+		_, err = ks.PublicKey(old.KeyID)
+		assert.Check(t, err != nil)
+		_, err = ks.PublicKey(retired.KeyID)
+		assert.NilError(t, err)
+
+		signing, err := ks.GetSigningKey("RS256")
+		assert.NilError(t, err)
+		assert.Equal(t, signing.KeyID, current.KeyID)
+	})
+
+	t.Run("key set should be cached up to the publish delay", func(t *testing.T) {
+		ks, _ := newRotatingKeystore(t)
+		assert.Equal(t, ks.CacheMaxAge(), testPolicy.PublishDelay)
+	})
+}
+
+var _ keystore.ManagedKeystore = &keystore.TempKeystore{}
+var _ keystore.ManagedKeystore = &keystore.MongoKeystore{}
+var _ keystore.Keystore = &keystore.RotatingKeystore{}
@@ -1,26 +1,120 @@
 /**
- * Minimal router package, only intent is to add support for url parameters.
+ * Minimal router package, only intent is to add support for url parameters
+ * and method routing. Routes are stored in a segment tree, so the matched
+ * route doesn't depend on the registration order.
  */
 package mux
 
 import (
 	"context"
 	"net/http"
-	"regexp"
+	"net/url"
+	"sort"
+	"strings"
 )
 
-const varsContextKey string = "vars"
+// Private type of the context keys, so they could not collide with other packages
+type contextKey int
+
+const varsContextKey contextKey = 0
+
+// handlers registered with `HandleFunc` serve any method
+const anyMethod = ""
+
+/**
+ * Wraps a handler, e.g. to share authentication or logging among routes
+ */
+type Middleware func(http.Handler) http.Handler
+
+type route struct {
+	pattern string
+
+	// names of the parameters, in the order they're matched
+	names []string
+
+	// handlers by method
+	handlers map[string]http.Handler
+}
+
+func newRoute(pattern string, names []string) *route {
+	return &route{
+		pattern:  pattern,
+		names:    names,
+		handlers: map[string]http.Handler{},
+	}
+}
+
+/**
+ * Patterns matching the same paths with different parameter names
+ * could not be distinguished
+ */
+func (rt *route) check(pattern string) *route {
+	if rt.pattern != pattern {
+		panic("mux: pattern " + pattern + " overlaps with " + rt.pattern)
+	}
+	return rt
+}
 
 type Router struct {
-	handlers map[*regexp.Regexp]http.HandlerFunc
+	root *node
+
+	// routes by name, shared with the groups
+	named map[string]*route
+
+	// prepended to the patterns of the router
+	prefix      string
+	middlewares []Middleware
+
+	// middlewares could not be added after registering routes or groups
+	sealed bool
 }
 
 func NewServeMux() *Router {
 	return &Router{
-		handlers: map[*regexp.Regexp]http.HandlerFunc{},
+		root:  newNode(),
+		named: map[string]*route{},
 	}
 }
 
+/**
+ * Adds middlewares to the routes of the router and of its groups, the
+ * first one is the outermost. Only the middlewares of the main router
+ * wrap the responses to unknown paths and methods. Should be called
+ * before registering any route.
+ */
+func (router *Router) Use(middlewares ...Middleware) {
+	if router.sealed {
+		panic("mux: middlewares should be added before the routes")
+	}
+	router.middlewares = append(router.middlewares, middlewares...)
+}
+
+/**
+ * Returns a router registering its routes with the prefix, wrapped by
+ * the middlewares of the parent router and the given ones.
+ */
+func (router *Router) Group(prefix string, middlewares ...Middleware) *Router {
+	router.sealed = true
+
+	return &Router{
+		root:        router.root,
+		named:       router.named,
+		prefix:      router.prefix + prefix,
+		middlewares: append(append([]Middleware{}, router.middlewares...), middlewares...),
+	}
+}
+
+// Wraps the handler with the middlewares of the router
+func (router *Router) chain(handler http.Handler) http.Handler {
+	for i := len(router.middlewares) - 1; i >= 0; i-- {
+		handler = router.middlewares[i](handler)
+	}
+	return handler
+}
+
+/**
+ * Returns the path parameters of the request, unescaped
+ */
 func Vars(r *http.Request) map[string]string {
 	if params := r.Context().Value(varsContextKey); params != nil {
 		return params.(map[string]string)
@@ -28,35 +122,157 @@ func Vars(r *http.Request) map[string]string {
 	return map[string]string{}
 }
 
-func (router *Router) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
-	reg := regexp.MustCompile("^" + pattern + "$")
-	router.handlers[reg] = handler
+/**
+ * Registers the handler for requests with the given method and path matching
+ * the pattern. Handlers for GET requests serve HEAD requests as well, when no
+ * other handler is registered for them.
+ */
+func (router *Router) Handle(method, pattern string, handler http.Handler) *Route {
+	if method == anyMethod {
+		panic("mux: empty method for pattern " + pattern)
+	}
+	return router.handle(strings.ToUpper(method), pattern, handler)
 }
 
-func matchURL(pattern *regexp.Regexp, url string) (map[string]string, bool) {
-	if !pattern.MatchString(url) {
-		return nil, false
+/**
+ * Registers the handler for requests with any method and path matching
+ * the pattern.
+ */
+func (router *Router) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) *Route {
+	return router.handle(anyMethod, pattern, http.HandlerFunc(handler))
+}
+
+func (router *Router) handle(method, pattern string, handler http.Handler) *Route {
+	router.sealed = true
+	pattern = router.prefix + pattern
+
+	rt := router.root.insert(pattern)
+	if _, ok := rt.handlers[method]; ok {
+		panic("mux: multiple registrations for " + strings.TrimSpace(method+" "+pattern))
 	}
+	rt.handlers[method] = router.chain(handler)
+	return &Route{route: rt, named: router.named}
+}
 
-	matches := pattern.FindStringSubmatch(url)
-	params := make(map[string]string)
+/**
+ * Registered route, could be named to build its urls with `Router.URL`
+ */
+type Route struct {
+	route *route
+	named map[string]*route
+}
+
+/**
+ * Names the route, names are unique among the router and its groups
+ */
+func (r *Route) Name(name string) *Route {
+	if existing, ok := r.named[name]; ok && existing != r.route {
+		panic("mux: multiple routes named " + name)
+	}
+	r.named[name] = r.route
+	return r
+}
+
+/**
+ * Returns the handler of the request method, nil if the method is
+ * not allowed
+ */
+func (rt *route) handler(method string) http.Handler {
+	if handler, ok := rt.handlers[method]; ok {
+		return handler
+	}
 
-	for i, name := range pattern.SubexpNames() {
-		if i > 0 && i <= len(matches) {
-			params[name] = matches[i]
+	if method == "HEAD" {
+		if handler, ok := rt.handlers["GET"]; ok {
+			return handler
 		}
 	}
+	return rt.handlers[anyMethod]
+}
+
+// Value of the `Allow` header, methods supported by the route
+func (rt *route) allow() string {
+	methods := []string{"OPTIONS"}
+	for method := range rt.handlers {
+		methods = append(methods, method)
+	}
 
-	return params, true
+	if _, ok := rt.handlers["GET"]; ok && !contains(methods, "HEAD") {
+		methods = append(methods, "HEAD")
+	}
+
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
 }
 
-func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	for reg, handler := range router.handlers {
-		if params, ok := matchURL(reg, r.URL.EscapedPath()); ok {
-			ctx := context.WithValue(r.Context(), varsContextKey, params)
-			handler(w, r.WithContext(ctx))
-			return
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Returns the route matching the path, with its parameters
+ */
+func (router *Router) match(path string) (*route, map[string]string) {
+	rt, values := router.root.lookup(strings.Split(path, "/"), nil)
+	if rt == nil {
+		return nil, nil
+	}
+
+	params := make(map[string]string)
+	for i, name := range rt.names {
+		if name == "" {
+			continue
+		}
+
+		// paths are matched escaped, so `%2F` does not split segments
+		value, err := url.PathUnescape(values[i])
+		if err != nil {
+			value = values[i]
 		}
+		params[name] = value
+	}
+	return rt, params
+}
+
+/**
+ * Requests with methods not registered for the route get a 405 response,
+ * OPTIONS requests are answered with the allowed methods.
+ */
+func (rt *route) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("allow", rt.allow())
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
+
+/**
+ * Dispatches the request to the handler of the matching route
+ */
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt, params := router.match(r.URL.EscapedPath())
+	if rt == nil {
+		router.chain(http.HandlerFunc(notFound)).ServeHTTP(w, r)
+		return
+	}
+
+	handler := rt.handler(r.Method)
+	if handler == nil {
+		// group middlewares, e.g. authentication, are meant for the routes
+		handler = router.chain(http.HandlerFunc(rt.methodNotAllowed))
+	}
+
+	ctx := context.WithValue(r.Context(), varsContextKey, params)
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
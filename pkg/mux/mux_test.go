@@ -1,6 +1,7 @@
 package mux_test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -66,3 +67,344 @@ func TestMux(t *testing.T) {
 		assert.Equal(t, string(body), "hello from the_value")
 	})
 }
+
+func TestMethods(t *testing.T) {
+	router := mux.NewServeMux()
+	respond := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		})
+	}
+	router.Handle("GET", "/items", respond("list"))
+	router.Handle("POST", "/items", respond("create"))
+	router.Handle("DELETE", "/items/(?P<id>\\w+)", respond("delete"))
+	router.HandleFunc("/any", respond("any").ServeHTTP)
+
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	do := func(t *testing.T, method, path string) (*http.Response, string) {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		assert.NilError(t, err)
+
+		resp, err := srv.Client().Do(req)
+		assert.NilError(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NilError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("should dispatch by method", func(t *testing.T) {
+		_, body := do(t, "GET", "/items")
+		assert.Equal(t, body, "list")
+
+		_, body = do(t, "POST", "/items")
+		assert.Equal(t, body, "create")
+	})
+
+	t.Run("get handlers should serve head requests", func(t *testing.T) {
+		resp, _ := do(t, "HEAD", "/items")
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+	})
+
+	t.Run("should return 405 with the allowed methods", func(t *testing.T) {
+		resp, _ := do(t, "PUT", "/items")
+		assert.Equal(t, resp.StatusCode, http.StatusMethodNotAllowed)
+		assert.Equal(t, resp.Header.Get("allow"), "GET, HEAD, OPTIONS, POST")
+
+		resp, _ = do(t, "GET", "/items/1")
+		assert.Equal(t, resp.StatusCode, http.StatusMethodNotAllowed)
+		assert.Equal(t, resp.Header.Get("allow"), "DELETE, OPTIONS")
+	})
+
+	t.Run("should answer options requests", func(t *testing.T) {
+		resp, _ := do(t, "OPTIONS", "/items")
+		assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+		assert.Equal(t, resp.Header.Get("allow"), "GET, HEAD, OPTIONS, POST")
+	})
+
+	t.Run("handle func should serve any method", func(t *testing.T) {
+		for _, method := range []string{"GET", "POST", "PATCH"} {
+			resp, body := do(t, method, "/any")
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+			assert.Equal(t, body, "any")
+		}
+	})
+
+	t.Run("should return 404 when no path matches", func(t *testing.T) {
+		resp, _ := do(t, "POST", "/missing")
+		assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+	})
+
+	t.Run("duplicate registrations should panic", func(t *testing.T) {
+		defer func() {
+			assert.Check(t, recover() != nil)
+		}()
+		router.Handle("GET", "/items", respond("again"))
+	})
+}
+
+func TestPriority(t *testing.T) {
+	router := mux.NewServeMux()
+	respond := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %v", r.Context().Value(patternKey{}), mux.Vars(r))
+	}
+	register := func(pattern string) {
+		router.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			respond(w, r.WithContext(context.WithValue(r.Context(), patternKey{}, pattern)))
+		})
+	}
+
+	// registered in reverse priority order
+	register("/files/*")
+	register("/users/(?P<id>[\\w-]+)/groups/(?P<group>[\\w:-]+)")
+	register("/users/(?P<user_id>[\\w-]+)")
+	register("/users/me")
+	register("/users/me/settings")
+
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	tt := []struct {
+		Path string
+		Want string
+	}{
+		{"/users/me", "/users/me map[]"},
+		{"/users/someone", "/users/(?P<user_id>[\\w-]+) map[user_id:someone]"},
+		{"/users/me/groups/admin", "/users/(?P<id>[\\w-]+)/groups/(?P<group>[\\w:-]+) map[group:admin id:me]"},
+		{"/users/me/settings", "/users/me/settings map[]"},
+		{"/files/a/b.txt", "/files/* map[*:a/b.txt]"},
+		{"/files/", "/files/* map[*:]"},
+	}
+
+	// results should not change between runs
+	for i := 0; i < 20; i++ {
+		for _, tc := range tt {
+			resp, err := srv.Client().Get(srv.URL + tc.Path)
+			assert.NilError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NilError(t, err)
+			assert.Equal(t, string(body), tc.Want)
+		}
+	}
+
+	for _, path := range []string{"/users", "/users/a/b", "/users/a!b", "/files"} {
+		resp, err := srv.Client().Get(srv.URL + path)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusNotFound, path)
+	}
+}
+
+type patternKey struct{}
+
+func TestOverlappingPatterns(t *testing.T) {
+	tt := []struct {
+		Name     string
+		Patterns []string
+	}{
+		{"different parameters", []string{"/users/(?P<id>\\d+)", "/users/(?P<name>\\w+)"}},
+		{"different parameter names", []string{"/users/(?P<id>\\w+)", "/users/(?P<user_id>\\w+)"}},
+		{"wildcard not at the end", []string{"/files/*/meta"}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			defer func() {
+				assert.Check(t, recover() != nil, "expected panic")
+			}()
+
+			router := mux.NewServeMux()
+			for _, pattern := range tc.Patterns {
+				router.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {})
+			}
+		})
+	}
+
+	t.Run("same parameter in different routes", func(t *testing.T) {
+		router := mux.NewServeMux()
+		router.HandleFunc("/users/(?P<id>[\\w-]+)", func(w http.ResponseWriter, r *http.Request) {})
+		router.HandleFunc("/users/(?P<user_id>[\\w-]+)/groups", func(w http.ResponseWriter, r *http.Request) {})
+	})
+}
+
+// Middleware appending its name to the `trace` header
+func tracing(name string) mux.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("trace", name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	router := mux.NewServeMux()
+	router.Use(tracing("root"))
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(mux.Vars(r)["id"]))
+	}
+	router.Handle("GET", "/public", http.HandlerFunc(ok))
+
+	api := router.Group("/api", tracing("api"))
+	api.Use(tracing("auth"))
+	api.Handle("GET", "/items/(?P<id>\\w+)", http.HandlerFunc(ok))
+
+	v1 := api.Group("/v1", tracing("v1"))
+	v1.Handle("GET", "/items", http.HandlerFunc(ok))
+
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	tt := []struct {
+		Method string
+		Path   string
+		Status int
+		Trace  []string
+	}{
+		{"GET", "/public", http.StatusOK, []string{"root"}},
+		{"GET", "/api/items/1", http.StatusOK, []string{"root", "api", "auth"}},
+		{"GET", "/api/v1/items", http.StatusOK, []string{"root", "api", "auth", "v1"}},
+		{"OPTIONS", "/api/v1/items", http.StatusNoContent, []string{"root"}},
+		{"POST", "/api/items/1", http.StatusMethodNotAllowed, []string{"root"}},
+		{"GET", "/api/missing", http.StatusNotFound, []string{"root"}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Method+" "+tc.Path, func(t *testing.T) {
+			req, err := http.NewRequest(tc.Method, srv.URL+tc.Path, nil)
+			assert.NilError(t, err)
+
+			resp, err := srv.Client().Do(req)
+			assert.NilError(t, err)
+			assert.Equal(t, resp.StatusCode, tc.Status)
+			assert.DeepEqual(t, resp.Header.Values("trace"), tc.Trace)
+		})
+	}
+
+	t.Run("params should be available to the handler", func(t *testing.T) {
+		resp, err := srv.Client().Get(srv.URL + "/api/items/abc")
+		assert.NilError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NilError(t, err)
+		assert.Equal(t, string(body), "abc")
+	})
+
+	t.Run("middlewares should not be added after the routes", func(t *testing.T) {
+		defer func() {
+			assert.Check(t, recover() != nil, "expected panic")
+		}()
+		api.Use(tracing("late"))
+	})
+}
+
+func TestTypedParams(t *testing.T) {
+	router := mux.NewServeMux()
+	vars := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v", mux.Vars(r))
+	}
+	router.HandleFunc("/users/{user_id}/groups", vars)
+	router.HandleFunc("/items/{id:uuid}", vars)
+	router.HandleFunc("/pages/{n:int}", vars)
+	router.HandleFunc("/files/{name}.json", vars)
+
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	tt := []struct {
+		Path   string
+		Status int
+		Body   string
+	}{
+		{"/users/a.b@c/groups", http.StatusOK, "map[user_id:a.b@c]"},
+		{"/users/a%20b%2Fc/groups", http.StatusOK, "map[user_id:a b/c]"},
+		{"/items/3f0b8e0a-6c1d-4e3b-9a52-0f7c2b9d1e44", http.StatusOK, "map[id:3f0b8e0a-6c1d-4e3b-9a52-0f7c2b9d1e44]"},
+		{"/items/not-a-uuid", http.StatusNotFound, ""},
+		{"/pages/12", http.StatusOK, "map[n:12]"},
+		{"/pages/twelve", http.StatusNotFound, ""},
+		{"/files/config.json", http.StatusOK, "map[name:config]"},
+		{"/files/configxjson", http.StatusNotFound, ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Path, func(t *testing.T) {
+			resp, err := srv.Client().Get(srv.URL + tc.Path)
+			assert.NilError(t, err)
+			assert.Equal(t, resp.StatusCode, tc.Status)
+
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NilError(t, err)
+			assert.Equal(t, string(body), tc.Body)
+		})
+	}
+
+	t.Run("vars should not collide with string context keys", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "vars", map[string]string{"id": "1"}))
+		assert.Equal(t, len(mux.Vars(req)), 0)
+	})
+
+	t.Run("unknown types should panic", func(t *testing.T) {
+		defer func() {
+			assert.Check(t, recover() != nil, "expected panic")
+		}()
+		router.HandleFunc("/dates/{d:date}", vars)
+	})
+}
+
+func TestURL(t *testing.T) {
+	router := mux.NewServeMux()
+	noop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	router.Handle("GET", "/login", noop).Name("login")
+	api := router.Group("/api")
+	api.Handle("GET", "/users/{user_id}/groups", noop).Name("user-groups")
+	api.Handle("GET", "/items/{id:uuid}", noop).Name("item")
+	api.Handle("GET", "/legacy/(?P<id>\\w+)", noop).Name("legacy")
+	api.Handle("GET", "/files/*", noop).Name("files")
+
+	tt := []struct {
+		Name  string
+		Pairs []string
+		Want  string
+	}{
+		{"login", nil, "/login"},
+		{"user-groups", []string{"user_id", "a b/c"}, "/api/users/a%20b%2Fc/groups"},
+		{"item", []string{"id", "3f0b8e0a-6c1d-4e3b-9a52-0f7c2b9d1e44"}, "/api/items/3f0b8e0a-6c1d-4e3b-9a52-0f7c2b9d1e44"},
+		{"legacy", []string{"id", "abc"}, "/api/legacy/abc"},
+		{"files", []string{"*", "a/b c.txt"}, "/api/files/a/b%20c.txt"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			got, err := router.URL(tc.Name, tc.Pairs...)
+			assert.NilError(t, err)
+			assert.Equal(t, got, tc.Want)
+		})
+	}
+
+	t.Run("invalid parameters should return error", func(t *testing.T) {
+		for _, tc := range []struct {
+			Name  string
+			Pairs []string
+		}{
+			{"missing", nil},
+			{"user-groups", nil},
+			{"user-groups", []string{"user_id"}},
+			{"item", []string{"id", "1"}},
+			{"legacy", []string{"id", "a-b"}},
+		} {
+			_, err := router.URL(tc.Name, tc.Pairs...)
+			assert.Check(t, err != nil, "%s %v", tc.Name, tc.Pairs)
+		}
+	})
+
+	t.Run("names should be unique", func(t *testing.T) {
+		defer func() {
+			assert.Check(t, recover() != nil, "expected panic")
+		}()
+		router.Handle("GET", "/other", noop).Name("login")
+	})
+}
@@ -0,0 +1,213 @@
+package mux
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/**
+ * Patterns are split in segments on `/`. Segments with parameters, e.g.
+ * `{user_id}`, `{id:uuid}` or `{n:int}`, match a whole path segment.
+ * Parameters could also be regexp groups, e.g. `(?P<user_id>[\w-]+)`.
+ * A trailing `*` segment is a wildcard and matches the rest of the path,
+ * available as the `*` variable. Other segments are matched literally.
+ *
+ * When more patterns match a path, static segments have precedence over
+ * parameters, and parameters over wildcards.
+ */
+const wildcardSegment = "*"
+
+// name of the variable with the path matched by a wildcard
+const wildcardVar = "*"
+
+var namedGroup = regexp.MustCompile(`\(\?P<\w+>`)
+
+// `{name}` and `{name:type}` parameters
+var paramSyntax = regexp.MustCompile(`\{([A-Za-z_]\w*)(?::(\w+))?\}`)
+
+// Values accepted by each parameter type, any segment when not specified
+var paramTypes = map[string]string{
+	"":     `[^/]+`,
+	"int":  `[0-9]+`,
+	"uuid": `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+}
+
+func paramType(typ string) string {
+	regex, ok := paramTypes[typ]
+	if !ok {
+		panic("mux: unknown parameter type " + typ)
+	}
+	return regex
+}
+
+/**
+ * Converts the `{name:type}` parameters of the segment to regexp groups,
+ * the text around them is matched literally unless the segment is already
+ * a regexp.
+ */
+func expandParams(segment string) string {
+	raw := strings.Contains(segment, "(")
+	quote := func(literal string) string {
+		if raw {
+			return literal
+		}
+		return regexp.QuoteMeta(literal)
+	}
+
+	var expanded strings.Builder
+	last := 0
+	for _, loc := range paramSyntax.FindAllStringSubmatchIndex(segment, -1) {
+		typ := ""
+		if loc[4] >= 0 {
+			typ = segment[loc[4]:loc[5]]
+		}
+
+		expanded.WriteString(quote(segment[last:loc[0]]))
+		expanded.WriteString("(?P<" + segment[loc[2]:loc[3]] + ">" + paramType(typ) + ")")
+		last = loc[1]
+	}
+	expanded.WriteString(quote(segment[last:]))
+	return expanded.String()
+}
+
+/**
+ * Node of the segment tree, children are tried by priority
+ */
+type node struct {
+	static map[string]*node
+
+	// parameter child, only one is allowed per node
+	param      *node
+	paramKey   string
+	paramRegex *regexp.Regexp
+
+	wildcard *route
+
+	// route of the patterns ending at this node
+	route *route
+}
+
+func newNode() *node {
+	return &node{static: map[string]*node{}}
+}
+
+/**
+ * Splits the pattern on `/`, ignoring the ones inside groups and
+ * character classes
+ */
+func splitPattern(pattern string) []string {
+	segments := []string{}
+	depth, start := 0, 0
+	inClass := false
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == '/' && depth == 0:
+			segments = append(segments, pattern[start:i])
+			start = i + 1
+		}
+	}
+	return append(segments, pattern[start:])
+}
+
+func isParam(segment string) bool {
+	return strings.Contains(segment, "(")
+}
+
+/**
+ * Inserts the pattern, returning its route. Panics if the pattern overlaps
+ * with another one, and the priority could not decide which one to match.
+ */
+func (n *node) insert(pattern string) *route {
+	segments := splitPattern(pattern)
+	names := []string{}
+
+	for i, segment := range segments {
+		if paramSyntax.MatchString(segment) {
+			segment = expandParams(segment)
+		}
+
+		switch {
+		case segment == wildcardSegment:
+			if i != len(segments)-1 {
+				panic("mux: wildcard should be the last segment of " + pattern)
+			}
+			if n.wildcard == nil {
+				n.wildcard = newRoute(pattern, append(names, wildcardVar))
+			}
+			return n.wildcard.check(pattern)
+
+		case isParam(segment):
+			regex := regexp.MustCompile("^(?:" + segment + ")$")
+			names = append(names, regex.SubexpNames()[1:]...)
+
+			// parameter names don't change the matched paths
+			key := namedGroup.ReplaceAllString(segment, "(")
+			if n.param == nil {
+				n.param = newNode()
+				n.paramKey = key
+				n.paramRegex = regexp.MustCompile("^(?:" + key + ")$")
+			}
+			if n.paramKey != key {
+				panic(fmt.Sprintf("mux: pattern %s overlaps with %q parameter", pattern, n.paramKey))
+			}
+			n = n.param
+
+		default:
+			child, ok := n.static[segment]
+			if !ok {
+				child = newNode()
+				n.static[segment] = child
+			}
+			n = child
+		}
+	}
+
+	if n.route == nil {
+		n.route = newRoute(pattern, names)
+	}
+	return n.route.check(pattern)
+}
+
+/**
+ * Finds the route matching the path segments, values are the
+ * submatches of the parameters
+ */
+func (n *node) lookup(segments []string, values []string) (*route, []string) {
+	if len(segments) == 0 {
+		if n.route != nil {
+			return n.route, values
+		}
+		return nil, nil
+	}
+
+	if child, ok := n.static[segments[0]]; ok {
+		if rt, values := child.lookup(segments[1:], values); rt != nil {
+			return rt, values
+		}
+	}
+
+	if n.param != nil {
+		if matches := n.paramRegex.FindStringSubmatch(segments[0]); matches != nil {
+			if rt, values := n.param.lookup(segments[1:], append(values, matches[1:]...)); rt != nil {
+				return rt, values
+			}
+		}
+	}
+
+	if n.wildcard != nil {
+		return n.wildcard, append(values, strings.Join(segments, "/"))
+	}
+	return nil, nil
+}
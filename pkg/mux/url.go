@@ -0,0 +1,88 @@
+package mux
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Segment made of a single regexp group, e.g. `(?P<user_id>[\w-]+)`
+var singleGroup = regexp.MustCompile(`^\(\?P<(\w+)>.*\)$`)
+
+/**
+ * Builds the path of the named route, pairs are the names and values
+ * of its parameters, e.g. `router.URL("user-groups", "user_id", id)`.
+ * Values are escaped, and should be valid for the parameter type once escaped.
+ */
+func (router *Router) URL(name string, pairs ...string) (string, error) {
+	rt, ok := router.named[name]
+	if !ok {
+		return "", fmt.Errorf("Unknown route %q", name)
+	}
+
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("Missing value of parameter %q", pairs[len(pairs)-1])
+	}
+
+	values := map[string]string{}
+	for i := 0; i < len(pairs); i += 2 {
+		values[pairs[i]] = pairs[i+1]
+	}
+
+	segments := splitPattern(rt.pattern)
+	for i, segment := range segments {
+		built, err := buildSegment(segment, values)
+		if err != nil {
+			return "", fmt.Errorf("Unable to build url of route %q: %w", name, err)
+		}
+		segments[i] = built
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+func paramValue(values map[string]string, name, regex string) (string, error) {
+	value, ok := values[name]
+	if !ok {
+		return "", fmt.Errorf("missing parameter %q", name)
+	}
+
+	// paths are matched escaped
+	escaped := url.PathEscape(value)
+	if !regexp.MustCompile("^(?:" + regex + ")$").MatchString(escaped) {
+		return "", fmt.Errorf("invalid value %q of parameter %q", value, name)
+	}
+	return escaped, nil
+}
+
+func buildSegment(segment string, values map[string]string) (string, error) {
+	switch {
+	case segment == wildcardSegment:
+		parts := strings.Split(values[wildcardVar], "/")
+		for i, part := range parts {
+			parts[i] = url.PathEscape(part)
+		}
+		return strings.Join(parts, "/"), nil
+
+	case strings.Contains(segment, "("):
+		// only parameters spanning the whole segment could be built from a regexp
+		matches := singleGroup.FindStringSubmatch(segment)
+		if matches == nil {
+			return "", fmt.Errorf("segment %q could not be built", segment)
+		}
+		return paramValue(values, matches[1], expandParams(segment))
+
+	case paramSyntax.MatchString(segment):
+		var err error
+		built := paramSyntax.ReplaceAllStringFunc(segment, func(param string) string {
+			matches := paramSyntax.FindStringSubmatch(param)
+			value, paramErr := paramValue(values, matches[1], paramType(matches[2]))
+			if paramErr != nil && err == nil {
+				err = paramErr
+			}
+			return value
+		})
+		return built, err
+	}
+	return segment, nil
+}
@@ -0,0 +1,150 @@
+package passwords
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Length of the hash prefix used to narrow the search, as in the HIBP range API
+const blocklistPrefixSize = 5
+
+/**
+ * Breached passwords, read from an offline dump of the
+ * "Have I Been Pwned" SHA-1 list (https://haveibeenpwned.com/Passwords),
+ * ordered by hash. Each line is `<SHA-1 hex>:<count>`.
+ *
+ * Like the k-anonymity range API, lookups binary search the 5 characters
+ * prefix of the hash and compare only the lines sharing it, so the file
+ * is never loaded in memory.
+ */
+type Blocklist struct {
+	file *os.File
+	size int64
+}
+
+/**
+ * Opens the blocklist file, it should be closed with `Close`
+ */
+func OpenBlocklist(path string) (*Blocklist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open blocklist: %v", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to open blocklist: %v", err)
+	}
+	return &Blocklist{file: file, size: stat.Size()}, nil
+}
+
+func (b *Blocklist) Close() error {
+	return b.file.Close()
+}
+
+/**
+ * Returns the offset of the first line starting at or after `offset`
+ */
+func (b *Blocklist) lineStart(offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+
+	// the line starts after the newline preceding the offset
+	reader := bufio.NewReader(io.NewSectionReader(b.file, offset-1, b.size-offset+1))
+	skipped, err := reader.ReadBytes('\n')
+	if err == io.EOF {
+		return b.size, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return offset - 1 + int64(len(skipped)), nil
+}
+
+/**
+ * Returns the hash prefix of the line starting at offset
+ */
+func (b *Blocklist) prefixAt(offset int64) (string, error) {
+	prefix := make([]byte, blocklistPrefixSize)
+	n, err := b.file.ReadAt(prefix, offset)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.ToUpper(string(prefix[:n])), nil
+}
+
+/**
+ * Reports if the password appears in the blocklist
+ */
+func (b *Blocklist) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix := hash[:blocklistPrefixSize]
+
+	// first line whose prefix is not lower than the one searched
+	var searchErr error
+	offset := sort.Search(int(b.size), func(i int) bool {
+		if searchErr != nil {
+			return true
+		}
+
+		start, err := b.lineStart(int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		if start >= b.size {
+			return true
+		}
+
+		linePrefix, err := b.prefixAt(start)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return linePrefix >= prefix
+	})
+	if searchErr != nil {
+		return false, fmt.Errorf("Unable to read blocklist: %v", searchErr)
+	}
+
+	start, err := b.lineStart(int64(offset))
+	if err != nil {
+		return false, fmt.Errorf("Unable to read blocklist: %v", err)
+	}
+
+	scanner := bufio.NewScanner(io.NewSectionReader(b.file, start, b.size-start))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		lineHash := line
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			lineHash = line[:i]
+		}
+		lineHash = bytes.ToUpper(lineHash)
+
+		if !bytes.HasPrefix(lineHash, []byte(prefix)) {
+			break
+		}
+		if string(lineHash) == hash {
+			return true, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("Unable to read blocklist: %v", err)
+	}
+	return false, nil
+}
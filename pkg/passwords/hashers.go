@@ -0,0 +1,245 @@
+package passwords
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"math"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+/**
+ * Upper bounds of the parameters accepted when validating, so malformed
+ * hashes could not exhaust the server resources.
+ */
+const (
+	maxArgon2Memory     = 1 << 20 // KiB
+	maxArgon2Time       = 64
+	maxScryptLogN       = 20
+	maxScryptBlockSize  = 32
+	maxScryptThreads    = 16
+	maxPBKDF2Iterations = 10000000
+)
+
+func compareHash(expected, actual []byte) error {
+	if subtle.ConstantTimeCompare(expected, actual) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+/**
+ * Argon2id, https://datatracker.ietf.org/doc/html/rfc9106
+ * `$argon2id$v=19$m=<memory KiB>,t=<iterations>,p=<parallelism>$<salt>$<hash>`
+ */
+type argon2idHasher struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	keyLen  uint32
+}
+
+func (h argon2idHasher) hash(salt []byte, password string) (string, error) {
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+
+	return fmt.Sprintf(
+		"$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		Argon2id, argon2.Version, h.memory, h.time, h.threads,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h argon2idHasher) verify(hashed, password string) error {
+	phc, err := parsePHC(hashed)
+	if err != nil {
+		return err
+	}
+
+	if phc.version != argon2.Version {
+		return fmt.Errorf("%w: unsupported argon2 version %d", ErrMalformedHash, phc.version)
+	}
+
+	threads, err := phc.intParam("p", 1, math.MaxUint8)
+	if err != nil {
+		return err
+	}
+	memory, err := phc.intParam("m", 8*threads, maxArgon2Memory)
+	if err != nil {
+		return err
+	}
+	time, err := phc.intParam("t", 1, maxArgon2Time)
+	if err != nil {
+		return err
+	}
+
+	key := argon2.IDKey(
+		[]byte(password), phc.salt,
+		uint32(time), uint32(memory), uint8(threads), uint32(len(phc.hash)),
+	)
+	return compareHash(phc.hash, key)
+}
+
+func (h argon2idHasher) needsRehash(hashed string) bool {
+	phc, err := parsePHC(hashed)
+	if err != nil || phc.version != argon2.Version {
+		return true
+	}
+
+	return !phc.hasParams(map[string]int{
+		"m": int(h.memory),
+		"t": int(h.time),
+		"p": int(h.threads),
+	}, int(h.keyLen))
+}
+
+/**
+ * bcrypt, hashes are in the modular crypt format `$2a$<cost>$<salt><hash>`.
+ * Passwords are limited to 72 bytes.
+ */
+type bcryptHasher struct {
+	cost int
+}
+
+// bcrypt ignores the bytes after the 72nd
+const bcryptMaxPassword = 72
+
+func (h bcryptHasher) hash(_ []byte, password string) (string, error) {
+	if len(password) > bcryptMaxPassword {
+		return "", fmt.Errorf("Password too long for bcrypt")
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", fmt.Errorf("Unable to hash password: %v", err)
+	}
+	return string(hashed), nil
+}
+
+func (h bcryptHasher) verify(hashed, password string) error {
+	if len(password) > bcryptMaxPassword {
+		return ErrMismatch
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrMismatch
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedHash, err)
+	}
+	return nil
+}
+
+func (h bcryptHasher) needsRehash(hashed string) bool {
+	cost, err := bcrypt.Cost([]byte(hashed))
+	return err != nil || cost != h.cost
+}
+
+/**
+ * scrypt, https://datatracker.ietf.org/doc/html/rfc7914
+ * `$scrypt$ln=<log2 N>,r=<block size>,p=<parallelism>$<salt>$<hash>`
+ */
+type scryptHasher struct {
+	logN   int
+	r      int
+	p      int
+	keyLen int
+}
+
+func (h scryptHasher) hash(salt []byte, password string) (string, error) {
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.logN, h.r, h.p, h.keyLen)
+	if err != nil {
+		return "", fmt.Errorf("Unable to hash password: %v", err)
+	}
+
+	return fmt.Sprintf(
+		"$%s$ln=%d,r=%d,p=%d$%s$%s",
+		Scrypt, h.logN, h.r, h.p,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h scryptHasher) verify(hashed, password string) error {
+	phc, err := parsePHC(hashed)
+	if err != nil {
+		return err
+	}
+
+	logN, err := phc.intParam("ln", 1, maxScryptLogN)
+	if err != nil {
+		return err
+	}
+	r, err := phc.intParam("r", 1, maxScryptBlockSize)
+	if err != nil {
+		return err
+	}
+	p, err := phc.intParam("p", 1, maxScryptThreads)
+	if err != nil {
+		return err
+	}
+
+	key, err := scrypt.Key([]byte(password), phc.salt, 1<<logN, r, p, len(phc.hash))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedHash, err)
+	}
+	return compareHash(phc.hash, key)
+}
+
+func (h scryptHasher) needsRehash(hashed string) bool {
+	phc, err := parsePHC(hashed)
+	if err != nil {
+		return true
+	}
+
+	return !phc.hasParams(map[string]int{
+		"ln": h.logN,
+		"r":  h.r,
+		"p":  h.p,
+	}, h.keyLen)
+}
+
+/**
+ * PBKDF2 with HMAC-SHA256, https://datatracker.ietf.org/doc/html/rfc8018#section-5.2
+ * `$pbkdf2-sha256$i=<iterations>$<salt>$<hash>`
+ */
+type pbkdf2Hasher struct {
+	iterations int
+	keyLen     int
+}
+
+func (h pbkdf2Hasher) hash(salt []byte, password string) (string, error) {
+	key := pbkdf2.Key([]byte(password), salt, h.iterations, h.keyLen, sha256.New)
+
+	return fmt.Sprintf(
+		"$%s$i=%d$%s$%s",
+		PBKDF2, h.iterations,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h pbkdf2Hasher) verify(hashed, password string) error {
+	phc, err := parsePHC(hashed)
+	if err != nil {
+		return err
+	}
+
+	iterations, err := phc.intParam("i", 1, maxPBKDF2Iterations)
+	if err != nil {
+		return err
+	}
+
+	key := pbkdf2.Key([]byte(password), phc.salt, iterations, len(phc.hash), sha256.New)
+	return compareHash(phc.hash, key)
+}
+
+func (h pbkdf2Hasher) needsRehash(hashed string) bool {
+	phc, err := parsePHC(hashed)
+	if err != nil {
+		return true
+	}
+	return !phc.hasParams(map[string]int{"i": h.iterations}, h.keyLen)
+}
@@ -1,8 +1,24 @@
+/**
+ * Password hashing. Hashes are stored with their algorithm and parameters,
+ * so they could be validated even when the defaults change.
+ *
+ * Hashes are encoded in the PHC string format
+ * (https://github.com/P-H-C/phc-string-format/blob/master/phc-sf-spec.md),
+ * e.g. `$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>`, bcrypt hashes use
+ * their own `$2a$<cost>$...` format. Legacy `sha256$<salt>$<hash>` hashes
+ * are still validated.
+ *
+ * When peppers are set, hashes are computed on the HMAC of the password keyed
+ * with a server-side secret, so they could not be attacked offline from a
+ * database dump alone.
+ */
 package passwords
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -10,23 +26,96 @@ import (
 
 type Algorithm = string
 
+var (
+	// the hash algorithm is not supported
+	ErrUnknownAlgorithm = errors.New("Unknown password hash algorithm")
+	// the hash could not be parsed, or has invalid parameters
+	ErrMalformedHash = errors.New("Malformed password hash")
+	// the password does not match the hash
+	ErrMismatch = errors.New("Mismatching passwords")
+	// the hash is peppered with a pepper not configured
+	ErrUnknownPepper = errors.New("Unknown password pepper")
+)
+
 const (
-	SHA256 Algorithm = "sha256"
+	SHA256   Algorithm = "sha256" // legacy, single iteration of sha256(salt+password)
+	Argon2id Algorithm = "argon2id"
+	Bcrypt   Algorithm = "bcrypt"
+	Scrypt   Algorithm = "scrypt"
+	PBKDF2   Algorithm = "pbkdf2-sha256"
 )
 
+// Algorithm used for new passwords
+const Default = Argon2id
+
+// Size in bytes of the salt of new passwords
+const saltSize = 16
+
+/**
+ * Password hashing function, with the parameters used for new hashes
+ */
+type hasher interface {
+	// hashes the password, returning the encoded hash string
+	hash(salt []byte, password string) (string, error)
+
+	// checks the password against an encoded hash string of the algorithm
+	verify(hashed, password string) error
+
+	// reports if the hash was generated with different parameters
+	needsRehash(hashed string) bool
+}
+
+var hashers = map[Algorithm]hasher{
+	Argon2id: argon2idHasher{memory: 64 * 1024, time: 3, threads: 4, keyLen: 32},
+	Bcrypt:   bcryptHasher{cost: 12},
+	Scrypt:   scryptHasher{logN: 15, r: 8, p: 1, keyLen: 32},
+	PBKDF2:   pbkdf2Hasher{iterations: 600000, keyLen: 32},
+}
+
+/**
+ * Hashes the password with the default algorithm and a random salt
+ */
 func New(rng io.Reader, password string) (string, error) {
-	salt := make([]byte, 12)
-	_, err := io.ReadFull(rng, salt)
-	if err != nil {
-		return "", err
+	return NewWithAlgorithm(rng, Default, password)
+}
+
+/**
+ * Hashes the password with the given algorithm and a random salt.
+ * bcrypt generates its own salt, from `crypto/rand`. Legacy sha256 hashes
+ * are never peppered.
+ */
+func NewWithAlgorithm(rng io.Reader, alg Algorithm, password string) (string, error) {
+	if alg == SHA256 {
+		salt := make([]byte, 12)
+		if _, err := io.ReadFull(rng, salt); err != nil {
+			return "", err
+		}
+		return Encode(SHA256, base64.RawStdEncoding.EncodeToString(salt), password)
+	}
+
+	h, ok := hashers[alg]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownAlgorithm, alg)
 	}
 
-	return Encode(SHA256, base64.RawStdEncoding.EncodeToString(salt), password)
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rng, salt); err != nil {
+		return "", err
+	}
+	return pepperedHash(h, salt, password)
 }
 
+/**
+ * Hashes the password with the given salt, using the default parameters
+ * of the algorithm.
+ */
 func Encode(alg Algorithm, salt, password string) (string, error) {
 	if alg != SHA256 {
-		return "", fmt.Errorf("Unexpected algorithm name: %q", alg)
+		h, ok := hashers[alg]
+		if !ok {
+			return "", fmt.Errorf("%w: %q", ErrUnknownAlgorithm, alg)
+		}
+		return pepperedHash(h, []byte(salt), password)
 	}
 
 	hasher := sha256.New()
@@ -37,17 +126,88 @@ func Encode(alg Algorithm, salt, password string) (string, error) {
 	return pass, nil
 }
 
+/**
+ * Returns the algorithm of the hash, from its identifier
+ */
+func algorithmOf(hashed string) (Algorithm, error) {
+	id := strings.TrimPrefix(hashed, "$")
+
+	i := strings.Index(id, "$")
+	if i <= 0 {
+		return "", ErrMalformedHash
+	}
+	id = id[:i]
+
+	switch id {
+	case "2a", "2b", "2y":
+		return Bcrypt, nil
+	}
+
+	if _, ok := hashers[id]; !ok && id != SHA256 {
+		return "", fmt.Errorf("%w: %q", ErrUnknownAlgorithm, id)
+	}
+	return id, nil
+}
+
+/**
+ * Checks the password against the hash, comparisons are made in
+ * constant time. Errors are `ErrMismatch` when the password is wrong,
+ * `ErrUnknownAlgorithm` or `ErrMalformedHash` when the hash is not valid,
+ * `ErrUnknownPepper` when its pepper is not set.
+ */
 func Validate(hashed, plain string) error {
-	chunks := strings.Split(hashed, "$")
-	alg, salt, _ := chunks[0], chunks[1], chunks[2]
+	id, hashed, err := splitPepper(hashed)
+	if err != nil {
+		return err
+	}
 
-	enc, err := Encode(alg, salt, plain)
+	if id != "" {
+		key, err := findPepper(id)
+		if err != nil {
+			return err
+		}
+		plain = pepperPassword(key, plain)
+	}
+
+	alg, err := algorithmOf(hashed)
 	if err != nil {
 		return err
 	}
 
-	if enc != hashed {
-		return fmt.Errorf("Mismatching passwords")
+	if alg == SHA256 {
+		// legacy hashes have no leading `$`
+		chunks := strings.Split(hashed, "$")
+		if len(chunks) != 3 || chunks[0] != SHA256 {
+			return ErrMalformedHash
+		}
+
+		enc, err := Encode(SHA256, chunks[1], plain)
+		if err != nil {
+			return err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(enc), []byte(hashed)) != 1 {
+			return ErrMismatch
+		}
+		return nil
+	}
+
+	return hashers[alg].verify(hashed, plain)
+}
+
+/**
+ * Reports if the hash should be replaced, since it was not generated with
+ * the default algorithm and parameters, or with another pepper. Hashes should
+ * be replaced only after validating the password, as the plain password is needed.
+ */
+func NeedsRehash(hashed string) bool {
+	id, hashed, err := splitPepper(hashed)
+	if current, _ := currentPepper(); err != nil || id != current {
+		return true
+	}
+
+	if alg, err := algorithmOf(hashed); err != nil || alg != Default {
+		return true
 	}
-	return nil
+	return hashers[Default].needsRehash(hashed)
 }
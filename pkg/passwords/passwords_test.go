@@ -2,9 +2,13 @@ package passwords_test
 
 import (
 	"crypto/rand"
-	"github.com/ale-cci/oauthsrv/pkg/passwords"
+	"errors"
+	mathrand "math/rand"
 	"strings"
 	"testing"
+	"testing/quick"
+
+	"github.com/ale-cci/oauthsrv/pkg/passwords"
 )
 
 func TestNewPassword(t *testing.T) {
@@ -49,11 +53,30 @@ func TestNewPassword(t *testing.T) {
 		chunks := strings.Split(pass, "$")
 
 		got := len(chunks)
-		want := 3
+		want := 6
 
 		if got != want {
 			t.Fatalf("want: %d, got: %d", want, got)
 		}
+
+		if chunks[1] != passwords.Argon2id {
+			t.Fatalf("want: %q, got: %q", passwords.Argon2id, chunks[1])
+		}
+	})
+
+	t.Run("legacy sha256 passwords should still be generated", func(t *testing.T) {
+		pass, err := passwords.NewWithAlgorithm(rand.Reader, passwords.SHA256, "x")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if got := len(strings.Split(pass, "$")); got != 3 {
+			t.Fatalf("want: 3 chunks, got: %d", got)
+		}
+
+		if err := passwords.Validate(pass, "x"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
 	})
 
 	t.Run("2 passwords should likely have different salt", func(t *testing.T) {
@@ -107,3 +130,234 @@ func TestPasswordFormat(t *testing.T) {
 		}
 	})
 }
+
+func TestAlgorithms(t *testing.T) {
+	algorithms := []passwords.Algorithm{
+		passwords.Argon2id,
+		passwords.Bcrypt,
+		passwords.Scrypt,
+		passwords.PBKDF2,
+	}
+
+	for _, alg := range algorithms {
+		t.Run(alg+" passwords should be validated", func(t *testing.T) {
+			pass, err := passwords.NewWithAlgorithm(rand.Reader, alg, "test")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if err := passwords.Validate(pass, "test"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if err := passwords.Validate(pass, "testo"); err == nil {
+				t.Fatalf("Expected error on mismatching password")
+			}
+		})
+	}
+
+	t.Run("PHC strings of other implementations should be validated", func(t *testing.T) {
+		tt := []struct {
+			Name, Hashed, Password string
+		}{
+			// argon2 reference implementation
+			{
+				"argon2id",
+				"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+				"password",
+			},
+			// RFC 7914, section 12
+			{
+				"scrypt",
+				"$scrypt$ln=10,r=8,p=16$TmFDbA$/bq+HJ00cgB4VucZDQHp/nxq18vII3gw53N2Y0s3MWIurzDZLiKjiG/xCSedmDDaxyevuUqD7m2DYMvfoswGQA",
+				"password",
+			},
+			// RFC 7914, section 11
+			{
+				"pbkdf2-sha256",
+				"$pbkdf2-sha256$i=1$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd+8xfHG4RbHjC9UJESBB06GXgw",
+				"passwd",
+			},
+		}
+
+		for _, tc := range tt {
+			if err := passwords.Validate(tc.Hashed, tc.Password); err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.Name, err)
+			}
+
+			if err := passwords.Validate(tc.Hashed, tc.Password+"x"); err == nil {
+				t.Errorf("%s: expected error on mismatching password", tc.Name)
+			}
+		}
+	})
+
+	t.Run("Encode should include the parameters in the hash", func(t *testing.T) {
+		got, err := passwords.Encode(passwords.PBKDF2, "salt", "passwd")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		want := "$pbkdf2-sha256$i=600000$c2FsdA$"
+		if !strings.HasPrefix(got, want) {
+			t.Errorf("want prefix: %q, got %q", want, got)
+		}
+	})
+
+	t.Run("bcrypt should reject passwords longer than 72 bytes", func(t *testing.T) {
+		_, err := passwords.NewWithAlgorithm(rand.Reader, passwords.Bcrypt, strings.Repeat("x", 73))
+		if err == nil {
+			t.Errorf("Expected error, got %v", err)
+		}
+	})
+
+	t.Run("hashes with invalid parameters should not be validated", func(t *testing.T) {
+		for _, hashed := range []string{
+			"$argon2id$v=19$m=65536,t=0,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+			"$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+			"$scrypt$ln=99,r=8,p=1$TmFDbA$/bq+HJ00cgB4VucZDQHp",
+			"$pbkdf2-sha256$i=1$c2FsdA$",
+		} {
+			if err := passwords.Validate(hashed, "password"); err == nil {
+				t.Errorf("Expected error for %q", hashed)
+			}
+		}
+	})
+}
+
+func TestNeedsRehash(t *testing.T) {
+	t.Run("new passwords should not need rehash", func(t *testing.T) {
+		pass, err := passwords.New(rand.Reader, "test")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if passwords.NeedsRehash(pass) {
+			t.Errorf("Unexpected rehash of %q", pass)
+		}
+	})
+
+	t.Run("other algorithms and parameters should need rehash", func(t *testing.T) {
+		for _, hashed := range []string{
+			"sha256$$SBNJTRN-FjG7owHVrKtue7eqdM4RhdRWVl71HXN2d7I",
+			"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+			"$pbkdf2-sha256$i=1$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd+8xfHG4RbHjC9UJESBB06GXgw",
+			"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+			"malformed",
+		} {
+			if !passwords.NeedsRehash(hashed) {
+				t.Errorf("Expected rehash of %q", hashed)
+			}
+		}
+	})
+}
+
+// Hashes with the lowest parameters, all of "password"
+var cheapHashes = []string{
+	"sha256$1234$2ERkGB9_AZ8_sQ5rvQb1Q9eshMT442DruUAqRyqzDrw",
+	"$argon2id$v=19$m=8,t=1,p=1$c2FsdHNhbHRzYWx0$p9Pz+FurkX0t8OX63M+Fag",
+	"$scrypt$ln=4,r=1,p=1$c2FsdHNhbHRzYWx0$K5fOwuSST4WGNRuENLnJiw",
+	"$pbkdf2-sha256$i=1$c2FsdHNhbHRzYWx0$dHoInFd+L67F+JGOheGfvg",
+	"$2a$04$roytmrqM8rQaUjFYawJixOM/p07zdK30AN34dTRrVgN1iwx/IMyZC",
+}
+
+func isTypedError(err error) bool {
+	return errors.Is(err, passwords.ErrMismatch) ||
+		errors.Is(err, passwords.ErrMalformedHash) ||
+		errors.Is(err, passwords.ErrUnknownAlgorithm) ||
+		errors.Is(err, passwords.ErrUnknownPepper)
+}
+
+func TestValidateErrors(t *testing.T) {
+	t.Run("cheap hashes should be valid", func(t *testing.T) {
+		for _, hashed := range cheapHashes {
+			if err := passwords.Validate(hashed, "password"); err != nil {
+				t.Errorf("%q: unexpected error: %v", hashed, err)
+			}
+		}
+	})
+
+	t.Run("wrong passwords should return ErrMismatch", func(t *testing.T) {
+		for _, hashed := range cheapHashes {
+			if err := passwords.Validate(hashed, "wrong"); !errors.Is(err, passwords.ErrMismatch) {
+				t.Errorf("%q: want ErrMismatch, got %v", hashed, err)
+			}
+		}
+	})
+
+	t.Run("malformed hashes should return ErrMalformedHash", func(t *testing.T) {
+		for _, hashed := range []string{
+			"",
+			"sha256",
+			"sha256$",
+			"sha256$salt",
+			"$",
+			"$$",
+			"$argon2id",
+			"$argon2id$v=19$m=8,t=1,p=1$c2FsdA",
+			"$argon2id$v=x$m=8,t=1,p=1$c2FsdA$aGFzaA",
+			"$argon2id$v=19$m=8,t,p=1$c2FsdA$aGFzaA",
+			"$argon2id$v=19$m=8,t=1,p=1$!!!$aGFzaA",
+			"$argon2id$v=19$m=99999999999,t=1,p=1$c2FsdA$aGFzaA",
+			"$scrypt$ln=4,r=1$c2FsdA$aGFzaA",
+			"$pbkdf2-sha256$i=-1$c2FsdA$aGFzaA",
+			"$2a$04$short",
+		} {
+			if err := passwords.Validate(hashed, "password"); !errors.Is(err, passwords.ErrMalformedHash) {
+				t.Errorf("%q: want ErrMalformedHash, got %v", hashed, err)
+			}
+		}
+	})
+
+	t.Run("unknown algorithms should return ErrUnknownAlgorithm", func(t *testing.T) {
+		for _, hashed := range []string{
+			"sha257$1234$hash",
+			"$md5$c2FsdA$aGFzaA",
+		} {
+			if err := passwords.Validate(hashed, "password"); !errors.Is(err, passwords.ErrUnknownAlgorithm) {
+				t.Errorf("%q: want ErrUnknownAlgorithm, got %v", hashed, err)
+			}
+		}
+
+		if _, err := passwords.Encode("sha257", "1234", "password"); !errors.Is(err, passwords.ErrUnknownAlgorithm) {
+			t.Errorf("want ErrUnknownAlgorithm, got %v", err)
+		}
+	})
+}
+
+func TestValidateFuzz(t *testing.T) {
+	t.Run("random hashes should return typed errors", func(t *testing.T) {
+		validate := func(hashed, password string) bool {
+			return isTypedError(passwords.Validate(hashed, password))
+		}
+
+		if err := quick.Check(validate, &quick.Config{MaxCount: 5000}); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("mutated hashes should not panic", func(t *testing.T) {
+		rng := mathrand.New(mathrand.NewSource(1))
+		alphabet := "$=,0123456789abcdefghijklmnopqrstuvwxyz+/"
+
+		for i := 0; i < 5000; i++ {
+			hashed := []byte(cheapHashes[rng.Intn(len(cheapHashes))])
+
+			for n := rng.Intn(3) + 1; n > 0 && len(hashed) > 0; n-- {
+				pos := rng.Intn(len(hashed))
+				switch rng.Intn(3) {
+				case 0: // replace
+					hashed[pos] = alphabet[rng.Intn(len(alphabet))]
+				case 1: // delete
+					hashed = append(hashed[:pos], hashed[pos+1:]...)
+				case 2: // truncate
+					hashed = hashed[:pos]
+				}
+			}
+
+			// mutations could still decode to the same hash
+			if err := passwords.Validate(string(hashed), "password"); err != nil && !isTypedError(err) {
+				t.Errorf("%q: untyped error %v", hashed, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package passwords
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/**
+ * Peppered hashes are prefixed with the id of the pepper,
+ * `$pepper$id=<id>$argon2id$v=19$...`, the inner hash is computed on the
+ * HMAC-SHA256 of the password keyed with the pepper.
+ */
+const pepperPrefix = "$pepper$id="
+
+// Minimum size in bytes of a pepper key
+const minPepperSize = 32
+
+var pepperID = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+/**
+ * Secret keys mixed into the password hashes, kept outside the database.
+ * New hashes use the current pepper, older ones are still validated during
+ * the rotation.
+ */
+type Peppers struct {
+	current string
+	keys    map[string][]byte
+}
+
+/**
+ * Peppers with the given keys, by id. `current` is the id of the pepper
+ * used for new hashes.
+ */
+func NewPeppers(current string, keys map[string][]byte) (*Peppers, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("Missing current pepper %q", current)
+	}
+
+	peppers := &Peppers{current: current, keys: make(map[string][]byte)}
+	for id, key := range keys {
+		if !pepperID.MatchString(id) {
+			return nil, fmt.Errorf("Invalid pepper id %q", id)
+		}
+		if len(key) < minPepperSize {
+			return nil, fmt.Errorf("Pepper %q should be at least %d bytes long", id, minPepperSize)
+		}
+		peppers.keys[id] = key
+	}
+	return peppers, nil
+}
+
+/**
+ * Parses peppers in the format `<id>:<base64 key>`, separated by commas or
+ * whitespaces. The last one is used for new hashes, so peppers are rotated
+ * by appending a new one.
+ */
+func ParsePeppers(text string) (*Peppers, error) {
+	fields := strings.FieldsFunc(text, func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\t' || c == '\r' || c == '\n'
+	})
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("No pepper found")
+	}
+
+	keys := make(map[string][]byte)
+	var current string
+	for _, field := range fields {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid pepper %q, expected <id>:<base64 key>", field)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pepper %q: %v", kv[0], err)
+		}
+		if _, ok := keys[kv[0]]; ok {
+			return nil, fmt.Errorf("Duplicate pepper %q", kv[0])
+		}
+
+		keys[kv[0]] = key
+		current = kv[0]
+	}
+	return NewPeppers(current, keys)
+}
+
+/**
+ * Reads the peppers from a file, in the format of `ParsePeppers`
+ */
+func LoadPeppers(path string) (*Peppers, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read peppers: %v", err)
+	}
+	return ParsePeppers(string(content))
+}
+
+// peppers used by the package, nil when disabled
+var peppers struct {
+	sync.RWMutex
+	current *Peppers
+}
+
+/**
+ * Sets the peppers used to hash and validate passwords, nil disables them.
+ * Peppered hashes could not be validated without their pepper.
+ */
+func SetPeppers(p *Peppers) {
+	peppers.Lock()
+	defer peppers.Unlock()
+	peppers.current = p
+}
+
+/**
+ * Returns the id and key of the pepper for new hashes, an empty id when
+ * peppers are disabled
+ */
+func currentPepper() (string, []byte) {
+	peppers.RLock()
+	defer peppers.RUnlock()
+
+	if peppers.current == nil {
+		return "", nil
+	}
+	id := peppers.current.current
+	return id, peppers.current.keys[id]
+}
+
+func findPepper(id string) ([]byte, error) {
+	peppers.RLock()
+	defer peppers.RUnlock()
+
+	if peppers.current != nil {
+		if key, ok := peppers.current.keys[id]; ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownPepper, id)
+}
+
+/**
+ * Password given to the hash function, the HMAC is base64 encoded so it
+ * fits the bcrypt limit and has no NUL bytes
+ */
+func pepperPassword(key []byte, password string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(password))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/**
+ * Splits a peppered hash into the pepper id and the inner hash, the id is
+ * empty when the hash is not peppered.
+ */
+func splitPepper(hashed string) (string, string, error) {
+	if !strings.HasPrefix(hashed, pepperPrefix) {
+		return "", hashed, nil
+	}
+
+	rest := strings.TrimPrefix(hashed, pepperPrefix)
+	i := strings.Index(rest, "$")
+	if i <= 0 {
+		return "", "", fmt.Errorf("%w: invalid pepper id", ErrMalformedHash)
+	}
+	return rest[:i], rest[i:], nil
+}
+
+/**
+ * Hashes the password with the current pepper, if any
+ */
+func pepperedHash(h hasher, salt []byte, password string) (string, error) {
+	id, key := currentPepper()
+	if id == "" {
+		return h.hash(salt, password)
+	}
+
+	hashed, err := h.hash(salt, pepperPassword(key, password))
+	if err != nil {
+		return "", err
+	}
+	return pepperPrefix + id + hashed, nil
+}
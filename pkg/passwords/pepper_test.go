@@ -0,0 +1,165 @@
+package passwords_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/passwords"
+)
+
+func pepperKey(fill byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+}
+
+func setPeppers(t *testing.T, text string) {
+	t.Helper()
+
+	peppers, err := passwords.ParsePeppers(text)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	passwords.SetPeppers(peppers)
+	t.Cleanup(func() { passwords.SetPeppers(nil) })
+}
+
+func TestPeppers(t *testing.T) {
+	t.Run("Peppered hashes should be validated", func(t *testing.T) {
+		setPeppers(t, "v1:"+pepperKey(1))
+
+		hashed, err := passwords.NewWithAlgorithm(rand.Reader, passwords.PBKDF2, "password")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if !strings.HasPrefix(hashed, "$pepper$id=v1$pbkdf2-sha256$") {
+			t.Errorf("Unexpected hash format: %q", hashed)
+		}
+		if err := passwords.Validate(hashed, "password"); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if err := passwords.Validate(hashed, "wrong"); !errors.Is(err, passwords.ErrMismatch) {
+			t.Errorf("want ErrMismatch, got %v", err)
+		}
+	})
+
+	t.Run("Hashes should not be validated without their pepper", func(t *testing.T) {
+		setPeppers(t, "v1:"+pepperKey(1))
+		hashed, err := passwords.NewWithAlgorithm(rand.Reader, passwords.PBKDF2, "password")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		passwords.SetPeppers(nil)
+		if err := passwords.Validate(hashed, "password"); !errors.Is(err, passwords.ErrUnknownPepper) {
+			t.Errorf("want ErrUnknownPepper, got %v", err)
+		}
+
+		// same id, different key
+		setPeppers(t, "v1:"+pepperKey(2))
+		if err := passwords.Validate(hashed, "password"); !errors.Is(err, passwords.ErrMismatch) {
+			t.Errorf("want ErrMismatch, got %v", err)
+		}
+	})
+
+	t.Run("Hashes of older peppers should be validated and rehashed", func(t *testing.T) {
+		unpeppered := cheapHashes[3]
+
+		setPeppers(t, "v1:"+pepperKey(1))
+		old, err := passwords.NewWithAlgorithm(rand.Reader, passwords.PBKDF2, "password")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		setPeppers(t, "v1:"+pepperKey(1)+",v2:"+pepperKey(2))
+		for _, hashed := range []string{unpeppered, old} {
+			if err := passwords.Validate(hashed, "password"); err != nil {
+				t.Errorf("%q: unexpected error: %v", hashed, err)
+			}
+			if !passwords.NeedsRehash(hashed) {
+				t.Errorf("Expected rehash of %q", hashed)
+			}
+		}
+
+		hashed, err := passwords.New(rand.Reader, "password")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !strings.HasPrefix(hashed, "$pepper$id=v2$argon2id$") || passwords.NeedsRehash(hashed) {
+			t.Errorf("Unexpected hash %q", hashed)
+		}
+	})
+
+	t.Run("Bcrypt should accept long passwords when peppered", func(t *testing.T) {
+		setPeppers(t, "v1:"+pepperKey(1))
+
+		password := strings.Repeat("a", 100)
+		hashed, err := passwords.NewWithAlgorithm(rand.Reader, passwords.Bcrypt, password)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := passwords.Validate(hashed, password[:72]); !errors.Is(err, passwords.ErrMismatch) {
+			t.Errorf("want ErrMismatch, got %v", err)
+		}
+	})
+
+	t.Run("Malformed peppered hashes should return ErrMalformedHash", func(t *testing.T) {
+		setPeppers(t, "v1:"+pepperKey(1))
+
+		for _, hashed := range []string{
+			"$pepper$id=",
+			"$pepper$id=v1",
+			"$pepper$id=$pbkdf2-sha256$i=1$c2FsdA$aGFzaA",
+			"$pepper$id=v1$sha256$1234$2ERkGB9_AZ8_sQ5rvQb1Q9eshMT442DruUAqRyqzDrw",
+		} {
+			if err := passwords.Validate(hashed, "password"); !errors.Is(err, passwords.ErrMalformedHash) {
+				t.Errorf("%q: want ErrMalformedHash, got %v", hashed, err)
+			}
+		}
+	})
+}
+
+func TestParsePeppers(t *testing.T) {
+	t.Run("Invalid peppers should return error", func(t *testing.T) {
+		for _, text := range []string{
+			"",
+			"v1",
+			"v1:!!!",
+			"v1:" + base64.StdEncoding.EncodeToString([]byte("short")),
+			"v$1:" + pepperKey(1),
+			"v1:" + pepperKey(1) + "\nv1:" + pepperKey(2),
+		} {
+			if _, err := passwords.ParsePeppers(text); err == nil {
+				t.Errorf("%q: expected error", text)
+			}
+		}
+	})
+
+	t.Run("Peppers should be loaded from file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "peppers")
+		content := "v1:" + pepperKey(1) + "\nv2:" + pepperKey(2) + "\n"
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write peppers: %v", err)
+		}
+
+		peppers, err := passwords.LoadPeppers(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		passwords.SetPeppers(peppers)
+		t.Cleanup(func() { passwords.SetPeppers(nil) })
+
+		hashed, err := passwords.NewWithAlgorithm(rand.Reader, passwords.PBKDF2, "password")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !strings.HasPrefix(hashed, "$pepper$id=v2$") {
+			t.Errorf("Unexpected hash %q", hashed)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package passwords
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Hash in the PHC string format: `$<id>[$v=<version>][$<param>=<value>(,...)]$<salt>$<hash>`
+ * Salt and hash are base64 encoded, without padding.
+ */
+type phcString struct {
+	id      string
+	version int // 0 when not specified
+	params  map[string]string
+	salt    []byte
+	hash    []byte
+}
+
+var phcEncoding = base64.RawStdEncoding
+
+func parsePHC(hashed string) (*phcString, error) {
+	if !strings.HasPrefix(hashed, "$") {
+		return nil, ErrMalformedHash
+	}
+
+	fields := strings.Split(hashed[1:], "$")
+	phc := &phcString{
+		id:     fields[0],
+		params: make(map[string]string),
+	}
+	fields = fields[1:]
+
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "v=") {
+		version, err := strconv.Atoi(strings.TrimPrefix(fields[0], "v="))
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid version", ErrMalformedHash)
+		}
+		phc.version = version
+		fields = fields[1:]
+	}
+
+	if len(fields) == 3 {
+		for _, param := range strings.Split(fields[0], ",") {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("%w: invalid parameter %q", ErrMalformedHash, param)
+			}
+			phc.params[kv[0]] = kv[1]
+		}
+		fields = fields[1:]
+	}
+
+	if len(fields) != 2 {
+		return nil, ErrMalformedHash
+	}
+
+	var err error
+	if phc.salt, err = phcEncoding.DecodeString(fields[0]); err != nil {
+		return nil, fmt.Errorf("%w: invalid salt encoding", ErrMalformedHash)
+	}
+
+	if phc.hash, err = phcEncoding.DecodeString(fields[1]); err != nil {
+		return nil, fmt.Errorf("%w: invalid hash encoding", ErrMalformedHash)
+	}
+
+	if len(phc.hash) == 0 {
+		return nil, ErrMalformedHash
+	}
+	return phc, nil
+}
+
+/**
+ * Returns the parameter as an integer between min and max
+ */
+func (phc *phcString) intParam(name string, min, max int) (int, error) {
+	raw, ok := phc.params[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: missing parameter %q", ErrMalformedHash, name)
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("%w: invalid parameter %q", ErrMalformedHash, name)
+	}
+	return value, nil
+}
+
+/**
+ * Reports if the hash has exactly the given parameters and length
+ */
+func (phc *phcString) hasParams(params map[string]int, keyLen int) bool {
+	if len(phc.params) != len(params) || len(phc.hash) != keyLen {
+		return false
+	}
+
+	for name, value := range params {
+		if phc.params[name] != strconv.Itoa(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package passwords
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rules of the password policy, reported in the violations
+const (
+	RuleMinLength  = "min_length"
+	RuleMaxLength  = "max_length"
+	RuleClasses    = "character_classes"
+	RuleEmail      = "contains_email"
+	RuleBlocklist  = "breached"
+	defaultMaxSize = 1024
+)
+
+// Longest password, in bytes, accepted by each algorithm
+var maxPasswordSizes = map[Algorithm]int{
+	Bcrypt: bcryptMaxPassword,
+}
+
+/**
+ * Rules checked when a password is set. The zero value accepts any
+ * password that fits the default algorithm.
+ */
+type Policy struct {
+	// algorithm the password will be hashed with, limits its size
+	Algorithm Algorithm
+
+	// minimum number of characters
+	MinLength int
+
+	// minimum number of character classes among lowercase, uppercase,
+	// digits and symbols
+	MinClasses int
+
+	// breached passwords, not checked when nil
+	Blocklist *Blocklist
+}
+
+// Rule not satisfied by a password, could be shown to the user
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+/**
+ * Returned by `Policy.Check` when the password does not satisfy the policy
+ */
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (err *PolicyError) Error() string {
+	messages := make([]string, 0, len(err.Violations))
+	for _, violation := range err.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return "Password rejected: " + strings.Join(messages, ", ")
+}
+
+// Longest password, in bytes, accepted by the algorithm of the policy
+func (p *Policy) maxSize() int {
+	alg := p.Algorithm
+	if alg == "" {
+		alg = Default
+	}
+
+	if size, ok := maxPasswordSizes[alg]; ok {
+		return size
+	}
+	return defaultMaxSize
+}
+
+// Number of character classes used by the password
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+/**
+ * Shortest local part of the email checked on its own, shorter ones
+ * would match too many unrelated passwords
+ */
+const minEmailLocalPart = 4
+
+// Reports if the password contains the email, or its local part
+func containsEmail(password, email string) bool {
+	if email == "" {
+		return false
+	}
+
+	password = strings.ToLower(password)
+	email = strings.ToLower(email)
+
+	if strings.Contains(password, email) {
+		return true
+	}
+
+	local := email
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		local = email[:i]
+	}
+	return utf8.RuneCountInString(local) >= minEmailLocalPart && strings.Contains(password, local)
+}
+
+/**
+ * Checks the password of the user with the given email. Returns a
+ * `*PolicyError` with all the violated rules, other errors are returned
+ * if the blocklist could not be read.
+ */
+func (p *Policy) Check(password, email string) error {
+	violations := []Violation{}
+
+	if length := utf8.RuneCountInString(password); length < p.MinLength {
+		violations = append(violations, Violation{
+			Rule:    RuleMinLength,
+			Message: fmt.Sprintf("Password should be at least %d characters long", p.MinLength),
+		})
+	}
+
+	if max := p.maxSize(); len(password) > max {
+		violations = append(violations, Violation{
+			Rule:    RuleMaxLength,
+			Message: fmt.Sprintf("Password should be at most %d bytes long", max),
+		})
+	}
+
+	if characterClasses(password) < p.MinClasses {
+		violations = append(violations, Violation{
+			Rule:    RuleClasses,
+			Message: fmt.Sprintf("Password should contain at least %d of lowercase, uppercase, digits and symbols", p.MinClasses),
+		})
+	}
+
+	if containsEmail(password, email) {
+		violations = append(violations, Violation{
+			Rule:    RuleEmail,
+			Message: "Password should not contain the email",
+		})
+	}
+
+	if p.Blocklist != nil {
+		breached, err := p.Blocklist.Contains(password)
+		if err != nil {
+			return err
+		}
+
+		if breached {
+			violations = append(violations, Violation{
+				Rule:    RuleBlocklist,
+				Message: "Password appeared in a data breach",
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
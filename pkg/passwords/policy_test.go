@@ -0,0 +1,146 @@
+package passwords_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/passwords"
+)
+
+/**
+ * Writes a blocklist in the HIBP format with the given passwords, and
+ * some filler hashes around them
+ */
+func writeBlocklist(t *testing.T, breached ...string) string {
+	t.Helper()
+
+	lines := []string{}
+	for i, password := range breached {
+		sum := sha1.Sum([]byte(password))
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i+1))
+	}
+	for i := 0; i < 500; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprintf("filler-%d", i)))
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i+1))
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned-passwords-sha1.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0600); err != nil {
+		t.Fatalf("Unable to write blocklist: %v", err)
+	}
+	return path
+}
+
+func rules(err error) []string {
+	var policyErr *passwords.PolicyError
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+
+	rules := []string{}
+	for _, violation := range policyErr.Violations {
+		rules = append(rules, violation.Rule)
+	}
+	return rules
+}
+
+func TestBlocklist(t *testing.T) {
+	breached := []string{"password", "123456", "qwerty", "correct horse battery staple"}
+	blocklist, err := passwords.OpenBlocklist(writeBlocklist(t, breached...))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer blocklist.Close()
+
+	for _, password := range breached {
+		found, err := blocklist.Contains(password)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !found {
+			t.Errorf("Password %q should be in the blocklist", password)
+		}
+	}
+
+	for _, password := range []string{"", "Password", "filler", "2jH*c9!qLw"} {
+		found, err := blocklist.Contains(password)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if found {
+			t.Errorf("Password %q should not be in the blocklist", password)
+		}
+	}
+
+	t.Run("Missing file should return error", func(t *testing.T) {
+		_, err := passwords.OpenBlocklist(filepath.Join(t.TempDir(), "missing.txt"))
+		if err == nil {
+			t.Errorf("Expected error opening missing blocklist")
+		}
+	})
+}
+
+func TestPolicyCheck(t *testing.T) {
+	blocklist, err := passwords.OpenBlocklist(writeBlocklist(t, "Password1!"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer blocklist.Close()
+
+	policy := passwords.Policy{
+		MinLength:  8,
+		MinClasses: 3,
+		Blocklist:  blocklist,
+	}
+
+	tt := []struct {
+		Name     string
+		Policy   passwords.Policy
+		Password string
+		Email    string
+		Rules    []string
+	}{
+		{"Valid password", policy, "Tr0ub4dor&3", "john@example.com", nil},
+		{"Length counts characters", policy, "ääääÄÄ1", "", []string{passwords.RuleMinLength}},
+		{"Short password", policy, "aB1!", "", []string{passwords.RuleMinLength}},
+		{"Few classes", policy, "abcdefgh1", "", []string{passwords.RuleClasses}},
+		{"Contains email", policy, "X1!john@example.com", "John@Example.com", []string{passwords.RuleEmail}},
+		{"Contains local part", policy, "X1!JOHN.doe", "john.doe@example.com", []string{passwords.RuleEmail}},
+		{"Short local part", policy, "Alp#ine9", "al@example.com", nil},
+		{"Short local part in full email", policy, "X1!al@example.com", "al@example.com", []string{passwords.RuleEmail}},
+		{"Breached password", policy, "Password1!", "", []string{passwords.RuleBlocklist}},
+		{
+			"Bcrypt limit", passwords.Policy{Algorithm: passwords.Bcrypt},
+			strings.Repeat("a", 73), "", []string{passwords.RuleMaxLength},
+		},
+		{"Default limit", passwords.Policy{}, strings.Repeat("a", 1024), "", nil},
+		{"Multiple violations", policy, "abcd", "abcd@example.com", []string{
+			passwords.RuleMinLength, passwords.RuleClasses, passwords.RuleEmail,
+		}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := tc.Policy.Check(tc.Password, tc.Email)
+			if tc.Rules == nil {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+
+			got := rules(err)
+			if strings.Join(got, ",") != strings.Join(tc.Rules, ",") {
+				t.Errorf("want: %v, got: %v (%v)", tc.Rules, got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+/**
+ * Scope grant engine. Requested scopes are matched against the scope
+ * definitions, each matching definition adds its grant to the claims of
+ * the access token.
+ */
+package scopes
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Requesting this scope grants all the scopes without parameters
+const AllScopes = "*"
+
+/**
+ * Scope definition, as stored in the `scopes` collection.
+ * `Grant` is a json-like template, strings could contain the backreferences
+ * `\1`...`\9` to the groups captured by `Pattern`, `\0` is the whole scope.
+ */
+type Scope struct {
+	Pattern string
+	Groups  []string // optional, user should be in at least one of them
+	Grant   map[string]interface{}
+}
+
+// Result of the evaluation of the requested scopes
+type Grant struct {
+	Scopes []string               // granted scopes
+	Claims map[string]interface{} // claims to be merged in the access token
+}
+
+// Compiles the pattern, anchored to match the whole scope
+func (scope *Scope) compile() (*regexp.Regexp, error) {
+	// the pattern is checked on its own, so unbalanced parentheses
+	// could not escape the anchors
+	if _, err := regexp.Compile(scope.Pattern); err != nil {
+		return nil, fmt.Errorf("Invalid scope pattern %q: %v", scope.Pattern, err)
+	}
+	return regexp.Compile("^(?:" + scope.Pattern + ")$")
+}
+
+func (scope *Scope) allows(groups []string) bool {
+	if len(scope.Groups) == 0 {
+		return true
+	}
+
+	for _, allowed := range scope.Groups {
+		for _, group := range groups {
+			if allowed == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/**
+ * Evaluates the requested scopes (space separated) for a user belonging
+ * to the given groups. Requested scopes not matching any definition are
+ * not granted.
+ * Definitions with invalid patterns are ignored.
+ */
+func Evaluate(definitions []Scope, requested string, groups []string) *Grant {
+	grant := &Grant{
+		Scopes: []string{},
+		Claims: map[string]interface{}{},
+	}
+
+	patterns := make([]*regexp.Regexp, len(definitions))
+	for i := range definitions {
+		patterns[i], _ = definitions[i].compile()
+	}
+
+	for _, name := range expand(definitions, strings.Fields(requested)) {
+		granted := false
+
+		for i, definition := range definitions {
+			if patterns[i] == nil || !definition.allows(groups) {
+				continue
+			}
+
+			matches := patterns[i].FindStringSubmatch(name)
+			if matches == nil {
+				continue
+			}
+
+			granted = true
+			claims, _ := render(definition.Grant, matches).(map[string]interface{})
+			merge(grant.Claims, claims)
+		}
+
+		if granted && !contains(grant.Scopes, name) {
+			grant.Scopes = append(grant.Scopes, name)
+		}
+	}
+	return grant
+}
+
+// Replaces `AllScopes` with the definitions matching a single value
+func expand(definitions []Scope, requested []string) []string {
+	names := []string{}
+	for _, name := range requested {
+		if name == AllScopes {
+			names = append(names, Literals(definitions)...)
+		} else {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+/**
+ * Returns the scopes of the definitions whose pattern matches a
+ * single value, the only ones that could be listed.
+ */
+func Literals(definitions []Scope) []string {
+	names := []string{}
+	for _, definition := range definitions {
+		if _, err := definition.compile(); err != nil {
+			continue
+		}
+
+		reg := regexp.MustCompile(definition.Pattern)
+		if literal, complete := reg.LiteralPrefix(); complete && literal != "" {
+			names = append(names, literal)
+		}
+	}
+	return names
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the backreferences in the string with the captured groups
+func substitute(template string, matches []string) string {
+	var result strings.Builder
+
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '\\' || i+1 == len(template) {
+			result.WriteByte(c)
+			continue
+		}
+
+		next := template[i+1]
+		switch {
+		case next == '\\':
+			result.WriteByte('\\')
+			i++
+		case next >= '0' && next <= '9':
+			if index := int(next - '0'); index < len(matches) {
+				result.WriteString(matches[index])
+			}
+			i++
+		default:
+			result.WriteByte(c)
+		}
+	}
+	return result.String()
+}
+
+// Copies the template, expanding the backreferences of every string
+func render(template interface{}, matches []string) interface{} {
+	switch value := template.(type) {
+	case string:
+		return substitute(value, matches)
+
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			rendered[substitute(key, matches)] = render(item, matches)
+		}
+		return rendered
+
+	case []interface{}:
+		rendered := make([]interface{}, len(value))
+		for i, item := range value {
+			rendered[i] = render(item, matches)
+		}
+		return rendered
+
+	default:
+		return value
+	}
+}
+
+/**
+ * Merges src into dst: objects are merged recursively, arrays are
+ * concatenated skipping duplicates, other values are replaced.
+ */
+func merge(dst, src map[string]interface{}) {
+	for key, value := range src {
+		switch existing := dst[key].(type) {
+		case map[string]interface{}:
+			if srcMap, ok := value.(map[string]interface{}); ok {
+				merge(existing, srcMap)
+				continue
+			}
+
+		case []interface{}:
+			if srcSlice, ok := value.([]interface{}); ok {
+				for _, item := range srcSlice {
+					if !containsValue(existing, item) {
+						existing = append(existing, item)
+					}
+				}
+				dst[key] = existing
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
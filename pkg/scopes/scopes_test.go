@@ -0,0 +1,160 @@
+package scopes_test
+
+import (
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/scopes"
+	"gotest.tools/assert"
+)
+
+// Scope of the docker registry example, in docs/schema.md
+var repositoryScope = scopes.Scope{
+	Pattern: "repository:(.*):(.*)",
+	Grant: map[string]interface{}{
+		"access": []interface{}{
+			map[string]interface{}{
+				"type":    "repository",
+				"name":    "\\1",
+				"actions": []interface{}{"\\2"},
+			},
+		},
+	},
+}
+
+func TestEvaluate(t *testing.T) {
+	t.Run("backreferences should be expanded in the grant", func(t *testing.T) {
+		grant := scopes.Evaluate([]scopes.Scope{repositoryScope}, "repository:samalba/my-app:pull", nil)
+
+		assert.DeepEqual(t, grant.Scopes, []string{"repository:samalba/my-app:pull"})
+		assert.DeepEqual(t, grant.Claims, map[string]interface{}{
+			"access": []interface{}{
+				map[string]interface{}{
+					"type":    "repository",
+					"name":    "samalba/my-app",
+					"actions": []interface{}{"pull"},
+				},
+			},
+		})
+	})
+
+	t.Run("grants of multiple scopes should be merged", func(t *testing.T) {
+		definitions := []scopes.Scope{
+			repositoryScope,
+			{
+				Pattern: "profile:read",
+				Grant: map[string]interface{}{
+					"permissions": map[string]interface{}{"profile": "read"},
+				},
+			},
+			{
+				Pattern: "billing:(read|write)",
+				Grant: map[string]interface{}{
+					"permissions": map[string]interface{}{"billing": "\\1"},
+				},
+			},
+		}
+
+		grant := scopes.Evaluate(definitions, "repository:a:pull repository:b:push profile:read billing:write", nil)
+
+		assert.DeepEqual(t, grant.Claims, map[string]interface{}{
+			"access": []interface{}{
+				map[string]interface{}{"type": "repository", "name": "a", "actions": []interface{}{"pull"}},
+				map[string]interface{}{"type": "repository", "name": "b", "actions": []interface{}{"push"}},
+			},
+			"permissions": map[string]interface{}{
+				"profile": "read",
+				"billing": "write",
+			},
+		})
+	})
+
+	t.Run("duplicated grants should be added once", func(t *testing.T) {
+		grant := scopes.Evaluate([]scopes.Scope{repositoryScope}, "repository:a:pull repository:a:pull", nil)
+
+		assert.DeepEqual(t, grant.Scopes, []string{"repository:a:pull"})
+		assert.Equal(t, len(grant.Claims["access"].([]interface{})), 1)
+	})
+
+	t.Run("unknown scopes should not be granted", func(t *testing.T) {
+		grant := scopes.Evaluate([]scopes.Scope{repositoryScope}, "admin repository:x", nil)
+
+		assert.DeepEqual(t, grant.Scopes, []string{})
+		assert.DeepEqual(t, grant.Claims, map[string]interface{}{})
+	})
+
+	t.Run("patterns should match the whole scope", func(t *testing.T) {
+		definitions := []scopes.Scope{{Pattern: "read", Grant: map[string]interface{}{"read": true}}}
+
+		grant := scopes.Evaluate(definitions, "unread readonly", nil)
+		assert.DeepEqual(t, grant.Scopes, []string{})
+	})
+
+	t.Run("scopes restricted to groups should be granted only to members", func(t *testing.T) {
+		definitions := []scopes.Scope{{
+			Pattern: "project:(\\w+):admin",
+			Groups:  []string{"admin", "manager"},
+			Grant:   map[string]interface{}{"admin_of": []interface{}{"\\1"}},
+		}}
+
+		grant := scopes.Evaluate(definitions, "project:oauth:admin", []string{"users"})
+		assert.DeepEqual(t, grant.Scopes, []string{})
+
+		grant = scopes.Evaluate(definitions, "project:oauth:admin", []string{"users", "manager"})
+		assert.DeepEqual(t, grant.Scopes, []string{"project:oauth:admin"})
+		assert.DeepEqual(t, grant.Claims["admin_of"], []interface{}{"oauth"})
+	})
+
+	t.Run("all scopes without parameters should be granted with *", func(t *testing.T) {
+		definitions := []scopes.Scope{
+			repositoryScope,
+			{Pattern: "metrics:read", Grant: map[string]interface{}{"metrics": "read"}},
+			{Pattern: "metrics:write", Groups: []string{"admin"}, Grant: map[string]interface{}{"metrics": "write"}},
+		}
+
+		grant := scopes.Evaluate(definitions, scopes.AllScopes, nil)
+		assert.DeepEqual(t, grant.Scopes, []string{"metrics:read"})
+		assert.DeepEqual(t, grant.Claims, map[string]interface{}{"metrics": "read"})
+	})
+
+	t.Run("invalid patterns should be ignored", func(t *testing.T) {
+		definitions := []scopes.Scope{
+			{Pattern: "broken(", Grant: map[string]interface{}{"broken": true}},
+			{Pattern: "a)|(b", Grant: map[string]interface{}{"injected": true}},
+			{Pattern: "valid", Grant: map[string]interface{}{"valid": true}},
+		}
+
+		grant := scopes.Evaluate(definitions, "valid broken( * b", nil)
+		assert.DeepEqual(t, grant.Scopes, []string{"valid"})
+	})
+
+	t.Run("escaped backslashes and missing groups should be handled", func(t *testing.T) {
+		definitions := []scopes.Scope{{
+			Pattern: "path:(.*)",
+			Grant: map[string]interface{}{
+				"path":    "C:\\\\\\1",
+				"missing": "\\5",
+				"whole":   "\\0",
+				"number":  42.0,
+			},
+		}}
+
+		grant := scopes.Evaluate(definitions, "path:tmp", nil)
+		assert.DeepEqual(t, grant.Claims, map[string]interface{}{
+			"path":    "C:\\tmp",
+			"missing": "",
+			"whole":   "path:tmp",
+			"number":  42.0,
+		})
+	})
+}
+
+func TestLiterals(t *testing.T) {
+	definitions := []scopes.Scope{
+		repositoryScope,
+		{Pattern: "metrics:read"},
+		{Pattern: "broken("},
+		{Pattern: "metrics:write"},
+	}
+
+	assert.DeepEqual(t, scopes.Literals(definitions), []string{"metrics:read", "metrics:write"})
+}
@@ -0,0 +1,23 @@
+/**
+ * Http server of the application, routes the requests to the
+ * handlers with the given configuration.
+ */
+package server
+
+import (
+	"net/http"
+
+	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"github.com/ale-cci/oauthsrv/pkg/mux"
+)
+
+/**
+ * Builds the handler of the server, with all the routes registered
+ */
+func New(cnf *handlers.Config) http.Handler {
+	router := mux.NewServeMux()
+	// added to the main router, so unknown paths are logged too
+	router.Use(handlers.LogRequests)
+	handlers.AddRoutes(cnf, router)
+	return router
+}
@@ -0,0 +1,77 @@
+package server_test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ale-cci/oauthsrv/pkg/handlers"
+	"github.com/ale-cci/oauthsrv/pkg/keystore"
+	"github.com/ale-cci/oauthsrv/pkg/server"
+	"gotest.tools/assert"
+)
+
+func TestNew(t *testing.T) {
+	ks, err := keystore.NewTempKeystore()
+	assert.NilError(t, err)
+
+	srv := httptest.NewServer(server.New(&handlers.Config{Keystore: ks}))
+	defer srv.Close()
+
+	tt := []struct {
+		Method string
+		Path   string
+		Status int
+	}{
+		{"GET", "/.well-known/jwks.json", http.StatusOK},
+		// parametrised routes should be reachable
+		{"GET", "/api/users/some-user/groups", http.StatusBadRequest},
+		{"GET", "/oauth/v2/token", http.StatusMethodNotAllowed},
+		{"GET", "/missing", http.StatusNotFound},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Method+" "+tc.Path, func(t *testing.T) {
+			req, err := http.NewRequest(tc.Method, srv.URL+tc.Path, nil)
+			assert.NilError(t, err)
+
+			resp, err := srv.Client().Do(req)
+			assert.NilError(t, err)
+			assert.Equal(t, resp.StatusCode, tc.Status)
+		})
+	}
+
+	t.Run("api routes should answer unknown methods without access token", func(t *testing.T) {
+		tt := []struct {
+			Method string
+			Status int
+		}{
+			{"OPTIONS", http.StatusNoContent},
+			{"PUT", http.StatusMethodNotAllowed},
+		}
+
+		for _, tc := range tt {
+			req, err := http.NewRequest(tc.Method, srv.URL+"/api/v1/users", nil)
+			assert.NilError(t, err)
+
+			resp, err := srv.Client().Do(req)
+			assert.NilError(t, err)
+			assert.Equal(t, resp.StatusCode, tc.Status)
+			assert.Equal(t, resp.Header.Get("allow"), "GET, HEAD, OPTIONS, POST")
+		}
+	})
+	t.Run("unknown paths should be logged", func(t *testing.T) {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		defer log.SetOutput(os.Stderr)
+
+		resp, err := srv.Client().Get(srv.URL + "/missing")
+		assert.NilError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+		assert.Check(t, strings.Contains(buf.String(), "GET /missing 404"), buf.String())
+	})
+}